@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the parts of their data a user can share with a link, each data router checks its own scope
+// and profile lets the other user see the sharing user's account details at GET /users/{uid}
+const (
+	ScopeTremors   = "tremors"
+	ScopeMeds      = "meds"
+	ScopeExercises = "exercises"
+	ScopeProfile   = "profile"
+)
+
+// links which don't say otherwise share everything
+var linkScopes = Scopes{ScopeTremors, ScopeMeds, ScopeExercises, ScopeProfile}
+
+// Words are stored in the database as a space separated list, so none of them can have a space in it
+type Words []string
+
+func (w *Words) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		*w = strings.Fields(src)
+	case []byte:
+		*w = strings.Fields(string(src))
+	case nil:
+		*w = nil
+	default:
+		return fmt.Errorf("can't scan %T into words", src)
+	}
+	return nil
+}
+
+func (w Words) Value() (driver.Value, error) {
+	return strings.Join(w, " "), nil
+}
+
+// Scopes are what a link, share or api key gives access to
+type Scopes = Words
+
+// A Grant is what a link lets the other user see: the scopes shared, only data from DataFrom to DataTo
+// if they are set, and only until EndsAt if it is set. A nil Grant means the data is the user's own,
+// so it allows everything.
+type Grant struct {
+	Scopes   Scopes     `json:"scopes"`
+	DataFrom *time.Time `json:"dataFrom"`
+	DataTo   *time.Time `json:"dataTo"`
+	EndsAt   *time.Time `json:"endsAt"`
+	// lets the other user add records in the shared scopes, eg. a caregiver. Only links can allow this.
+	CanWrite bool `json:"canWrite"`
+}
+
+func (g *Grant) Has(scope string) bool {
+	return g == nil || hasScope(g.Scopes, scope)
+}
+
+// returns true if data recorded at t is inside the shared window
+func (g *Grant) Covers(t time.Time) bool {
+	if g == nil {
+		return true
+	}
+	return (g.DataFrom == nil || !t.Before(*g.DataFrom)) && (g.DataTo == nil || !t.After(*g.DataTo))
+}
+
+// narrows a window of data from from to to, either of which can be nil, to the shared window
+func (g *Grant) Window(from, to *time.Time) (*time.Time, *time.Time) {
+	if g == nil {
+		return from, to
+	}
+	if g.DataFrom != nil && (from == nil || from.Before(*g.DataFrom)) {
+		from = g.DataFrom
+	}
+	if g.DataTo != nil && (to == nil || to.After(*g.DataTo)) {
+		to = g.DataTo
+	}
+	return from, to
+}
+
+// returns true if something running from start until end, or forever if end is nil,
+// is inside the shared window for at least part of that time
+func (g *Grant) Overlaps(start time.Time, end *time.Time) bool {
+	if g == nil {
+		return true
+	}
+	return (g.DataTo == nil || !start.After(*g.DataTo)) && (g.DataFrom == nil || end == nil || !end.Before(*g.DataFrom))
+}
+
+// checks a grant sent by a user, filling in every scope if none were given
+func (g *Grant) validate() error {
+	if len(g.Scopes) == 0 {
+		g.Scopes = append(Scopes{}, linkScopes...)
+	}
+	for _, scope := range g.Scopes {
+		if !hasScope(linkScopes, scope) {
+			return errors.New("unknown scope " + scope)
+		}
+	}
+	if g.DataFrom != nil && g.DataTo != nil && g.DataTo.Before(*g.DataFrom) {
+		return errors.New("dataTo is before dataFrom")
+	}
+	if g.EndsAt != nil && !g.EndsAt.After(time.Now()) {
+		return errors.New("endsAt must be in the future")
+	}
+	return nil
+}
+
+// returns a grant of owner's data to viewer which includes scope, from a link or through an organization
+// viewer is a member of, or nil if there isn't one. A link comes first, then organizations in no particular order.
+func findGrant(userRepo UserRepo, orgRepo OrgRepo, owner, viewer int64, scope string) (*Grant, error) {
+	grant, err := userRepo.GetGrant(owner, viewer)
+	if err != nil {
+		return nil, err
+	}
+	if grant != nil && grant.Has(scope) {
+		return grant, nil
+	}
+	grants, err := orgRepo.GetOrgGrants(owner, viewer)
+	if err != nil {
+		return nil, err
+	}
+	for i := range grants {
+		if grants[i].Has(scope) {
+			return &grants[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// returns who entered a record for forUid, which is nil when it is the user themselves
+func enteredBy(tokenUid, forUid int64) *int64 {
+	if tokenUid == forUid {
+		return nil
+	}
+	return &tokenUid
+}
+
+// records added for another user have to be dated within what they share
+var errOutsideGrant = errors.New("outside the window of data shared with you")
+
+// returns the grant from the request context, added by accessMiddleware
+func requestGrant(r *http.Request) *Grant {
+	grant, _ := r.Context().Value("grant").(*Grant)
+	return grant
+}
+
+// accessMiddleware decides whose data a request is for, and makes sure the logged-in user is
+// allowed to see it. Every data router is wrapped with this so handlers never parse ?uid= themselves,
+// they just read "forUid" from the request context, and filter what they return by the "grant".
+func accessMiddleware(userRepo UserRepo, orgRepo OrgRepo, scope string, next http.Handler) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		// default to the logged in user
+		forUid := tokenUid
+
+		// if the logged in user is trying to access the data of another user
+		if requestedUidString := r.URL.Query().Get("uid"); requestedUidString != "" {
+			var err error
+			forUid, err = strconv.ParseInt(requestedUidString, 10, 64)
+			if err != nil {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+
+		auditSubject(r, forUid)
+
+		var grant *Grant
+		if forUid != tokenUid {
+			// shared data is read-only, except that links can let the other user add records.
+			// Nobody can ever change or delete another user's records.
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				status := http.StatusForbidden
+				return HandlerError{errors.New(http.StatusText(status)), status}
+			}
+			// make sure that user has actually shared this with us
+			var err error
+			grant, err = findGrant(userRepo, orgRepo, forUid, tokenUid, scope)
+			if err != nil {
+				return err
+			}
+			if grant == nil || (r.Method == http.MethodPost && !grant.CanWrite) {
+				status := http.StatusForbidden
+				return HandlerError{errors.New(http.StatusText(status)), status}
+			}
+		}
+
+		// set the uid whose data is being accessed in the request context and pass on the request
+		ctx := context.WithValue(r.Context(), "forUid", forUid)
+		ctx = context.WithValue(ctx, "grant", grant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+		return nil
+	}
+}
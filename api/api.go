@@ -10,19 +10,66 @@ type DataStore struct {
 	MedicineRepo
 	ExerciseRepo
 	UserRepo
+	TokenRepo
+	MFARepo
+	APIKeyRepo
+	OIDCRepo
+	ShareRepo
+	OrgRepo
+	AuditRepo
+	SampleRepo
+	RescoreRepo
 }
 type Env struct {
 	DataStore
 	Reboot chan struct{}
+	Keys   *Keyring
+	Mailer Mailer
+	Policy Policy
+	Limits Limits
+	// OpenID Connect identity providers by name
+	OIDC map[string]*OIDCProvider
+	// runs rescore jobs in the background, see Rescorer
+	Rescorer *Rescorer
+}
+
+// A Mailer sends plain text email to users, see the mailer package
+type Mailer interface {
+	Send(to, subject, body string) error
 }
 
 func NewRouter(env *Env) *mux.Router {
 	r := mux.NewRouter()
-	r.PathPrefix("/tremors").Handler(authMiddleware(tremorsRouter(env.DataStore.TremorRepo)))
-	r.PathPrefix("/meds").Handler(authMiddleware(medsRouter(env.DataStore.MedicineRepo)))
-	r.PathPrefix("/exercises").Handler(authMiddleware(exercisesRouter(env.DataStore.ExerciseRepo)))
-	r.PathPrefix("/users").Handler(authMiddleware(userRouter(env.DataStore.UserRepo)))
-	r.PathPrefix("/auth").Handler(authRouter(env.DataStore.UserRepo))
+	tokenRepo, apiKeyRepo, keys := env.DataStore.TokenRepo, env.DataStore.APIKeyRepo, env.Keys
+	auditRepo := env.DataStore.AuditRepo
+	// every request which can read or change user data or accounts is audited, even without a valid token
+	r.PathPrefix("/tremors").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, apiKeyRepo, keys,
+		scopeMiddleware("tremors", accessMiddleware(env.DataStore.UserRepo, env.DataStore.OrgRepo, ScopeTremors,
+			tremorsRouter(env.DataStore.TremorRepo, env.DataStore.SampleRepo))))))
+	r.PathPrefix("/meds").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, apiKeyRepo, keys,
+		scopeMiddleware("meds", accessMiddleware(env.DataStore.UserRepo, env.DataStore.OrgRepo, ScopeMeds,
+			medsRouter(env.DataStore.MedicineRepo))))))
+	r.PathPrefix("/exercises").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, apiKeyRepo, keys,
+		scopeMiddleware("exercises", accessMiddleware(env.DataStore.UserRepo, env.DataStore.OrgRepo, ScopeExercises,
+			exercisesRouter(env.DataStore.ExerciseRepo))))))
+	// api keys can't be used to manage the account, or they could be used to create more keys
+	r.PathPrefix("/users").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, nil, keys,
+		userRouter(env.DataStore.UserRepo, tokenRepo, env.DataStore.MFARepo, apiKeyRepo, env.DataStore.ShareRepo,
+			env.DataStore.OrgRepo, auditRepo, keys, env.Mailer, env.Policy, env.Limits))))
+	r.PathPrefix("/orgs").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, nil, keys,
+		orgsRouter(env.DataStore.OrgRepo, env.DataStore.UserRepo))))
+	r.PathPrefix("/clinician").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, nil, keys,
+		roleMiddleware(env.DataStore.UserRepo, RoleClinician,
+			clinicianRouter(env.DataStore.UserRepo, env.DataStore.OrgRepo, env.DataStore.TremorRepo)))))
+	r.PathPrefix("/admin").Handler(auditMiddleware(auditRepo, authMiddleware(tokenRepo, nil, keys,
+		roleMiddleware(env.DataStore.UserRepo, RoleAdmin, adminRouter(env.DataStore.UserRepo, auditRepo,
+			env.DataStore.RescoreRepo, env.Rescorer)))))
+	// anyone with a share token can read what it shares, without signing in
+	r.Handle("/share/{token}", ipRateLimit(env.Limits.Share, auditMiddleware(auditRepo, getSharedData(env.DataStore.ShareRepo,
+		env.DataStore.UserRepo, env.DataStore.TremorRepo, env.DataStore.MedicineRepo, env.DataStore.ExerciseRepo,
+		keys)))).Methods(http.MethodGet)
+	r.PathPrefix("/auth").Handler(auditMiddleware(auditRepo, authRouter(env.DataStore.UserRepo, tokenRepo,
+		env.DataStore.MFARepo, apiKeyRepo, env.DataStore.OIDCRepo, keys, env.Mailer, env.Limits, env.OIDC)))
 	r.Handle("/update", update(env.Reboot)).Methods(http.MethodPost)
 	return r
 }
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// every api key starts with this, so they are easy to tell apart from JWTs and to find in leaked logs
+const apiKeyPrefix = "tremr_"
+
+// the operations an api key can be allowed to do, reads are GET requests and writes are everything else
+var apiKeyScopes = map[string]bool{
+	"tremors:read":    true,
+	"tremors:write":   true,
+	"meds:read":       true,
+	"meds:write":      true,
+	"exercises:read":  true,
+	"exercises:write": true,
+}
+
+// An APIKey is a long-lived credential for a device which can't sign in with a password,
+// eg. a wearable sensor posting tremors. Only a hash of the key itself is stored,
+// the Prefix is kept so users can tell their keys apart.
+type APIKey struct {
+	Kid      int64      `json:"kid"`
+	Uid      int64      `json:"-"`
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix"`
+	Scopes   Scopes     `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed"`
+}
+
+type APIKeyRepo interface {
+	AddAPIKey(key *APIKey, hash string) error
+	GetAPIKeys(uid int64) ([]APIKey, error)
+	// returns the key with this hash and records that it was used
+	UseAPIKey(hash string) (APIKey, error)
+	// returns false if the user has no key with this kid
+	DeleteAPIKey(uid, kid int64) (bool, error)
+	DeleteAPIKeys(uid int64) error
+}
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeMiddleware makes sure requests made with an api key have the scope for resource,
+// requests from a signed in session can do anything
+func scopeMiddleware(resource string, next http.Handler) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get api key scopes, added to context by authMiddleware
+		if scopes, ok := r.Context().Value("scopes").([]string); ok {
+			scope := resource + ":write"
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				scope = resource + ":read"
+			}
+			if !hasScope(scopes, scope) {
+				return HandlerError{errors.New("api key does not have the " + scope + " scope"), http.StatusForbidden}
+			}
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+func getAPIKeys(apiKeyRepo APIKeyRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		apiKeys, err := apiKeyRepo.GetAPIKeys(uid)
+		if err != nil {
+			return err
+		}
+		if apiKeys == nil {
+			apiKeys = []APIKey{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(apiKeys)
+		return nil
+	}
+}
+
+func createAPIKey(apiKeyRepo APIKeyRepo) HttpErrorHandler {
+	type newAPIKey struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var apiKey APIKey
+		if err := json.NewDecoder(r.Body).Decode(&apiKey); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if len(apiKey.Name) < 1 {
+			return HandlerError{errors.New("api key must have a name"), http.StatusBadRequest}
+		}
+		if len(apiKey.Scopes) == 0 {
+			return HandlerError{errors.New("api key must have at least one scope"), http.StatusBadRequest}
+		}
+		for _, scope := range apiKey.Scopes {
+			if !apiKeyScopes[scope] {
+				return HandlerError{errors.New("unknown scope " + scope), http.StatusBadRequest}
+			}
+		}
+
+		secret, err := randomString(32)
+		if err != nil {
+			return err
+		}
+		key := apiKeyPrefix + secret
+		apiKey.Uid = uid
+		apiKey.Prefix = key[:len(apiKeyPrefix)+6]
+		apiKey.Created = time.Now()
+		apiKey.LastUsed = nil
+		if err := apiKeyRepo.AddAPIKey(&apiKey, hashToken(key)); err != nil {
+			return err
+		}
+
+		// this is the only time the key itself is ever shown
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newAPIKey{apiKey, key})
+		return nil
+	}
+}
+
+func revokeAPIKey(apiKeyRepo APIKeyRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		kid, err := strconv.ParseInt(mux.Vars(r)["kid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := apiKeyRepo.DeleteAPIKey(uid, kid)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("no such api key"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+// checks the api key from an Authorization header, returning its uid and scopes.
+// A nil repo means the endpoint is only for signed in sessions.
+func authenticateAPIKey(apiKeyRepo APIKeyRepo, key string) (int64, []string, error) {
+	if apiKeyRepo == nil {
+		return 0, nil, HandlerError{errors.New("api keys can't be used here"), http.StatusForbidden}
+	}
+	apiKey, err := apiKeyRepo.UseAPIKey(hashToken(key))
+	if err == ErrInvalidAPIKey {
+		return 0, nil, HandlerError{err, http.StatusUnauthorized}
+	} else if err != nil {
+		return 0, nil, err
+	}
+	return apiKey.Uid, apiKey.Scopes, nil
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
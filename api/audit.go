@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Outcomes of audited requests
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+	AuditFailed  = "failed"
+)
+
+// An AuditEntry says that the actor read or changed the subject's data. Share links have no actor, since
+// whoever has the link reads the data anonymously, and neither do requests refused before it was known who
+// made them. Resource is the route, eg. /tremors/{tid}, so ids and tokens in urls are never stored. Status
+// is the http status of the response.
+type AuditEntry struct {
+	Aid       int64     `json:"aid"`
+	Actor     *int64    `json:"actor"`
+	Subject   int64     `json:"subject"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"`
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"requestId"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+}
+
+// AuditFilter selects audit entries, newest first. Anything left empty matches every entry,
+// OthersOnly leaves out what users did with their own data.
+type AuditFilter struct {
+	Actor      *int64
+	Subject    *int64
+	Action     string
+	Outcome    string
+	From       *time.Time
+	To         *time.Time
+	Before     *int64
+	OthersOnly bool
+	Limit      int
+}
+
+// The audit log can only be added to, entries are never changed or deleted, even with the user
+type AuditRepo interface {
+	Record(entry *AuditEntry) error
+	Query(filter AuditFilter) ([]AuditEntry, error)
+}
+
+var auditActions = map[string]string{
+	http.MethodGet:    "read",
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodDelete: "delete",
+}
+
+// the request's audit entry, and every user whose data it touches
+type auditRecord struct {
+	entry    AuditEntry
+	subjects []int64
+}
+
+// records the status written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// auditActor records who made the request, once authMiddleware has checked their token or they have
+// proven who they are some other way, eg. with their password
+func auditActor(r *http.Request, uid int64) {
+	if record, ok := r.Context().Value("audit").(*auditRecord); ok {
+		record.entry.Actor = &uid
+	}
+}
+
+// auditRoute is router middleware which records the matched route as the resource
+func auditRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if record, ok := r.Context().Value("audit").(*auditRecord); ok {
+			if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+				record.entry.Resource = template
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auditSubject marks the request as touching uid's data. Requests which never call this are about the
+// logged in user's own data.
+func auditSubject(r *http.Request, uid int64) {
+	if record, ok := r.Context().Value("audit").(*auditRecord); ok {
+		for _, subject := range record.subjects {
+			if subject == uid {
+				return
+			}
+		}
+		record.subjects = append(record.subjects, uid)
+	}
+}
+
+// auditMiddleware records every request to next in the audit log once it has been handled, with one
+// entry per user whose data it touched. It goes outside authMiddleware so requests without a valid token
+// are recorded too, and routers under it use auditRoute to fill in the resource. Requests which touched
+// nobody's data aren't recorded, eg. fetching the signing keys. Refused ones are only logged, since anyone
+// can send them and the audit log can't be cleaned up. The request id is taken from the X-Request-Id
+// header if a proxy set one, and sent back in the response.
+func auditMiddleware(auditRepo AuditRepo, next http.Handler) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" || len(requestId) > 64 {
+			var err error
+			if requestId, err = randomString(12); err != nil {
+				return err
+			}
+		}
+		w.Header().Set("X-Request-Id", requestId)
+
+		action, ok := auditActions[r.Method]
+		if !ok {
+			action = r.Method
+		}
+		record := &auditRecord{entry: AuditEntry{
+			Action:    action,
+			Time:      time.Now(),
+			RequestId: requestId,
+		}}
+		// until a router finds the exact route, this is the one the request was sent on to, eg. /tremors
+		if route := mux.CurrentRoute(r); route != nil {
+			record.entry.Resource, _ = route.GetPathTemplate()
+		}
+
+		recorder := &statusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), "audit", record)))
+
+		record.entry.Status = recorder.status
+		switch {
+		case recorder.status < http.StatusBadRequest:
+			record.entry.Outcome = AuditAllowed
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden ||
+			recorder.status == http.StatusNotFound:
+			record.entry.Outcome = AuditDenied
+		default:
+			record.entry.Outcome = AuditFailed
+		}
+		subjects := record.subjects
+		if len(subjects) == 0 && record.entry.Actor != nil {
+			subjects = []int64{*record.entry.Actor}
+		}
+		if len(subjects) == 0 && record.entry.Outcome != AuditAllowed {
+			log.Print("anonymous ", action, " of ", record.entry.Resource, " ", record.entry.Outcome, " with status ",
+				recorder.status, ", request id ", requestId)
+		}
+		// the response has already been sent, so a failure can only be logged
+		for _, subject := range subjects {
+			entry := record.entry
+			entry.Subject = subject
+			if err := auditRepo.Record(&entry); err != nil {
+				log.Print("failed to record audit entry: ", err)
+			}
+		}
+		return nil
+	}
+}
+
+func adminRouter(userRepo UserRepo, auditRepo AuditRepo, rescoreRepo RescoreRepo, rescorer *Rescorer) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(auditRoute)
+	router.Handle("/admin/users/{uid:[0-9]+}/role", setUserRole(userRepo)).Methods(http.MethodPut)
+	router.Handle("/admin/audit", queryAudit(auditRepo)).Methods(http.MethodGet)
+	router.Handle("/admin/rescore", startRescore(rescorer)).Methods(http.MethodPost)
+	router.Handle("/admin/rescore", getRescoreJobs(rescoreRepo)).Methods(http.MethodGet)
+	router.Handle("/admin/rescore/{jid:[0-9]+}", getRescoreJob(rescoreRepo)).Methods(http.MethodGet)
+	router.Handle("/admin/rescore/{jid:[0-9]+}", cancelRescore(rescorer)).Methods(http.MethodDelete)
+	router.Handle("/admin/rescore/{jid:[0-9]+}/results", getRescoreResults(rescoreRepo)).Methods(http.MethodGet)
+	return router
+}
+
+// parses ?actor=, ?subject=, ?action=, ?outcome=, ?from=, ?to=, ?before= and ?limit=
+func auditFilter(r *http.Request) (filter AuditFilter, err error) {
+	query := r.URL.Query()
+	for param, id := range map[string]**int64{"actor": &filter.Actor, "subject": &filter.Subject, "before": &filter.Before} {
+		if value := query.Get(param); value != "" {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return filter, HandlerError{err, http.StatusBadRequest}
+			}
+			*id = &i
+		}
+	}
+	for param, date := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, HandlerError{err, http.StatusBadRequest}
+			}
+			*date = &t
+		}
+	}
+	filter.Action = query.Get("action")
+	filter.Outcome = query.Get("outcome")
+	filter.Limit = defaultAuditLimit
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			err = errors.New("limit must be between 1 and " + strconv.Itoa(maxAuditLimit))
+			return filter, HandlerError{err, http.StatusBadRequest}
+		}
+	}
+	return filter, nil
+}
+
+func writeAudit(w http.ResponseWriter, auditRepo AuditRepo, filter AuditFilter) error {
+	entries, err := auditRepo.Query(filter)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(append([]AuditEntry{}, entries...))
+	return nil
+}
+
+// getAudit lets users see who else has read or changed their data, filtered like queryAudit
+func getAudit(auditRepo AuditRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		filter, err := auditFilter(r)
+		if err != nil {
+			return err
+		}
+		filter.Subject = &uid
+		filter.OthersOnly = true
+		return writeAudit(w, auditRepo, filter)
+	}
+}
+
+// queryAudit lets admins search the whole audit log
+func queryAudit(auditRepo AuditRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		filter, err := auditFilter(r)
+		if err != nil {
+			return err
+		}
+		return writeAudit(w, auditRepo, filter)
+	}
+}
@@ -9,39 +9,63 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
+	"unicode"
 )
 
-func authRouter(repo UserRepo) *mux.Router {
+func authRouter(repo UserRepo, tokenRepo TokenRepo, mfaRepo MFARepo, apiKeyRepo APIKeyRepo, oidcRepo OIDCRepo,
+	keys *Keyring, mailer Mailer, limits Limits, providers map[string]*OIDCProvider) *mux.Router {
 	router := mux.NewRouter()
-	router.Handle("/auth/signup", signup(repo)).Methods(http.MethodPost)
-	router.Handle("/auth/signin", signin(repo)).Methods(http.MethodPost)
+	router.Use(auditRoute)
+	router.Handle("/auth/signup", ipRateLimit(limits.Signup, signup(repo, tokenRepo, mailer))).Methods(http.MethodPost)
+	router.Handle("/auth/verify", verifyEmail(repo, tokenRepo)).Methods(http.MethodPost)
+	router.Handle("/auth/signin", ipRateLimit(limits.Signin, signin(repo, tokenRepo, mfaRepo, keys, limits.Account))).Methods(http.MethodPost)
+	router.Handle("/auth/signin/mfa", ipRateLimit(limits.MFA, signinMFA(repo, tokenRepo, mfaRepo, keys))).Methods(http.MethodPost)
+	router.Handle("/auth/refresh", refresh(tokenRepo, keys)).Methods(http.MethodPost)
+	router.Handle("/auth/signout", authMiddleware(tokenRepo, nil, keys, signout(tokenRepo))).Methods(http.MethodPost)
+	router.Handle("/auth/jwks.json", jwks(keys)).Methods(http.MethodGet)
+	router.Handle("/auth/reset/request", ipRateLimit(limits.Reset, requestPasswordReset(repo, tokenRepo, mailer))).Methods(http.MethodPost)
+	router.Handle("/auth/reset", resetPassword(repo, tokenRepo, apiKeyRepo)).Methods(http.MethodPost)
+	router.Handle("/auth/oidc", getOIDCProviders(providers)).Methods(http.MethodGet)
+	router.Handle("/auth/oidc/{provider}/login", ipRateLimit(limits.OIDC, oidcLogin(oidcRepo, providers))).Methods(http.MethodGet)
+	router.Handle("/auth/oidc/{provider}/callback",
+		oidcCallback(repo, tokenRepo, mfaRepo, oidcRepo, keys, providers)).Methods(http.MethodGet)
 	return router
 }
 
 func (user User) Valid() error {
-	if len(user.Email) < 3 {
-		return errors.New("invalid email")
+	if err := validEmail(user.Email); err != nil {
+		return err
 	}
-	if len(user.Password) < 6 {
-		return errors.New("password must be at least 6 characters")
+	if err := validPassword(user.Password); err != nil {
+		return err
 	}
-	if len(user.Name) < 1 {
+	if err := validName(user.Name); err != nil {
+		return err
+	}
+	if user.Role != "" && user.Role != RolePatient {
+		return errors.New("everyone signs up as a " + RolePatient)
+	}
+	return nil
+}
+
+// names go in the subjects of emails to other users, so line breaks and other control characters
+// aren't allowed
+func validName(name string) error {
+	if len(name) < 1 {
 		return errors.New("user must have a name")
 	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return errors.New("name can't contain control characters")
+	}
 	return nil
 }
 
 type ErrUserExists error
 type ErrUserDoesNotExist error
 
-func keyFunc(token *jwt.Token) (interface{}, error) {
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, errors.New("invalid signing method")
-	}
-	return []byte("Very Secret Key, Shhh....."), nil
-}
-
-func signup(userRepo UserRepo) HttpErrorHandler {
+func signup(userRepo UserRepo, tokenRepo TokenRepo, mailer Mailer) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// decode user details from request body
 		var user User
@@ -50,13 +74,11 @@ func signup(userRepo UserRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		// generate a bcrypt hash from the user's plaintext password
-		hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 10)
-		if err != nil {
+		// replace the password in the user struct with a bcrypt hash before sending to the database
+		var err error
+		if user.Password, err = hashPassword(user.Password); err != nil {
 			return err
 		}
-		// replace the password in the user struct with the bcrypt hash before sending to the database
-		user.Password = string(hash)
 
 		// add the new user to the database
 		if err = userRepo.Add(&user); err != nil {
@@ -67,11 +89,18 @@ func signup(userRepo UserRepo) HttpErrorHandler {
 				return err
 			}
 		}
+
+		auditActor(r, user.Uid)
+
+		// the account can be used straight away, but the user can resend this if it never arrives
+		if err := sendVerification(tokenRepo, mailer, user.UserWithoutPassword); err != nil {
+			log.Print("failed to send verification email: ", err)
+		}
 		return nil
 	}
 }
 
-func signin(userRepo UserRepo) HttpErrorHandler {
+func signin(userRepo UserRepo, tokenRepo TokenRepo, mfaRepo MFARepo, keys *Keyring, limiter RateLimiter) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// decode user details from request body
 		var user User
@@ -79,44 +108,82 @@ func signin(userRepo UserRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		// get stored user details
+		// limit guesses per account, no matter how many addresses they come from
+		if err := allow(limiter, NormalizeEmail(user.Email), w); err != nil {
+			return err
+		}
+
+		// unknown emails and locked accounts get the same answer as a wrong password, after as long,
+		// so signin doesn't tell anyone which accounts exist
+		incorrect := HandlerError{errors.New("incorrect email or password"), http.StatusUnauthorized}
 		storedUser, err := userRepo.GetFromEmail(user.Email)
 		if err != nil {
 			switch err.(type) {
 			case ErrUserDoesNotExist:
-				return HandlerError{errors.New("incorrect email or password"), http.StatusUnauthorized}
+				bcrypt.CompareHashAndPassword(dummyHash, []byte(user.Password))
+				return incorrect
 			default:
 				return err
 			}
 		}
 
+		auditSubject(r, storedUser.Uid)
+
+		// don't check the password of a locked account, so guesses can't be confirmed while it is locked
+		if storedUser.LockedUntil != nil && storedUser.LockedUntil.After(time.Now()) {
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(user.Password))
+			return incorrect
+		}
+
 		// compare the user's plaintext password with the stored hash
 		hash := []byte(storedUser.Password)
 		pwd := []byte(user.Password)
 		if err = bcrypt.CompareHashAndPassword(hash, pwd); err != nil {
-			return HandlerError{errors.New("incorrect email or password"), http.StatusUnauthorized}
+			if err := recordLoginFailure(userRepo, storedUser.Uid); err != nil {
+				return err
+			}
+			return incorrect
 		}
+		auditActor(r, storedUser.Uid)
 
-		// return a signed JSON Web Token which embeds the user's UID
-		// this token should be used in the Authorization header of requests to authenticated endpoints
-		// the token is all that the server needs in order to verify the user's UID
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": storedUser.Uid})
-		key, _ := keyFunc(token)
-		tokenString, err := token.SignedString(key)
+		// users with two-factor authentication have to send a code to /auth/signin/mfa first
+		enabled, err := mfaEnabled(mfaRepo, storedUser.Uid)
 		if err != nil {
 			return err
 		}
+		if enabled {
+			challenge, err := issueMFAChallenge(keys, storedUser.Uid)
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(challenge)
+			return nil
+		}
 
-		w.Write([]byte(tokenString))
+		// the failures are only cleared once the second factor has been passed too,
+		// otherwise knowing the password would allow unlimited guesses at the code
+		if storedUser.FailedLogins > 0 {
+			if err := userRepo.ClearLoginFailures(storedUser.Uid); err != nil {
+				return err
+			}
+		}
+
+		// return a short-lived signed JSON Web Token which embeds the user's UID,
+		// and a refresh token which can be exchanged for a new one at /auth/refresh
+		tokens, err := issueTokens(tokenRepo, keys, storedUser.Uid, "")
+		if err != nil {
+			return err
+		}
+		writeTokens(w, tokens)
 		return nil
 	}
 }
 
-func authMiddleware(next http.Handler) HttpErrorHandler {
-	parser := jwt.Parser{
-		ValidMethods:  []string{jwt.SigningMethodHS256.Alg()},
-		UseJSONNumber: true,
-	}
+// authMiddleware accepts either a JWT access token or an api key in the Authorization header.
+// Pass a nil apiKeyRepo for endpoints which should only be used by signed in sessions.
+func authMiddleware(tokenRepo TokenRepo, apiKeyRepo APIKeyRepo, keys *Keyring, next http.Handler) HttpErrorHandler {
+	parser := keys.parser()
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// get jwt token with claims
 		tokenString := r.Header.Get("Authorization")
@@ -124,25 +191,68 @@ func authMiddleware(next http.Handler) HttpErrorHandler {
 			status := http.StatusUnauthorized
 			return HandlerError{errors.New(http.StatusText(status)), status}
 		}
+
+		// api keys are limited to their scopes, which are checked by scopeMiddleware
+		if isAPIKey(tokenString) {
+			uid, scopes, err := authenticateAPIKey(apiKeyRepo, tokenString)
+			if err != nil {
+				return err
+			}
+			auditActor(r, uid)
+			ctx := context.WithValue(r.Context(), "uid", uid)
+			ctx = context.WithValue(ctx, "scopes", scopes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return nil
+		}
+
 		var claims jwt.MapClaims
-		if _, err := parser.ParseWithClaims(tokenString, &claims, keyFunc); err != nil {
+		if _, err := parser.ParseWithClaims(tokenString, &claims, keys.keyFunc); err != nil {
 			return HandlerError{err, http.StatusUnauthorized}
 		}
+		// the parser only checks exp if it is present, tokens without one are never accepted
+		if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+			return HandlerError{errors.New("token is expired"), http.StatusUnauthorized}
+		}
+
+		// mfa pending tokens only prove the password, they are only accepted by /auth/signin/mfa
+		if _, pending := claims["mfa"]; pending {
+			return HandlerError{errors.New("two-factor authentication required"), http.StatusUnauthorized}
+		}
+		// share tokens are only accepted by /share/{token}
+		if _, share := claims["shr"]; share {
+			return HandlerError{errors.New("share tokens can't be used here"), http.StatusUnauthorized}
+		}
 
-		// parse uid from jwt claims
-		uidJSON, ok := claims["uid"].(json.Number)
-		if !ok {
-			log.Print(uidJSON)
-			return errors.New("failed to parse uid from jwt")
+		// make sure the session this token belongs to has not been signed out
+		family, _ := claims["fam"].(string)
+		active, err := tokenRepo.IsFamilyActive(family)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return HandlerError{errors.New("token has been revoked"), http.StatusUnauthorized}
 		}
-		uid, err := uidJSON.Int64()
+
+		uid, err := claimsUid(claims)
 		if err != nil {
 			return err
 		}
+		auditActor(r, uid)
 
-		// set the uid in the request context and pass on the request
+		// set the uid and token family in the request context and pass on the request
 		ctx := context.WithValue(r.Context(), "uid", uid)
+		ctx = context.WithValue(ctx, "family", family)
 		next.ServeHTTP(w, r.WithContext(ctx))
 		return nil
 	}
 }
+
+// parse uid from jwt claims
+func claimsUid(claims jwt.MapClaims) (int64, error) {
+	uidJSON, ok := claims["uid"].(json.Number)
+	if !ok {
+		log.Print(uidJSON)
+		return 0, errors.New("failed to parse uid from jwt")
+	}
+	return uidJSON.Int64()
+}
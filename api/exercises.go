@@ -18,6 +18,8 @@ type Exercise struct {
 	Reminder  bool       `json:"reminder"`
 	StartDate time.Time  `json:"startdate"`
 	EndDate   *time.Time `json:"enddate"`
+	// the user who added it, if it was someone else on the user's behalf
+	EnteredBy *int64 `json:"enteredBy"`
 }
 
 type ExerciseRepo interface {
@@ -30,10 +32,10 @@ type ExerciseRepo interface {
 
 func exercisesRouter(repo ExerciseRepo) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(auditRoute)
 	r.Handle("/exercises/{eid}", updateExercise(repo)).Methods(http.MethodPut)
 	r.Handle("/exercises/{eid}", getExercise(repo)).Methods(http.MethodGet)
 	r.Handle("/exercises", getExercisesForDate(repo)).Queries("date", "{date}").Methods(http.MethodGet)
-	r.Handle("/exercises", getExercises(repo)).Queries("uid", "{uid}").Methods(http.MethodGet)
 	r.Handle("/exercises", getExercises(repo)).Methods(http.MethodGet)
 	r.Handle("/exercises", addExercise(repo)).Methods(http.MethodPost)
 	return r
@@ -41,39 +43,40 @@ func exercisesRouter(repo ExerciseRepo) *mux.Router {
 
 func getExercises(exerciseRepo ExerciseRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		var forUid int64
-		var err error
-		// get uid from token, added to context by authMiddleware
-		tokenUid := r.Context().Value("uid").(int64)
-
-		// if the logged in user is trying to read the exercises of another user
-		requestedUidString := r.FormValue("uid")
-		if requestedUidString == "" {
-			// default to the logged in user
-			forUid = tokenUid
-		} else {
-			// else get the exercises for the uid requested in the url
-			// FIXME: need to add authentication here - make sure that user has actually shared with us
-			forUid, err = strconv.ParseInt(requestedUidString, 10, 64)
-			if err != nil {
-				return HandlerError{err, http.StatusBadRequest}
-			}
-		}
+		// get uid of the user whose exercises are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 
 		exercises, err := exerciseRepo.GetAll(forUid)
 		if err != nil {
 			return err
 		}
+		exercises = filterExercises(requestGrant(r), exercises)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(exercises)
 		return nil
 	}
 }
 
+// drops the exercises which were not scheduled at any time in the window shared by grant
+func filterExercises(grant *Grant, exercises []Exercise) []Exercise {
+	if grant == nil {
+		return exercises
+	}
+	filtered := exercises[:0]
+	for _, exercise := range exercises {
+		if grant.Overlaps(exercise.StartDate, exercise.EndDate) {
+			filtered = append(filtered, exercise)
+		}
+	}
+	return filtered
+}
+
 func addExercise(exerciseRepo ExerciseRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// get uid from token, added to context by authMiddleware
 		uid := r.Context().Value("uid").(int64)
+		// get uid of the user the exercise is for, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 		// decode exercise from json in body of request
 		var exercise Exercise
 		if err := json.NewDecoder(r.Body).Decode(&exercise); err != nil {
@@ -82,7 +85,14 @@ func addExercise(exerciseRepo ExerciseRepo) HttpErrorHandler {
 		if exercise.Name == "" || exercise.Unit == "" || exercise.Schedule == (Schedule{}) {
 			return HandlerError{errors.New("must populate name, unit, schedule"), http.StatusBadRequest}
 		}
-		eid, err := exerciseRepo.Add(uid, &exercise)
+		if exercise.StartDate.IsZero() {
+			exercise.StartDate = time.Now()
+		}
+		if !requestGrant(r).Overlaps(exercise.StartDate, exercise.EndDate) {
+			return HandlerError{errOutsideGrant, http.StatusForbidden}
+		}
+		exercise.EnteredBy = enteredBy(uid, forUid)
+		eid, err := exerciseRepo.Add(forUid, &exercise)
 		if err != nil {
 			return err
 		}
@@ -94,8 +104,8 @@ func addExercise(exerciseRepo ExerciseRepo) HttpErrorHandler {
 
 func getExercise(exerciseRepo ExerciseRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		// get uid from token, added to context by authMiddleware
-		uid := r.Context().Value("uid").(int64)
+		// get uid of the user whose exercises are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 		// get eid from url
 		vars := mux.Vars(r)
 		eid, err := strconv.ParseInt(vars["eid"], 10, 64)
@@ -103,10 +113,13 @@ func getExercise(exerciseRepo ExerciseRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		exercise, err := exerciseRepo.Get(uid, eid)
+		exercise, err := exerciseRepo.Get(forUid, eid)
 		if err != nil {
 			return err
 		}
+		if !requestGrant(r).Overlaps(exercise.StartDate, exercise.EndDate) {
+			return HandlerError{errors.New("no such exercise"), http.StatusNotFound}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(exercise)
 		return nil
@@ -115,8 +128,8 @@ func getExercise(exerciseRepo ExerciseRepo) HttpErrorHandler {
 
 func getExercisesForDate(exerciseRepo ExerciseRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		// get uid from token, added to context by authMiddleware
-		uid := r.Context().Value("uid").(int64)
+		// get uid of the user whose exercises are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 		// get date from url
 		timestring := r.FormValue("date")
 		timestamp, err := time.Parse(time.RFC3339, timestring)
@@ -124,10 +137,13 @@ func getExercisesForDate(exerciseRepo ExerciseRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		exercises, err := exerciseRepo.GetForDate(uid, timestamp)
+		exercises, err := exerciseRepo.GetForDate(forUid, timestamp)
 		if err != nil {
 			return err
 		}
+		if !requestGrant(r).Covers(timestamp) {
+			exercises = []Exercise{}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(exercises)
 		return nil
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how long the other user has to accept an invitation to see someone's data
+const invitationLifetime = 14 * 24 * time.Hour
+
+// how long after a user declines an invitation before they can be invited again, so declining
+// isn't followed by another email straight away
+const DeclinedCooldown = 30 * 24 * time.Hour
+
+// A link starts as a pending invitation from the user sharing their data (Source) to the user
+// who will be able to see it (Dest). Only accepted links grant access. Expired and ended are never stored,
+// they are how pending invitations past their Expires time and accepted links past their EndsAt are reported.
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+	InvitationRevoked  = "revoked"
+	InvitationExpired  = "expired"
+	InvitationEnded    = "ended"
+)
+
+// An Invitation is a link as seen by one of the users in it, Email and Name are the other user's.
+// The Grant is what would be shared, so the invited user knows what they are accepting.
+type Invitation struct {
+	Grant
+	Lid     int64      `json:"lid"`
+	Source  int64      `json:"from"`
+	Dest    int64      `json:"to"`
+	Email   string     `json:"email"`
+	Name    string     `json:"name"`
+	Status  string     `json:"status"`
+	Created *time.Time `json:"created"`
+	Expires *time.Time `json:"expires"`
+}
+
+var (
+	ErrLinkExists       = errors.New("already shared with this user")
+	ErrRecentlyDeclined = errors.New("this user declined an invitation recently")
+)
+
+func getInvitations(userRepo UserRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		invitations, err := userRepo.GetInvitations(tokenUid)
+		if err != nil {
+			return err
+		}
+		if invitations == nil {
+			invitations = []Invitation{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invitations)
+		return nil
+	}
+}
+
+// accepts or declines an invitation sent to the logged in user
+func respondToInvitation(userRepo UserRepo, accept bool) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		lid, err := strconv.ParseInt(mux.Vars(r)["lid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := userRepo.RespondToInvitation(lid, tokenUid, accept)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("no pending invitation with this id"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+// takes back an invitation sent by the logged in user before it is accepted
+func revokeInvitation(userRepo UserRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		lid, err := strconv.ParseInt(mux.Vars(r)["lid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := userRepo.RevokeInvitation(lid, tokenUid)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("no pending invitation with this id"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// A SigningKey is one key in the Keyring, identified in token headers by its Kid.
+// For HS256 the secret is both the signing and verification key, for RS256 and EdDSA
+// only the public half is needed to verify, so it can be published at /auth/jwks.json.
+type SigningKey struct {
+	Kid     string
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+}
+
+// A Keyring holds every key which is currently accepted, and the one which new tokens are signed with.
+// To rotate keys, add the new key and make it active, then remove the old key once every token signed
+// with it has expired.
+type Keyring struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{kid, jwt.SigningMethodHS256, secret, secret}
+}
+
+func NewRSAKey(kid string, key *rsa.PrivateKey) *SigningKey {
+	return &SigningKey{kid, jwt.SigningMethodRS256, key, &key.PublicKey}
+}
+
+func NewEd25519Key(kid string, key ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{kid, SigningMethodEdDSA, key, key.Public()}
+}
+
+// NewKeyring returns a keyring which signs with active and accepts tokens signed by any of the keys
+func NewKeyring(active *SigningKey, others ...*SigningKey) *Keyring {
+	k := &Keyring{active, map[string]*SigningKey{active.Kid: active}}
+	for _, key := range others {
+		k.keys[key.Kid] = key
+	}
+	return k
+}
+
+// Sign returns a token signed with the active key
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.Kid
+	return token.SignedString(k.active.Private)
+}
+
+// keyFunc returns the key to verify a token with, from the kid in its header
+func (k *Keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	// never let the token choose its own algorithm
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("invalid signing method")
+	}
+	return key.Public, nil
+}
+
+// parser returns a jwt parser which only accepts the algorithms used by the keys in the keyring
+func (k *Keyring) parser() *jwt.Parser {
+	var methods []string
+	seen := make(map[string]bool)
+	for _, key := range k.keys {
+		if alg := key.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return &jwt.Parser{
+		ValidMethods:  methods,
+		UseJSONNumber: true,
+	}
+}
+
+// the format of the file pointed to by TREMR_JWT_KEYS_FILE, eg.
+//
+//	{
+//		"active": "2019-02",
+//		"keys": [
+//			{"kid": "2019-02", "alg": "EdDSA", "file": "keys/2019-02.pem"},
+//			{"kid": "2019-01", "alg": "HS256", "secret": "c2VjcmV0IGtleQ=="}
+//		]
+//	}
+//
+// HS256 secrets are base64 encoded, RS256 and EdDSA keys are PEM files (PKCS#1 or PKCS#8)
+// with paths relative to the keys file.
+type keyringFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		Kid    string `json:"kid"`
+		Alg    string `json:"alg"`
+		Secret string `json:"secret"`
+		File   string `json:"file"`
+	} `json:"keys"`
+}
+
+// LoadKeyring gets the jwt signing keys from the environment:
+// TREMR_JWT_KEYS_FILE names a JSON keys file (see keyringFile), otherwise
+// TREMR_JWT_SECRET is used as a single HS256 secret. If neither is set, a random
+// key is generated, which means every token is invalidated when the server restarts.
+func LoadKeyring() (*Keyring, error) {
+	if path := os.Getenv("TREMR_JWT_KEYS_FILE"); path != "" {
+		return LoadKeyringFile(path)
+	}
+	if secret := os.Getenv("TREMR_JWT_SECRET"); secret != "" {
+		return NewKeyring(NewHMACKey("default", []byte(secret))), nil
+	}
+	log.Print("TREMR_JWT_KEYS_FILE and TREMR_JWT_SECRET not set, using a random signing key")
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(NewHMACKey("random", []byte(secret))), nil
+}
+
+func LoadKeyringFile(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{keys: make(map[string]*SigningKey)}
+	for _, entry := range f.Keys {
+		var key *SigningKey
+		switch entry.Alg {
+		case jwt.SigningMethodHS256.Alg():
+			secret, err := base64.StdEncoding.DecodeString(entry.Secret)
+			if err != nil {
+				return nil, err
+			}
+			key = NewHMACKey(entry.Kid, secret)
+		case jwt.SigningMethodRS256.Alg(), SigningMethodEdDSA.Alg():
+			keyPath := entry.File
+			if !filepath.IsAbs(keyPath) {
+				keyPath = filepath.Join(filepath.Dir(path), keyPath)
+			}
+			pemData, err := ioutil.ReadFile(keyPath)
+			if err != nil {
+				return nil, err
+			}
+			if key, err = parsePrivateKey(entry.Kid, entry.Alg, pemData); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("unsupported algorithm for key " + entry.Kid + ": " + entry.Alg)
+		}
+		if _, ok := k.keys[key.Kid]; ok {
+			return nil, errors.New("duplicate key id " + key.Kid)
+		}
+		k.keys[key.Kid] = key
+	}
+
+	var ok bool
+	if k.active, ok = k.keys[f.Active]; !ok {
+		return nil, errors.New("active key " + f.Active + " not found in " + path)
+	}
+	return k, nil
+}
+
+func parsePrivateKey(kid, alg string, pemData []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found for key " + kid)
+	}
+	var parsed interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if alg == jwt.SigningMethodRS256.Alg() {
+			return NewRSAKey(kid, key), nil
+		}
+	case ed25519.PrivateKey:
+		if alg == SigningMethodEdDSA.Alg() {
+			return NewEd25519Key(kid, key), nil
+		}
+	}
+	return nil, errors.New("key " + kid + " does not match algorithm " + alg)
+}
+
+// a JSON Web Key, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 and EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	// EC
+	Y string `json:"y,omitempty"`
+}
+
+// publishes the public keys in the keyring so other services can verify our tokens.
+// HMAC secrets are never published, so tokens signed with them can only be verified by this server.
+func jwks(keys *Keyring) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		set := struct {
+			Keys []jwk `json:"keys"`
+		}{[]jwk{}}
+		for _, key := range keys.keys {
+			switch public := key.Public.(type) {
+			case *rsa.PublicKey:
+				set.Keys = append(set.Keys, jwk{
+					Kty: "RSA",
+					Kid: key.Kid,
+					Alg: key.Method.Alg(),
+					Use: "sig",
+					N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+					E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+				})
+			case ed25519.PublicKey:
+				set.Keys = append(set.Keys, jwk{
+					Kty: "OKP",
+					Kid: key.Kid,
+					Alg: key.Method.Alg(),
+					Use: "sig",
+					Crv: "Ed25519",
+					X:   base64.RawURLEncoding.EncodeToString(public),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+		return nil
+	}
+}
+
+// jwt-go has no support for EdDSA, so it is implemented here
+type signingMethodEd25519 struct{}
+
+var SigningMethodEdDSA jwt.SigningMethod = signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// accounts are locked after this many failed signins in a row
+	lockoutThreshold = 5
+	// the first lockout is this long, and doubles with every failure after that
+	lockoutBase = time.Minute
+	lockoutMax  = time.Hour
+)
+
+// A RateLimiter decides whether the request identified by key may go ahead, see the ratelimit package.
+// If not, it returns how long until the next request is allowed.
+type RateLimiter interface {
+	Allow(key string) (bool, time.Duration, error)
+}
+
+// Limits are the rate limiters for the unauthenticated endpoints, a nil limiter allows everything.
+// Each kind of request is limited per client IP address on its own, so heavy use of one, eg. opening
+// share links, doesn't lock a client out of the others.
+type Limits struct {
+	Signup RateLimiter
+	Signin RateLimiter
+	// second factor codes sent to /auth/signin/mfa
+	MFA   RateLimiter
+	Reset RateLimiter
+	OIDC  RateLimiter
+	Share RateLimiter
+	// keyed by the email address being signed in to, or whose password is being checked
+	Account RateLimiter
+}
+
+// returns a 429 error, telling the client when to try again
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	status := http.StatusTooManyRequests
+	return HandlerError{errors.New(http.StatusText(status)), status}
+}
+
+// checks the limiter for key, returning a 429 error if the request is not allowed
+func allow(limiter RateLimiter, key string, w http.ResponseWriter) error {
+	if limiter == nil {
+		return nil
+	}
+	ok, retryAfter, err := limiter.Allow(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return tooManyRequests(w, retryAfter)
+	}
+	return nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipRateLimit limits requests to next per client IP address
+func ipRateLimit(limiter RateLimiter, next http.Handler) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := allow(limiter, clientIP(r), w); err != nil {
+			return err
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+// returns how long to lock an account for after this many failed signins in a row
+func lockoutDuration(failures int) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	d := lockoutBase
+	for i := lockoutThreshold; i < failures && d < lockoutMax; i++ {
+		d *= 2
+	}
+	if d > lockoutMax {
+		d = lockoutMax
+	}
+	return d
+}
+
+// lock the account for longer and longer after repeated failures
+func recordLoginFailure(userRepo UserRepo, uid int64) error {
+	failures, err := userRepo.RecordLoginFailure(uid)
+	if err != nil {
+		return err
+	}
+	if d := lockoutDuration(failures); d > 0 {
+		return userRepo.SetLockedUntil(uid, time.Now().Add(d))
+	}
+	return nil
+}
+
+// checkPassword checks the password of a signed in user before something sensitive. Wrong passwords count
+// towards the same limit and lockout as signin, so a stolen access token can't be used to guess it.
+func checkPassword(userRepo UserRepo, limiter RateLimiter, w http.ResponseWriter, user User, password string) error {
+	if err := allow(limiter, NormalizeEmail(user.Email), w); err != nil {
+		return err
+	}
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		return tooManyRequests(w, time.Until(*user.LockedUntil))
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if err := recordLoginFailure(userRepo, user.Uid); err != nil {
+			return err
+		}
+		return HandlerError{errors.New("incorrect password"), http.StatusForbidden}
+	}
+	return nil
+}
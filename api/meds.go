@@ -28,6 +28,8 @@ type Medicine struct {
 	Reminder  bool       `json:"reminder"`
 	StartDate time.Time  `json:"startdate"`
 	EndDate   *time.Time `json:"enddate"`
+	// the user who added it, if it was someone else on the user's behalf
+	EnteredBy *int64 `json:"enteredBy"`
 }
 
 type MedicineRepo interface {
@@ -40,10 +42,10 @@ type MedicineRepo interface {
 
 func medsRouter(repo MedicineRepo) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(auditRoute)
 	router.Handle("/meds/{mid}", updateMedicine(repo)).Methods(http.MethodPut)
 	router.Handle("/meds/{mid}", getMedicine(repo)).Methods(http.MethodGet)
 	router.Handle("/meds", getMedicinesForDate(repo)).Queries("date", "{date}").Methods(http.MethodGet)
-	router.Handle("/meds", getMedicines(repo)).Queries("uid", "{uid}").Methods(http.MethodGet)
 	router.Handle("/meds", getMedicines(repo)).Methods(http.MethodGet)
 	router.Handle("/meds", addMedicine(repo)).Methods(http.MethodPost)
 	return router
@@ -51,35 +53,34 @@ func medsRouter(repo MedicineRepo) *mux.Router {
 
 func getMedicines(medicineRepo MedicineRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		var forUid int64
-		var err error
-		// get uid from token, added to context by authMiddleware
-		tokenUid := r.Context().Value("uid").(int64)
-
-		// if the logged in user is trying to read the meds of another user
-		requestedUidString := r.FormValue("uid")
-		if requestedUidString == "" {
-			// default to the logged in user
-			forUid = tokenUid
-		} else {
-			// else get the meds for the uid requested in the url
-			// FIXME: need to add authentication here - make sure that user has actually shared with us
-			forUid, err = strconv.ParseInt(requestedUidString, 10, 64)
-			if err != nil {
-				return HandlerError{err, http.StatusBadRequest}
-			}
-		}
+		// get uid of the user whose meds are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 
 		medicines, err := medicineRepo.GetAll(forUid)
 		if err != nil {
 			return err
 		}
+		medicines = filterMedicines(requestGrant(r), medicines)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(medicines)
 		return nil
 	}
 }
 
+// drops the medicines which were not scheduled at any time in the window shared by grant
+func filterMedicines(grant *Grant, medicines []Medicine) []Medicine {
+	if grant == nil {
+		return medicines
+	}
+	filtered := medicines[:0]
+	for _, medicine := range medicines {
+		if grant.Overlaps(medicine.StartDate, medicine.EndDate) {
+			filtered = append(filtered, medicine)
+		}
+	}
+	return filtered
+}
+
 func addMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 	type midHelper struct {
 		mid int64
@@ -87,6 +88,8 @@ func addMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// get uid from token, added to context by authMiddleware
 		uid := r.Context().Value("uid").(int64)
+		// get uid of the user the medicine is for, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 		// decode medicine from json in body of request
 		var medicine Medicine
 		if err := json.NewDecoder(r.Body).Decode(&medicine); err != nil {
@@ -95,7 +98,14 @@ func addMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 		if medicine.Name == "" || medicine.Dosage == "" || medicine.Schedule == (Schedule{}) {
 			return HandlerError{errors.New("must populate name, dosage, schedule"), http.StatusBadRequest}
 		}
-		mid, err := medicineRepo.Add(uid, &medicine)
+		if medicine.StartDate.IsZero() {
+			medicine.StartDate = time.Now()
+		}
+		if !requestGrant(r).Overlaps(medicine.StartDate, medicine.EndDate) {
+			return HandlerError{errOutsideGrant, http.StatusForbidden}
+		}
+		medicine.EnteredBy = enteredBy(uid, forUid)
+		mid, err := medicineRepo.Add(forUid, &medicine)
 		if err != nil {
 			return err
 		}
@@ -107,8 +117,8 @@ func addMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 
 func getMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		// get uid from token, added to context by authMiddleware
-		uid := r.Context().Value("uid").(int64)
+		// get uid of the user whose meds are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 		// get mid from url
 		vars := mux.Vars(r)
 		mid, err := strconv.ParseInt(vars["mid"], 10, 64)
@@ -116,10 +126,13 @@ func getMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		medicine, err := medicineRepo.Get(uid, mid)
+		medicine, err := medicineRepo.Get(forUid, mid)
 		if err != nil {
 			return err
 		}
+		if !requestGrant(r).Overlaps(medicine.StartDate, medicine.EndDate) {
+			return HandlerError{errors.New("no such medicine"), http.StatusNotFound}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(medicine)
 		return nil
@@ -128,8 +141,8 @@ func getMedicine(medicineRepo MedicineRepo) HttpErrorHandler {
 
 func getMedicinesForDate(medicineRepo MedicineRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		// get uid from token, added to context by authMiddleware
-		uid := r.Context().Value("uid").(int64)
+		// get uid of the user whose meds are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 		// get date from url
 		timestring := r.FormValue("date")
 		timestamp, err := time.Parse(time.RFC3339, timestring)
@@ -137,10 +150,13 @@ func getMedicinesForDate(medicineRepo MedicineRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		medicines, err := medicineRepo.GetForDate(uid, timestamp)
+		medicines, err := medicineRepo.GetForDate(forUid, timestamp)
 		if err != nil {
 			return err
 		}
+		if !requestGrant(r).Covers(timestamp) {
+			medicines = []Medicine{}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(medicines)
 		return nil
@@ -0,0 +1,395 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTP parameters, see RFC 6238. These are the defaults every authenticator app supports.
+	totpPeriod = 30
+	totpDigits = 6
+	// accept codes from one period either side, to allow for clock drift
+	totpSkew = 1
+
+	totpIssuer         = "Tremr"
+	recoveryCodeCount  = 10
+	mfaPendingLifetime = 5 * time.Minute
+)
+
+// MFA is a user's TOTP enrollment. It is only Enabled once the user has proven their
+// authenticator app works by confirming a code. LastCounter is the time step of the last
+// code which was accepted, so that each code can only be used once.
+type MFA struct {
+	Uid         int64
+	Secret      string
+	Enabled     bool
+	LastCounter int64
+}
+
+type MFARepo interface {
+	GetMFA(uid int64) (MFA, error)
+	// starts a new enrollment, replacing any which has not been confirmed
+	SetMFASecret(uid int64, secret string) error
+	// enables the enrollment, replacing any recovery codes with these hashes
+	EnableMFA(uid int64, recoveryHashes []string) error
+	DisableMFA(uid int64) error
+	// records a TOTP time step as used, returning false if it or a later one has already been used
+	UseTOTPCounter(uid int64, counter int64) (bool, error)
+	UseRecoveryCode(uid int64, hash string) (bool, error)
+}
+
+var ErrNoMFA = errors.New("two-factor authentication is not set up")
+
+// MFAChallenge is returned by /auth/signin instead of Tokens when the user has two-factor
+// authentication enabled. The Token must be sent to /auth/signin/mfa along with a code.
+type MFAChallenge struct {
+	Required bool      `json:"mfaRequired"`
+	Token    string    `json:"mfaToken"`
+	Expires  time.Time `json:"expires"`
+}
+
+// TOTP returns the code for the base32 encoded secret at time t
+func TOTP(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, t.Unix()/totpPeriod), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+}
+
+// the HMAC-based one-time password for counter, see RFC 4226
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+func newTOTPSecret() (string, error) {
+	// 160 bits, as recommended by RFC 4226
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// the otpauth:// URI understood by authenticator apps, usually shown as a QR code
+func totpURI(email, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + query.Encode()
+}
+
+// recovery codes look like "k3p9-x2md", and are compared without the dash and case insensitively
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return
+}
+
+func normalizeCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// checks a code from the user's authenticator app or one of their recovery codes, using it up
+func checkSecondFactor(mfaRepo MFARepo, mfa MFA, code string) (bool, error) {
+	code = normalizeCode(code)
+	if len(code) != totpDigits {
+		return mfaRepo.UseRecoveryCode(mfa.Uid, hashToken(code))
+	}
+	return checkTOTP(mfaRepo, mfa, code)
+}
+
+func checkTOTP(mfaRepo MFARepo, mfa MFA, code string) (bool, error) {
+	key, err := decodeTOTPSecret(mfa.Secret)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().Unix() / totpPeriod
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if hmac.Equal([]byte(hotp(key, counter)), []byte(code)) {
+			// a code which has already been used could have been seen by someone else
+			return mfaRepo.UseTOTPCounter(mfa.Uid, counter)
+		}
+	}
+	return false, nil
+}
+
+// returns whether the user has to pass a second factor to sign in
+func mfaEnabled(mfaRepo MFARepo, uid int64) (bool, error) {
+	mfa, err := mfaRepo.GetMFA(uid)
+	if err == ErrNoMFA {
+		return false, nil
+	}
+	return mfa.Enabled, err
+}
+
+// the mfa pending token proves the user knows their password, but can't be used to access anything else
+func issueMFAChallenge(keys *Keyring, uid int64) (challenge MFAChallenge, err error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	challenge.Required = true
+	challenge.Expires = now.Add(mfaPendingLifetime)
+	challenge.Token, err = keys.Sign(jwt.MapClaims{
+		"uid": uid,
+		"iat": now.Unix(),
+		"exp": challenge.Expires.Unix(),
+		"jti": jti,
+		"mfa": "pending",
+	})
+	return
+}
+
+func signinMFA(userRepo UserRepo, tokenRepo TokenRepo, mfaRepo MFARepo, keys *Keyring) HttpErrorHandler {
+	type mfaSignin struct {
+		Token string `json:"mfaToken"`
+		Code  string `json:"code"`
+	}
+	parser := keys.parser()
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req mfaSignin
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		var claims jwt.MapClaims
+		if _, err := parser.ParseWithClaims(req.Token, &claims, keys.keyFunc); err != nil {
+			return HandlerError{err, http.StatusUnauthorized}
+		}
+		if !claims.VerifyExpiresAt(time.Now().Unix(), true) || claims["mfa"] != "pending" {
+			return HandlerError{errors.New("invalid mfa token"), http.StatusUnauthorized}
+		}
+		uid, err := claimsUid(claims)
+		if err != nil {
+			return HandlerError{err, http.StatusUnauthorized}
+		}
+		auditSubject(r, uid)
+
+		// wrong codes count towards the same lockout as wrong passwords
+		user, err := userRepo.GetFromUid(uid)
+		if err != nil {
+			return err
+		}
+		if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+			return tooManyRequests(w, time.Until(*user.LockedUntil))
+		}
+		mfa, err := mfaRepo.GetMFA(uid)
+		if err != nil && err != ErrNoMFA {
+			return err
+		}
+		ok := false
+		if mfa.Enabled {
+			if ok, err = checkSecondFactor(mfaRepo, mfa, req.Code); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			if err := recordLoginFailure(userRepo, uid); err != nil {
+				return err
+			}
+			return HandlerError{errors.New("incorrect code"), http.StatusUnauthorized}
+		}
+		auditActor(r, uid)
+		if user.FailedLogins > 0 {
+			if err := userRepo.ClearLoginFailures(uid); err != nil {
+				return err
+			}
+		}
+
+		tokens, err := issueTokens(tokenRepo, keys, uid, "")
+		if err != nil {
+			return err
+		}
+		writeTokens(w, tokens)
+		return nil
+	}
+}
+
+func enrollMFA(userRepo UserRepo, mfaRepo MFARepo, limiter RateLimiter) HttpErrorHandler {
+	type enrollRequest struct {
+		Password string `json:"password"`
+	}
+	type enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		// a stolen access token must not be able to lock the user out of their account
+		user, err := userRepo.GetFromUid(uid)
+		if err != nil {
+			return err
+		}
+		if err := checkPassword(userRepo, limiter, w, user, req.Password); err != nil {
+			return err
+		}
+		enabled, err := mfaEnabled(mfaRepo, uid)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return HandlerError{errors.New("two-factor authentication is already enabled"), http.StatusConflict}
+		}
+
+		secret, err := newTOTPSecret()
+		if err != nil {
+			return err
+		}
+		if err := mfaRepo.SetMFASecret(uid, secret); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(enrollment{secret, totpURI(user.Email, secret)})
+		return nil
+	}
+}
+
+func confirmMFA(mfaRepo MFARepo) HttpErrorHandler {
+	type confirmation struct {
+		Code string `json:"code"`
+	}
+	type recoveryCodes struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var req confirmation
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		mfa, err := mfaRepo.GetMFA(uid)
+		if err == ErrNoMFA {
+			return HandlerError{errors.New("two-factor enrollment has not been started"), http.StatusBadRequest}
+		} else if err != nil {
+			return err
+		}
+		if mfa.Enabled {
+			return HandlerError{errors.New("two-factor authentication is already enabled"), http.StatusConflict}
+		}
+		ok, err := checkTOTP(mfaRepo, mfa, normalizeCode(req.Code))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return HandlerError{errors.New("incorrect code"), http.StatusBadRequest}
+		}
+
+		// the recovery codes are only ever shown once, the database only has their hashes
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		if err := mfaRepo.EnableMFA(uid, hashes); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recoveryCodes{codes})
+		return nil
+	}
+}
+
+func disableMFA(userRepo UserRepo, mfaRepo MFARepo, limiter RateLimiter) HttpErrorHandler {
+	type disableRequest struct {
+		Code string `json:"code"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var req disableRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		mfa, err := mfaRepo.GetMFA(uid)
+		if err == ErrNoMFA || (err == nil && !mfa.Enabled) {
+			return HandlerError{ErrNoMFA, http.StatusConflict}
+		} else if err != nil {
+			return err
+		}
+		// turning off the second factor needs the second factor
+		user, err := userRepo.GetFromUid(uid)
+		if err != nil {
+			return err
+		}
+		if err := checkCode(userRepo, mfaRepo, limiter, w, user, mfa, req.Code); err != nil {
+			return err
+		}
+		return mfaRepo.DisableMFA(uid)
+	}
+}
+
+// checkCode checks the second factor of a signed in user before something sensitive, counting wrong codes
+// towards the same limit and lockout as checkPassword
+func checkCode(userRepo UserRepo, mfaRepo MFARepo, limiter RateLimiter, w http.ResponseWriter, user User, mfa MFA,
+	code string) error {
+	if err := allow(limiter, NormalizeEmail(user.Email), w); err != nil {
+		return err
+	}
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		return tooManyRequests(w, time.Until(*user.LockedUntil))
+	}
+	ok, err := checkSecondFactor(mfaRepo, mfa, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := recordLoginFailure(userRepo, user.Uid); err != nil {
+			return err
+		}
+		return HandlerError{errors.New("incorrect code"), http.StatusForbidden}
+	}
+	return nil
+}
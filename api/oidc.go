@@ -0,0 +1,511 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long the user has to sign in at the identity provider
+	oidcStateLifetime = 10 * time.Minute
+	// binds the state to the browser which started the signin, so nobody else can finish it
+	oidcStateCookie = "tremr_oidc_state"
+	// where the browser is sent with the result of an OpenID Connect signin, in the url fragment
+	oidcResultPage = "/signin.html"
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// An OIDCProvider is an OpenID Connect identity provider which users can sign in with.
+// The endpoints are found with OpenID Connect discovery from the Issuer if they are not set.
+type OIDCProvider struct {
+	// used in urls, eg. /auth/oidc/{name}/login
+	Name         string `json:"name"`
+	DisplayName  string `json:"displayName"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// the full url of /api/auth/oidc/{name}/callback, as registered with the provider
+	RedirectURL string `json:"redirectUrl"`
+
+	AuthURL  string `json:"authorizationEndpoint"`
+	TokenURL string `json:"tokenEndpoint"`
+	JWKSURL  string `json:"jwksUri"`
+
+	mu   sync.Mutex
+	keys map[string]interface{}
+}
+
+// OIDCState is everything needed to finish a signin when the provider redirects back to the callback.
+// Only a hash of the state parameter is stored.
+type OIDCState struct {
+	Hash     string
+	Provider string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+type OIDCRepo interface {
+	AddOIDCState(*OIDCState) error
+	// returns and deletes the state, so each one can only be used once
+	UseOIDCState(hash string) (OIDCState, error)
+	// returns the uid an identity is linked to
+	GetIdentity(provider, subject string) (int64, error)
+	AddIdentity(provider, subject string, uid int64) error
+}
+
+var (
+	ErrInvalidOIDCState = errors.New("invalid or expired signin, please try again")
+	ErrNoIdentity       = errors.New("identity is not linked to a user")
+)
+
+// LoadOIDCProviders reads the providers from the JSON file named by TREMR_OIDC_FILE, eg.
+//
+//	{
+//		"providers": [{
+//			"name": "hospital",
+//			"displayName": "St. Elsewhere Hospital",
+//			"issuer": "https://login.example.org",
+//			"clientId": "tremr",
+//			"clientSecret": "secret",
+//			"redirectUrl": "https://tremr.example.com/api/auth/oidc/hospital/callback"
+//		}]
+//	}
+//
+// If it is not set, there are no providers.
+func LoadOIDCProviders() (map[string]*OIDCProvider, error) {
+	providers := make(map[string]*OIDCProvider)
+	path := os.Getenv("TREMR_OIDC_FILE")
+	if path == "" {
+		return providers, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Providers []*OIDCProvider `json:"providers"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for _, provider := range f.Providers {
+		if provider.Name == "" || provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			return nil, errors.New("oidc providers need a name, issuer, clientId and redirectUrl")
+		}
+		if _, ok := providers[provider.Name]; ok {
+			return nil, errors.New("duplicate oidc provider " + provider.Name)
+		}
+		providers[provider.Name] = provider
+	}
+	return providers, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fills in any endpoints which were not configured from the provider's discovery document
+func (p *OIDCProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.AuthURL != "" && p.TokenURL != "" && p.JWKSURL != "" {
+		return nil
+	}
+	var config struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+		return err
+	}
+	if config.Issuer != p.Issuer {
+		return errors.New("oidc discovery returned the wrong issuer " + config.Issuer)
+	}
+	if p.AuthURL == "" {
+		p.AuthURL = config.AuthURL
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = config.TokenURL
+	}
+	if p.JWKSURL == "" {
+		p.JWKSURL = config.JWKSURL
+	}
+	return nil
+}
+
+// returns the provider's public key with this kid, fetching the provider's keys again
+// if it is not known, since the provider may have rotated its keys
+func (p *OIDCProvider) publicKey(kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(p.JWKSURL, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]interface{})
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key " + kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	return p.publicKey(kid)
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			break
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			break
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+// returns the provider named in the url
+func oidcProvider(providers map[string]*OIDCProvider, r *http.Request) (*OIDCProvider, error) {
+	provider, ok := providers[mux.Vars(r)["provider"]]
+	if !ok {
+		return nil, HandlerError{errors.New("unknown identity provider"), http.StatusNotFound}
+	}
+	if err := provider.discover(); err != nil {
+		log.Print("oidc discovery failed: ", err)
+		return nil, HandlerError{errors.New("identity provider is unavailable"), http.StatusBadGateway}
+	}
+	return provider, nil
+}
+
+// lists the providers for the signin page
+func getOIDCProviders(providers map[string]*OIDCProvider) HttpErrorHandler {
+	type providerInfo struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		list := []providerInfo{}
+		for _, provider := range providers {
+			list = append(list, providerInfo{provider.Name, provider.DisplayName})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return nil
+	}
+}
+
+// oidcLogin starts an authorization code flow with PKCE by redirecting the browser to the provider
+func oidcLogin(oidcRepo OIDCRepo, providers map[string]*OIDCProvider) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		provider, err := oidcProvider(providers, r)
+		if err != nil {
+			return err
+		}
+
+		var state, nonce, verifier string
+		for _, s := range []*string{&state, &nonce, &verifier} {
+			if *s, err = randomString(32); err != nil {
+				return err
+			}
+		}
+		err = oidcRepo.AddOIDCState(&OIDCState{
+			Hash:     hashToken(state),
+			Provider: provider.Name,
+			Nonce:    nonce,
+			Verifier: verifier,
+			Expires:  time.Now().Add(oidcStateLifetime),
+		})
+		if err != nil {
+			return err
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/api/auth/oidc",
+			MaxAge:   int(oidcStateLifetime.Seconds()),
+			Secure:   strings.HasPrefix(provider.RedirectURL, "https://"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		challenge := sha256.Sum256([]byte(verifier))
+		query := url.Values{}
+		query.Set("response_type", "code")
+		query.Set("client_id", provider.ClientID)
+		query.Set("redirect_uri", provider.RedirectURL)
+		query.Set("scope", "openid email profile")
+		query.Set("state", state)
+		query.Set("nonce", nonce)
+		query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+		query.Set("code_challenge_method", "S256")
+		separator := "?"
+		if strings.Contains(provider.AuthURL, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, provider.AuthURL+separator+query.Encode(), http.StatusFound)
+		return nil
+	}
+}
+
+// the claims we use from an id token
+type oidcIdentity struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+// exchanges the code for an id token and checks it, returning the identity it is for
+func (p *OIDCProvider) exchange(code string, state OIDCState) (identity oidcIdentity, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", state.Verifier)
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("token endpoint returned " + resp.Status)
+		return
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return
+	}
+
+	// HMAC is not allowed, the client secret is not a signing key we want to trust
+	parser := &jwt.Parser{ValidMethods: []string{"RS256", "ES256", SigningMethodEdDSA.Alg()}}
+	var claims jwt.MapClaims
+	if _, err = parser.ParseWithClaims(tokens.IDToken, &claims, p.keyFunc); err != nil {
+		return
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) || !claims.VerifyIssuer(p.Issuer, true) {
+		err = errors.New("id token is expired or from the wrong issuer")
+		return
+	}
+	// jwt-go only understands a single audience
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == p.ClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == p.ClientID
+		}
+	}
+	if !audience {
+		err = errors.New("id token is for another client")
+		return
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state.Nonce {
+		err = errors.New("id token has the wrong nonce")
+		return
+	}
+
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" {
+		err = errors.New("id token has no subject")
+		return
+	}
+	// accounts are matched by email, so the provider has to vouch for it
+	if verified, _ := claims["email_verified"].(bool); !verified || validEmail(identity.Email) != nil {
+		err = HandlerError{errors.New("your identity provider has not verified your email address"), http.StatusForbidden}
+	}
+	return
+}
+
+// returns the user linked to the identity, linking it to the user with the same email or creating a new user
+func oidcUser(userRepo UserRepo, oidcRepo OIDCRepo, provider string, identity oidcIdentity) (int64, error) {
+	uid, err := oidcRepo.GetIdentity(provider, identity.Subject)
+	if err != ErrNoIdentity {
+		return uid, err
+	}
+
+	user, err := userRepo.GetFromEmail(identity.Email)
+	if err != nil {
+		switch err.(type) {
+		case ErrUserDoesNotExist:
+			// the user has no password yet, they can set one with a password reset
+			password, err := randomString(32)
+			if err != nil {
+				return 0, err
+			}
+			user = User{UserWithoutPassword: UserWithoutPassword{Email: identity.Email, Name: identity.Name}}
+			if validName(user.Name) != nil {
+				user.Name = identity.Email
+			}
+			if user.Password, err = hashPassword(password); err != nil {
+				return 0, err
+			}
+			if err = userRepo.Add(&user); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, err
+		}
+	}
+	if !user.Verified {
+		if err := userRepo.SetVerified(user.Uid); err != nil {
+			return 0, err
+		}
+	}
+	return user.Uid, oidcRepo.AddIdentity(provider, identity.Subject, user.Uid)
+}
+
+// oidcCallback is where the provider sends the browser back to. It finishes the signin and sends the
+// browser on to the signin page with the tokens, an mfa challenge or an error in the url fragment.
+func oidcCallback(userRepo UserRepo, tokenRepo TokenRepo, mfaRepo MFARepo, oidcRepo OIDCRepo,
+	keys *Keyring, providers map[string]*OIDCProvider) HttpErrorHandler {
+	finish := func(r *http.Request) (url.Values, error) {
+		provider, err := oidcProvider(providers, r)
+		if err != nil {
+			return nil, err
+		}
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			return nil, HandlerError{errors.New("identity provider returned " + e), http.StatusUnauthorized}
+		}
+
+		cookie, err := r.Cookie(oidcStateCookie)
+		if err != nil || cookie.Value != query.Get("state") {
+			return nil, HandlerError{ErrInvalidOIDCState, http.StatusBadRequest}
+		}
+		state, err := oidcRepo.UseOIDCState(hashToken(query.Get("state")))
+		if err == ErrInvalidOIDCState || (err == nil && state.Provider != provider.Name) {
+			return nil, HandlerError{ErrInvalidOIDCState, http.StatusBadRequest}
+		} else if err != nil {
+			return nil, err
+		}
+
+		identity, err := provider.exchange(query.Get("code"), state)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := oidcUser(userRepo, oidcRepo, provider.Name, identity)
+		if err != nil {
+			return nil, err
+		}
+		auditActor(r, uid)
+
+		result := url.Values{}
+		enabled, err := mfaEnabled(mfaRepo, uid)
+		if err != nil {
+			return nil, err
+		}
+		if enabled {
+			challenge, err := issueMFAChallenge(keys, uid)
+			if err != nil {
+				return nil, err
+			}
+			result.Set("mfaToken", challenge.Token)
+			return result, nil
+		}
+		tokens, err := issueTokens(tokenRepo, keys, uid, "")
+		if err != nil {
+			return nil, err
+		}
+		result.Set("token", tokens.Token)
+		result.Set("refresh", tokens.Refresh)
+		return result, nil
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc", MaxAge: -1})
+		result, err := finish(r)
+		if err != nil {
+			// only show the user errors which were meant for them
+			message := "signin failed, please try again"
+			if handlerError, ok := err.(HandlerError); ok {
+				message = handlerError.Error()
+			}
+			log.Print("oidc signin failed: ", err)
+			result = url.Values{}
+			result.Set("error", message)
+		}
+		http.Redirect(w, r, oidcResultPage+"#"+result.Encode(), http.StatusFound)
+		return nil
+	}
+}
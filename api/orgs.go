@@ -0,0 +1,403 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every member of an organization can read the data patients share with it, admins can also manage
+// who the members are. These are separate from the user's own role.
+const (
+	OrgRoleClinician = "clinician"
+	OrgRoleNurse     = "nurse"
+	OrgRoleAdmin     = "admin"
+)
+
+// An Org is a clinic or care team. Patients share with the organization once,
+// and everyone who is a member at the time can see what they share.
+type Org struct {
+	Oid     int64     `json:"oid"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// members give patients the share code, which they need to share with the organization.
+	// Only members see it.
+	ShareCode string `json:"shareCode,omitempty"`
+}
+
+// An OrgMembership is an organization as seen by one of its members
+type OrgMembership struct {
+	Org
+	Role string `json:"role"`
+}
+
+type OrgMember struct {
+	UserWithoutPassword
+	OrgRole string    `json:"orgRole"`
+	Added   time.Time `json:"added"`
+}
+
+// An OrgShare is a patient sharing their data with an organization, what they share is the Grant
+type OrgShare struct {
+	Org
+	Grant
+	Shared time.Time `json:"shared"`
+}
+
+type OrgRepo interface {
+	// creates the organization with uid as its first admin
+	AddOrg(org *Org, uid int64) error
+	GetOrg(oid int64) (Org, error)
+	GetOrgs(uid int64) ([]OrgMembership, error)
+	GetMembers(oid int64) ([]OrgMember, error)
+	// returns "" if uid is not a member
+	GetMemberRole(oid, uid int64) (string, error)
+	// returns ErrMemberExists if uid is already a member
+	AddMember(oid, uid int64, role string) error
+	// returns false if uid is not a member, and ErrLastAdmin instead of leaving the organization without an admin
+	SetMemberRole(oid, uid int64, role string) (bool, error)
+	RemoveMember(oid, uid int64) (bool, error)
+	// shares uid's data with the organization, replacing what they shared before
+	ShareWithOrg(oid, uid int64, grant Grant) error
+	UnshareWithOrg(oid, uid int64) (bool, error)
+	// returns the organizations uid shares with
+	GetOrgShares(uid int64) ([]OrgShare, error)
+	// returns the patients sharing with the organization, as LinkedUsers without a lid
+	GetOrgPatients(oid int64) ([]LinkedUser, error)
+	// returns every grant owner has made to an organization viewer is a member of, which hasn't ended
+	GetOrgGrants(owner, viewer int64) ([]Grant, error)
+}
+
+var (
+	ErrNoOrg        = errors.New("no such organization")
+	ErrMemberExists = errors.New("already a member of this organization")
+	ErrLastAdmin    = errors.New("an organization must have an admin")
+)
+
+func orgsRouter(repo OrgRepo, userRepo UserRepo) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(auditRoute)
+	router.Handle("/orgs", getOrgs(repo)).Methods(http.MethodGet)
+	router.Handle("/orgs", createOrg(repo)).Methods(http.MethodPost)
+	router.Handle("/orgs/shared", getOrgShares(repo)).Methods(http.MethodGet)
+	router.Handle("/orgs/{oid:[0-9]+}", getOrg(repo)).Methods(http.MethodGet)
+	router.Handle("/orgs/{oid:[0-9]+}/members", addOrgMember(repo, userRepo)).Methods(http.MethodPost)
+	router.Handle("/orgs/{oid:[0-9]+}/members/{uid}", setOrgMemberRole(repo)).Methods(http.MethodPut)
+	router.Handle("/orgs/{oid:[0-9]+}/members/{uid}", removeOrgMember(repo)).Methods(http.MethodDelete)
+	router.Handle("/orgs/{oid:[0-9]+}/patients", getOrgPatients(repo)).Methods(http.MethodGet)
+	router.Handle("/orgs/{oid:[0-9]+}/share", shareWithOrg(repo)).Methods(http.MethodPut)
+	router.Handle("/orgs/{oid:[0-9]+}/share", unshareWithOrg(repo)).Methods(http.MethodDelete)
+	return router
+}
+
+func validOrgRole(role string) error {
+	if role != OrgRoleClinician && role != OrgRoleNurse && role != OrgRoleAdmin {
+		return errors.New("role must be " + OrgRoleClinician + ", " + OrgRoleNurse + " or " + OrgRoleAdmin)
+	}
+	return nil
+}
+
+// returns the oid from the url, making sure the logged in user is a member, and an admin if admin is set.
+// Non-members get a 404 so they can't tell which organizations exist.
+func orgMember(orgRepo OrgRepo, r *http.Request, admin bool) (int64, error) {
+	// get uid from token, added to context by authMiddleware
+	tokenUid := r.Context().Value("uid").(int64)
+
+	oid, err := strconv.ParseInt(mux.Vars(r)["oid"], 10, 64)
+	if err != nil {
+		return 0, HandlerError{err, http.StatusBadRequest}
+	}
+	role, err := orgRepo.GetMemberRole(oid, tokenUid)
+	if err != nil {
+		return 0, err
+	}
+	if role == "" {
+		return 0, HandlerError{ErrNoOrg, http.StatusNotFound}
+	}
+	if admin && role != OrgRoleAdmin {
+		return 0, HandlerError{errors.New("only an admin of the organization can do this"), http.StatusForbidden}
+	}
+	return oid, nil
+}
+
+func getOrgs(orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		orgs, err := orgRepo.GetOrgs(tokenUid)
+		if err != nil {
+			return err
+		}
+		if orgs == nil {
+			orgs = []OrgMembership{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orgs)
+		return nil
+	}
+}
+
+func createOrg(orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		var org Org
+		if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if len(org.Name) < 1 {
+			return HandlerError{errors.New("organization must have a name"), http.StatusBadRequest}
+		}
+		org.Created = time.Now()
+		code, err := randomString(12)
+		if err != nil {
+			return err
+		}
+		org.ShareCode = code
+		if err := orgRepo.AddOrg(&org, tokenUid); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(org)
+		return nil
+	}
+}
+
+func getOrg(orgRepo OrgRepo) HttpErrorHandler {
+	type orgWithMembers struct {
+		Org
+		Members []OrgMember `json:"members"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		oid, err := orgMember(orgRepo, r, false)
+		if err != nil {
+			return err
+		}
+		org, err := orgRepo.GetOrg(oid)
+		if err != nil {
+			return err
+		}
+		members, err := orgRepo.GetMembers(oid)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(orgWithMembers{org, members})
+		return nil
+	}
+}
+
+func addOrgMember(orgRepo OrgRepo, userRepo UserRepo) HttpErrorHandler {
+	type memberRequest struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		oid, err := orgMember(orgRepo, r, true)
+		if err != nil {
+			return err
+		}
+		var req memberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := validOrgRole(req.Role); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		user, err := userRepo.GetFromEmail(req.Email)
+		if err != nil {
+			switch err.(type) {
+			case ErrUserDoesNotExist:
+				return HandlerError{err, http.StatusBadRequest}
+			default:
+				return err
+			}
+		}
+		err = orgRepo.AddMember(oid, user.Uid, req.Role)
+		if err == ErrMemberExists {
+			return HandlerError{err, http.StatusConflict}
+		}
+		return err
+	}
+}
+
+// makes sure the organization would still have an admin if uid wasn't one
+func checkOtherAdmin(orgRepo OrgRepo, oid, uid int64) error {
+	members, err := orgRepo.GetMembers(oid)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.OrgRole == OrgRoleAdmin && member.Uid != uid {
+			return nil
+		}
+	}
+	return HandlerError{ErrLastAdmin, http.StatusConflict}
+}
+
+func setOrgMemberRole(orgRepo OrgRepo) HttpErrorHandler {
+	type roleRequest struct {
+		Role string `json:"role"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		oid, err := orgMember(orgRepo, r, true)
+		if err != nil {
+			return err
+		}
+		var req roleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := validOrgRole(req.Role); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		uid, err := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := orgRepo.SetMemberRole(oid, uid, req.Role)
+		if err == ErrLastAdmin {
+			return HandlerError{err, http.StatusConflict}
+		} else if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("not a member of this organization"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+// removing a member takes away their access to every patient sharing with the organization straight away.
+// Admins can remove anyone, and every member can leave.
+func removeOrgMember(orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		admin := mux.Vars(r)["uid"] != strconv.FormatInt(tokenUid, 10)
+		oid, err := orgMember(orgRepo, r, admin)
+		if err != nil {
+			return err
+		}
+		uid, err := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := orgRepo.RemoveMember(oid, uid)
+		if err == ErrLastAdmin {
+			return HandlerError{err, http.StatusConflict}
+		} else if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("not a member of this organization"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+func getOrgPatients(orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		oid, err := orgMember(orgRepo, r, false)
+		if err != nil {
+			return err
+		}
+		patients, err := orgRepo.GetOrgPatients(oid)
+		if err != nil {
+			return err
+		}
+		for _, patient := range patients {
+			auditSubject(r, patient.Uid)
+		}
+		if patients == nil {
+			patients = []LinkedUser{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(patients)
+		return nil
+	}
+}
+
+func getOrgShares(orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		shares, err := orgRepo.GetOrgShares(tokenUid)
+		if err != nil {
+			return err
+		}
+		if shares == nil {
+			shares = []OrgShare{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shares)
+		return nil
+	}
+}
+
+// shareWithOrg shares the logged in user's data with an organization, taking the same scopes, window,
+// days and endsAt as a link, and the code the organization gave them. Organizations don't have to accept,
+// and sharing again replaces what is shared. A wrong code gets the same 404 as an organization which
+// doesn't exist, so patients can't find out which ones do.
+func shareWithOrg(orgRepo OrgRepo) HttpErrorHandler {
+	type shareRequest struct {
+		Grant
+		Days int    `json:"days"`
+		Code string `json:"code"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		oid, err := strconv.ParseInt(mux.Vars(r)["oid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		var req shareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := grantWithDays(&req.Grant, req.Days); err != nil {
+			return err
+		}
+		if req.CanWrite {
+			return HandlerError{errors.New("organizations can't be allowed to write"), http.StatusBadRequest}
+		}
+		org, err := orgRepo.GetOrg(oid)
+		if err != nil && err != ErrNoOrg {
+			return err
+		}
+		if err == ErrNoOrg || subtle.ConstantTimeCompare([]byte(org.ShareCode), []byte(req.Code)) != 1 {
+			return HandlerError{ErrNoOrg, http.StatusNotFound}
+		}
+		return orgRepo.ShareWithOrg(oid, tokenUid, req.Grant)
+	}
+}
+
+func unshareWithOrg(orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		oid, err := strconv.ParseInt(mux.Vars(r)["oid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := orgRepo.UnshareWithOrg(oid, tokenUid)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("not shared with this organization"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	bcryptCost         = 10
+	resetTokenLifetime = time.Hour
+	resetTokenPurpose  = "reset"
+)
+
+func validPassword(password string) error {
+	if len(password) < 6 {
+		return errors.New("password must be at least 6 characters")
+	}
+	return nil
+}
+
+// compared against when there is no password to check, so it takes as long as when there is
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not anyone's password"), bcryptCost)
+
+// NormalizeEmail is the form emails are stored, looked up and rate limited in, since
+// addresses are case-insensitive in practice
+func NormalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// generate a bcrypt hash from the user's plaintext password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	return string(hash), err
+}
+
+func changePassword(userRepo UserRepo, tokenRepo TokenRepo, limiter RateLimiter) HttpErrorHandler {
+	type passwordChange struct {
+		Current  string `json:"current"`
+		Password string `json:"password"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+
+		var change passwordChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := validPassword(change.Password); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		// a stolen access token alone is not enough to take over the account
+		user, err := userRepo.GetFromUid(uid)
+		if err != nil {
+			return err
+		}
+		if err := checkPassword(userRepo, limiter, w, user, change.Current); err != nil {
+			return err
+		}
+
+		hash, err := hashPassword(change.Password)
+		if err != nil {
+			return err
+		}
+		if err := userRepo.UpdatePassword(uid, hash); err != nil {
+			return err
+		}
+
+		// sign out every other session, but keep the one which changed the password
+		family := r.Context().Value("family").(string)
+		return tokenRepo.RevokeUser(uid, family)
+	}
+}
+
+func requestPasswordReset(userRepo UserRepo, tokenRepo TokenRepo, mailer Mailer) HttpErrorHandler {
+	type email struct {
+		Email string `json:"email"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var e email
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		user, err := userRepo.GetFromEmail(e.Email)
+		if err != nil {
+			switch err.(type) {
+			case ErrUserDoesNotExist:
+				// don't tell the caller whether an account exists for this email
+				return nil
+			default:
+				return err
+			}
+		}
+		auditSubject(r, user.Uid)
+
+		// the token is only ever sent to the user's email, the database only has its hash
+		token, err := randomString(32)
+		if err != nil {
+			return err
+		}
+		err = tokenRepo.AddUserToken(user.Uid, resetTokenPurpose, hashToken(token), time.Now().Add(resetTokenLifetime))
+		if err != nil {
+			return err
+		}
+
+		return mailer.Send(user.Email, "Reset your Tremr password",
+			"Hi "+user.Name+",\n\n"+
+				"Someone asked to reset the password for your Tremr account. "+
+				"If it was you, use this code to choose a new password within the next hour:\n\n"+
+				token+"\n\n"+
+				"If you didn't ask for this you can ignore this email, your password has not been changed.\n")
+	}
+}
+
+func resetPassword(userRepo UserRepo, tokenRepo TokenRepo, apiKeyRepo APIKeyRepo) HttpErrorHandler {
+	type passwordReset struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var reset passwordReset
+		if err := json.NewDecoder(r.Body).Decode(&reset); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		// check the new password before using up the token
+		if err := validPassword(reset.Password); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		uid, err := tokenRepo.UseUserToken(resetTokenPurpose, hashToken(reset.Token))
+		if err != nil {
+			if err == ErrInvalidUserToken {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+			return err
+		}
+		auditActor(r, uid)
+
+		hash, err := hashPassword(reset.Password)
+		if err != nil {
+			return err
+		}
+		if err := userRepo.UpdatePassword(uid, hash); err != nil {
+			return err
+		}
+		// the user has proven they own the account, so let them back in
+		if err := userRepo.ClearLoginFailures(uid); err != nil {
+			return err
+		}
+
+		// whoever knew the old password should not stay signed in, or keep any api keys they made
+		if err := apiKeyRepo.DeleteAPIKeys(uid); err != nil {
+			return err
+		}
+		return tokenRepo.RevokeUser(uid, "")
+	}
+}
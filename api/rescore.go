@@ -0,0 +1,341 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/nklaassen/tremr-web/scoring"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Statuses of rescore jobs. Jobs which are running when the server stops carry on when it starts again.
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobCancelled = "cancelled"
+	JobFailed    = "failed"
+)
+
+// recordings rescored between saving the job's progress
+const rescoreBatch = 100
+
+var ErrNoJob = errors.New("no such job")
+
+// A RescoreJob scores every stored recording again with the current version of the scoring package.
+// It goes through them in order of tid up to MaxTid, the newest when it started, since newer ones are
+// scored with the current version when they are uploaded. LastTid is how far it has got.
+type RescoreJob struct {
+	Jid       int64     `json:"jid"`
+	Algorithm string    `json:"algorithm"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	MaxTid    int64     `json:"maxTid"`
+	LastTid   int64     `json:"lastTid"`
+	Total     int       `json:"total"`
+	Rescored  int       `json:"rescored"`
+	// recordings which can't be scored, eg. because they don't say where the postural test starts
+	Skipped int     `json:"skipped"`
+	Error   *string `json:"error"`
+}
+
+// Scores of a tremor and the algorithm which made them, null for scores from the phone
+type Scores struct {
+	Algorithm *string `json:"algorithm"`
+	Resting   int     `json:"resting"`
+	Postural  int     `json:"postural"`
+}
+
+// A RescoreResult is a tremor's original scores next to those from a rescore
+type RescoreResult struct {
+	TID      int64     `json:"tid"`
+	UID      int64     `json:"uid"`
+	Date     time.Time `json:"date"`
+	Original Scores    `json:"original"`
+	Rescored Scores    `json:"rescored"`
+	Scored   time.Time `json:"scored"`
+}
+
+// Rescores are kept beside the original scores, one for each tremor and algorithm
+type RescoreRepo interface {
+	AddJob(job *RescoreJob) error
+	UpdateJob(job *RescoreJob) error
+	// returns ErrNoJob if there is no job with this jid
+	GetJob(jid int64) (RescoreJob, error)
+	// returns every job, newest first
+	GetJobs() ([]RescoreJob, error)
+	GetRunningJobs() ([]RescoreJob, error)
+	// returns the newest tid with samples, and how many tremors have them
+	SampledRange() (maxTid int64, count int, err error)
+	// returns up to limit tids with samples after after and up to until, in order
+	NextSampled(after, until int64, limit int) ([]int64, error)
+	// saves the scores of tid from an algorithm, replacing any it already had
+	SaveRescore(tid int64, algorithm string, resting, postural int) error
+	// returns up to limit results of an algorithm after the tid after, in order
+	GetResults(algorithm string, after int64, limit int) ([]RescoreResult, error)
+}
+
+// A Rescorer runs rescore jobs in the background. Jobs save their progress after every batch, so
+// rescoring a batch again after a restart does no harm.
+type Rescorer struct {
+	rescoreRepo RescoreRepo
+	sampleRepo  SampleRepo
+	mu          sync.Mutex
+	// closed to cancel each running job
+	cancel map[int64]chan struct{}
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewRescorer(rescoreRepo RescoreRepo, sampleRepo SampleRepo) *Rescorer {
+	return &Rescorer{
+		rescoreRepo: rescoreRepo,
+		sampleRepo:  sampleRepo,
+		cancel:      make(map[int64]chan struct{}),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Resume carries on with the jobs which were running when the server stopped. Jobs for another
+// version of the scoring package than this one fail, since they can't be finished.
+func (r *Rescorer) Resume() error {
+	jobs, err := r.rescoreRepo.GetRunningJobs()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, job := range jobs {
+		if job.Algorithm != scoring.Version {
+			message := "the server now scores with " + scoring.Version
+			job.Status, job.Error, job.Updated = JobFailed, &message, time.Now()
+			if err := r.rescoreRepo.UpdateJob(&job); err != nil {
+				return err
+			}
+			continue
+		}
+		r.run(job)
+	}
+	return nil
+}
+
+// Start starts a job rescoring everything with the current version of the scoring package,
+// unless one is already running
+func (r *Rescorer) Start() (job RescoreJob, started bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cancel) > 0 {
+		return
+	}
+	now := time.Now()
+	job = RescoreJob{Algorithm: scoring.Version, Status: JobRunning, Created: now, Updated: now}
+	if job.MaxTid, job.Total, err = r.rescoreRepo.SampledRange(); err != nil {
+		return
+	}
+	if err = r.rescoreRepo.AddJob(&job); err != nil {
+		return
+	}
+	r.run(job)
+	return job, true, nil
+}
+
+// Cancel stops a running job for good, returning false if it isn't running. The job counts as running
+// until it has saved that it was cancelled, so no other job can start before then.
+func (r *Rescorer) Cancel(jid int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancel, ok := r.cancel[jid]
+	if ok {
+		select {
+		case <-cancel:
+		default:
+			close(cancel)
+		}
+	}
+	return ok
+}
+
+// Stop stops every job where it is and waits for them, they carry on after Resume
+func (r *Rescorer) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// Wait waits for every running job to finish
+func (r *Rescorer) Wait() {
+	r.wg.Wait()
+}
+
+// run starts the job in the background, r.mu must be held
+func (r *Rescorer) run(job RescoreJob) {
+	cancel := make(chan struct{})
+	r.cancel[job.Jid] = cancel
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if err := r.rescore(&job, cancel); err != nil {
+			log.Print("rescore job ", job.Jid, " failed: ", err)
+			message := err.Error()
+			job.Status, job.Error = JobFailed, &message
+		}
+		if job.Status != JobRunning {
+			job.Updated = time.Now()
+			if err := r.rescoreRepo.UpdateJob(&job); err != nil {
+				log.Print("failed to save rescore job: ", err)
+			}
+		}
+		r.mu.Lock()
+		delete(r.cancel, job.Jid)
+		r.mu.Unlock()
+	}()
+}
+
+// rescore works through the job a batch at a time until it is done, cancelled or stopped
+func (r *Rescorer) rescore(job *RescoreJob, cancel chan struct{}) error {
+	for {
+		select {
+		case <-cancel:
+			job.Status = JobCancelled
+			return nil
+		case <-r.stop:
+			return nil
+		default:
+		}
+
+		tids, err := r.rescoreRepo.NextSampled(job.LastTid, job.MaxTid, rescoreBatch)
+		if err != nil {
+			return err
+		}
+		if len(tids) == 0 {
+			job.Status = JobDone
+			return nil
+		}
+		for _, tid := range tids {
+			// the samples are gone if their user was deleted since the batch was fetched
+			samples, err := r.sampleRepo.GetSamples(tid)
+			if err != nil && err != ErrNoSamples {
+				return err
+			}
+			if err == ErrNoSamples {
+				job.Skipped++
+			} else if analysis, err := samples.analyze(); err != nil {
+				job.Skipped++
+			} else {
+				err := r.rescoreRepo.SaveRescore(tid, analysis.Algorithm, analysis.Resting.Score, analysis.Postural.Score)
+				if err != nil {
+					return err
+				}
+				job.Rescored++
+			}
+			job.LastTid = tid
+		}
+		job.Updated = time.Now()
+		if err := r.rescoreRepo.UpdateJob(job); err != nil {
+			return err
+		}
+	}
+}
+
+// returns the job in the url
+func requestJob(rescoreRepo RescoreRepo, r *http.Request) (RescoreJob, error) {
+	jid, err := strconv.ParseInt(mux.Vars(r)["jid"], 10, 64)
+	if err != nil {
+		return RescoreJob{}, HandlerError{err, http.StatusBadRequest}
+	}
+	job, err := rescoreRepo.GetJob(jid)
+	if err == ErrNoJob {
+		return job, HandlerError{err, http.StatusNotFound}
+	}
+	return job, err
+}
+
+func startRescore(rescorer *Rescorer) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		job, started, err := rescorer.Start()
+		if err != nil {
+			return err
+		}
+		if !started {
+			return HandlerError{errors.New("a rescore job is already running"), http.StatusConflict}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return nil
+	}
+}
+
+func getRescoreJobs(rescoreRepo RescoreRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		jobs, err := rescoreRepo.GetJobs()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(append([]RescoreJob{}, jobs...))
+		return nil
+	}
+}
+
+func getRescoreJob(rescoreRepo RescoreRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		job, err := requestJob(rescoreRepo, r)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return nil
+	}
+}
+
+func cancelRescore(rescorer *Rescorer) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		jid, err := strconv.ParseInt(mux.Vars(r)["jid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if !rescorer.Cancel(jid) {
+			return HandlerError{errors.New("job isn't running"), http.StatusConflict}
+		}
+		return nil
+	}
+}
+
+// getRescoreResults compares the original scores of tremors with the job's, a page of ?limit= at a time
+// after the tid ?after=
+func getRescoreResults(rescoreRepo RescoreRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		job, err := requestJob(rescoreRepo, r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		limit := defaultTremorLimit
+		if value := query.Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxTremorLimit {
+				err = errors.New("limit must be between 1 and " + strconv.Itoa(maxTremorLimit))
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+		var after int64
+		if value := query.Get("after"); value != "" {
+			if after, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+		results, err := rescoreRepo.GetResults(job.Algorithm, after, limit)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			auditSubject(r, result.UID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(append([]RescoreResult{}, results...))
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// Every user has one role. Everyone signs up as a patient, and only admins can make someone a clinician,
+// so patients can trust that whoever they find on a roster is one. Users can give up being a clinician
+// themselves. Admins are only made by changing the database.
+const (
+	RolePatient   = "patient"
+	RoleClinician = "clinician"
+	RoleAdmin     = "admin"
+)
+
+func validRole(role string) error {
+	if role != RolePatient && role != RoleClinician {
+		return errors.New("role must be " + RolePatient + " or " + RoleClinician)
+	}
+	return nil
+}
+
+// roleMiddleware only lets users with the role through
+func roleMiddleware(userRepo UserRepo, role string, next http.Handler) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		user, err := userRepo.GetFromUid(tokenUid)
+		if err != nil {
+			return err
+		}
+		if user.Role != role {
+			return HandlerError{errors.New("only a " + role + " can do this"), http.StatusForbidden}
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	}
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// setRole lets users go back to being a patient
+func setRole(userRepo UserRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var req roleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := validRole(req.Role); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if req.Role != RolePatient {
+			return HandlerError{errors.New("only an admin can make someone a " + req.Role), http.StatusForbidden}
+		}
+		return userRepo.SetRole(uid, req.Role)
+	}
+}
+
+// setUserRole lets admins make any user a patient or clinician
+func setUserRole(userRepo UserRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		var req roleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := validRole(req.Role); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if _, err := userRepo.GetFromUid(uid); err != nil {
+			switch err.(type) {
+			case ErrUserDoesNotExist:
+				return HandlerError{err, http.StatusNotFound}
+			default:
+				return err
+			}
+		}
+		auditSubject(r, uid)
+		return userRepo.SetRole(uid, req.Role)
+	}
+}
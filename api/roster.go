@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TremorSummary describes a user's recent tremors, the week averages are null if there were none
+type TremorSummary struct {
+	Latest       *Tremor  `json:"latest"`
+	WeekResting  *float64 `json:"weekResting"`
+	WeekPostural *float64 `json:"weekPostural"`
+}
+
+// A SummaryWindow is the part of a user's tremors to summarize, From and To can be nil
+type SummaryWindow struct {
+	Uid  int64
+	From *time.Time
+	To   *time.Time
+}
+
+// A RosterPatient is a user sharing their data with a clinician, with enough about their tremors to
+// decide who needs attention first. Everything is limited to what the link shares, so a patient who
+// doesn't share tremors has no summary.
+type RosterPatient struct {
+	LinkedUser
+	TremorSummary
+	LastActivity *time.Time `json:"lastActivity"`
+}
+
+func clinicianRouter(userRepo UserRepo, orgRepo OrgRepo, tremorRepo TremorRepo) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(auditRoute)
+	router.Handle("/clinician/roster", getRoster(userRepo, orgRepo, tremorRepo)).Methods(http.MethodGet)
+	return router
+}
+
+// the roster is sorted by name by default, or by one of these with ?sort=, reversed with a leading "-",
+// eg. ?sort=-resting. Patients without a value always come last.
+var rosterSortKeys = map[string]func(p *RosterPatient) *float64{
+	"resting":  func(p *RosterPatient) *float64 { return p.WeekResting },
+	"postural": func(p *RosterPatient) *float64 { return p.WeekPostural },
+	"activity": func(p *RosterPatient) *float64 {
+		if p.LastActivity == nil {
+			return nil
+		}
+		seconds := float64(p.LastActivity.Unix())
+		return &seconds
+	},
+}
+
+// getRoster lists every patient sharing with the logged in clinician, directly or through one of their
+// organizations, with the patient's own link first. It can be filtered with
+// ?q= to search names and emails, ?minResting= and ?minPostural= for week averages of at least
+// that much, and ?inactiveDays= for patients who haven't recorded a tremor in that many days.
+func getRoster(userRepo UserRepo, orgRepo OrgRepo, tremorRepo TremorRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		query := r.URL.Query()
+		sortBy := query.Get("sort")
+		if sortBy == "" {
+			sortBy = "name"
+		}
+		reverse := strings.HasPrefix(sortBy, "-")
+		sortName := strings.TrimPrefix(sortBy, "-")
+		sortKey, ok := rosterSortKeys[sortName]
+		if !ok && sortName != "name" {
+			return HandlerError{errors.New("can't sort by " + sortBy), http.StatusBadRequest}
+		}
+		search := strings.ToLower(query.Get("q"))
+		var minResting, minPostural *float64
+		for param, min := range map[string]**float64{"minResting": &minResting, "minPostural": &minPostural} {
+			if value := query.Get(param); value != "" {
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return HandlerError{err, http.StatusBadRequest}
+				}
+				*min = &f
+			}
+		}
+		var inactiveSince *time.Time
+		if value := query.Get("inactiveDays"); value != "" {
+			days, err := strconv.Atoi(value)
+			if err != nil || days < 0 {
+				return HandlerError{errors.New("inactiveDays must be a positive number"), http.StatusBadRequest}
+			}
+			since := time.Now().AddDate(0, 0, -days)
+			inactiveSince = &since
+		}
+
+		links, err := userRepo.GetIncomingLinks(tokenUid)
+		if err != nil {
+			return err
+		}
+		orgs, err := orgRepo.GetOrgs(tokenUid)
+		if err != nil {
+			return err
+		}
+		for _, org := range orgs {
+			patients, err := orgRepo.GetOrgPatients(org.Oid)
+			if err != nil {
+				return err
+			}
+			links = append(links, patients...)
+		}
+
+		// a patient can share through their own link and any number of organizations. Like findGrant, the
+		// first of them which shares tremors is used, so a link without tremors doesn't hide an org's share.
+		var patients []RosterPatient
+		index := make(map[int64]int)
+		for _, link := range links {
+			if i, ok := index[link.Uid]; ok {
+				if !patients[i].Grant.Has(ScopeTremors) && link.Grant.Has(ScopeTremors) {
+					patients[i].LinkedUser = link
+				}
+				continue
+			}
+			if search != "" && !strings.Contains(strings.ToLower(link.Name), search) &&
+				!strings.Contains(strings.ToLower(link.Email), search) {
+				continue
+			}
+			index[link.Uid] = len(patients)
+			patients = append(patients, RosterPatient{LinkedUser: link})
+		}
+		var windows []SummaryWindow
+		for _, patient := range patients {
+			if patient.Grant.Has(ScopeTremors) {
+				auditSubject(r, patient.Uid)
+				windows = append(windows, SummaryWindow{patient.Uid, patient.DataFrom, patient.DataTo})
+			}
+		}
+		summaries, err := tremorRepo.Summarize(windows, time.Now().AddDate(0, 0, -7))
+		if err != nil {
+			return err
+		}
+
+		roster := []RosterPatient{}
+		for _, patient := range patients {
+			if summary, ok := summaries[patient.Uid]; ok {
+				patient.TremorSummary = summary
+				patient.LastActivity = &summary.Latest.Date
+			}
+			if minResting != nil && (patient.WeekResting == nil || *patient.WeekResting < *minResting) {
+				continue
+			}
+			if minPostural != nil && (patient.WeekPostural == nil || *patient.WeekPostural < *minPostural) {
+				continue
+			}
+			if inactiveSince != nil && patient.LastActivity != nil && patient.LastActivity.After(*inactiveSince) {
+				continue
+			}
+			roster = append(roster, patient)
+		}
+
+		sort.SliceStable(roster, func(i, j int) bool {
+			a, b := &roster[i], &roster[j]
+			if sortKey == nil {
+				if reverse {
+					a, b = b, a
+				}
+				return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+			}
+			keyA, keyB := sortKey(a), sortKey(b)
+			if keyA == nil || keyB == nil {
+				return keyA != nil && keyB == nil
+			}
+			if reverse {
+				return *keyA > *keyB
+			}
+			return *keyA < *keyB
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roster)
+		return nil
+	}
+}
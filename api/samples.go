@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/nklaassen/tremr-web/scoring"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// half an hour at 100Hz is plenty for any test
+	maxSamples     = 180000
+	maxSampleRate  = 10000
+	maxSampleBytes = 32 << 20
+	// samples are stored to a thousandth, anything bigger than this is a broken sensor
+	maxSampleValue = 1e6
+)
+
+var (
+	ErrNoSamples     = errors.New("no samples for this tremor")
+	ErrSamplesExist  = errors.New("tremor already has samples")
+	errSampleValues  = errors.New("samples must be numbers less than a million")
+	errSampleLengths = errors.New("gyro must be left out or have as many samples as accel")
+	errPosturalFrom  = errors.New("posturalFrom must be the index of a sample after the first")
+	errNoPostural    = errors.New("samples without posturalFrom can't be scored")
+)
+
+// Samples are the raw sensor readings of a tremor test, so it can be scored again when scoring improves.
+// Accel is in m/s² and Gyro, which is optional, in rad/s, as x, y and z at Rate samples per second.
+// Values are stored to a thousandth. A test is recorded in one go, resting until the sample at
+// PosturalFrom and postural from then on. Samples without it are kept, but can't be scored.
+type Samples struct {
+	Rate         float64      `json:"rate"`
+	Accel        [][3]float64 `json:"accel"`
+	Gyro         [][3]float64 `json:"gyro"`
+	PosturalFrom *int         `json:"posturalFrom"`
+}
+
+// TremorAnalysis is what the scoring package makes of each part of a test
+type TremorAnalysis struct {
+	Algorithm string           `json:"algorithm"`
+	Resting   scoring.Analysis `json:"resting"`
+	Postural  scoring.Analysis `json:"postural"`
+}
+
+// Samples are kept with the tremor they were recorded for, and never change once they are added
+type SampleRepo interface {
+	// returns ErrSamplesExist if the tremor already has samples
+	AddSamples(uid, tid int64, samples *Samples) error
+	// returns ErrNoSamples if the tremor has no samples
+	GetSamples(tid int64) (Samples, error)
+}
+
+func (s *Samples) validate() error {
+	if s.Rate <= 0 || s.Rate > maxSampleRate {
+		return errors.New("rate must be more than 0 and at most " + strconv.Itoa(maxSampleRate))
+	}
+	if len(s.Accel) == 0 || len(s.Accel) > maxSamples {
+		return errors.New("there must be between 1 and " + strconv.Itoa(maxSamples) + " samples")
+	}
+	if len(s.Gyro) != 0 && len(s.Gyro) != len(s.Accel) {
+		return errSampleLengths
+	}
+	if s.PosturalFrom != nil && (*s.PosturalFrom < 1 || *s.PosturalFrom >= len(s.Accel)) {
+		return errPosturalFrom
+	}
+	for _, samples := range [][][3]float64{s.Accel, s.Gyro} {
+		for _, sample := range samples {
+			for _, value := range sample {
+				if math.IsNaN(value) || math.Abs(value) >= maxSampleValue {
+					return errSampleValues
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// round rounds the samples to the thousandth they are stored to, so scoring them now gives the same
+// scores as rescoring them later
+func (s *Samples) round() {
+	for _, samples := range [][][3]float64{s.Accel, s.Gyro} {
+		for i := range samples {
+			for axis := range samples[i] {
+				samples[i][axis] = math.Round(samples[i][axis]*1000) / 1000
+			}
+		}
+	}
+}
+
+// analyze scores both parts of the test with the current version of the scoring package
+func (s *Samples) analyze() (analysis TremorAnalysis, err error) {
+	if s.PosturalFrom == nil {
+		return analysis, errNoPostural
+	}
+	analysis.Algorithm = scoring.Version
+	if analysis.Resting, err = scoring.Analyze(s.Rate, s.Accel[:*s.PosturalFrom]); err != nil {
+		return
+	}
+	analysis.Postural, err = scoring.Analyze(s.Rate, s.Accel[*s.PosturalFrom:])
+	return
+}
+
+// returns the tremor in the url if it belongs to the user whose data is being read,
+// and is inside what is shared with the logged in user
+func requestTremor(tremorRepo TremorRepo, r *http.Request) (Tremor, error) {
+	// get uid of the user whose tremor it is, added to context by accessMiddleware
+	forUid := r.Context().Value("forUid").(int64)
+	tid, err := strconv.ParseInt(mux.Vars(r)["tid"], 10, 64)
+	if err != nil {
+		return Tremor{}, HandlerError{err, http.StatusBadRequest}
+	}
+	tremor, err := tremorRepo.Get(forUid, tid)
+	if err == ErrNoTremor || (err == nil && !requestGrant(r).Covers(tremor.Date)) {
+		return Tremor{}, HandlerError{ErrNoTremor, http.StatusNotFound}
+	}
+	return tremor, err
+}
+
+func addSamples(tremorRepo TremorRepo, sampleRepo SampleRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		tremor, err := requestTremor(tremorRepo, r)
+		if err != nil {
+			return err
+		}
+		var samples Samples
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSampleBytes)).Decode(&samples); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := samples.validate(); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		err = sampleRepo.AddSamples(tremor.UID, tremor.TID, &samples)
+		if err == ErrSamplesExist {
+			return HandlerError{err, http.StatusConflict}
+		}
+		return err
+	}
+}
+
+// getAnalysis scores the tremor's samples again, showing the frequency and amplitude behind the scores
+func getAnalysis(tremorRepo TremorRepo, sampleRepo SampleRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		tremor, err := requestTremor(tremorRepo, r)
+		if err != nil {
+			return err
+		}
+		samples, err := sampleRepo.GetSamples(tremor.TID)
+		if err == ErrNoSamples {
+			return HandlerError{err, http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		analysis, err := samples.analyze()
+		if err != nil {
+			return HandlerError{err, http.StatusUnprocessableEntity}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(analysis)
+		return nil
+	}
+}
+
+func getSamples(tremorRepo TremorRepo, sampleRepo SampleRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		tremor, err := requestTremor(tremorRepo, r)
+		if err != nil {
+			return err
+		}
+		samples, err := sampleRepo.GetSamples(tremor.TID)
+		if err == ErrNoSamples {
+			return HandlerError{err, http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(samples)
+		return nil
+	}
+}
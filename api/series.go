@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSeriesPoints = 500
+	maxSeriesPoints     = 5000
+)
+
+type SeriesPoint struct {
+	Date  time.Time `json:"date"`
+	Value float64   `json:"value"`
+}
+
+// TremorSeries is the resting and postural scores of a user's tremors, each downsampled on its own
+type TremorSeries struct {
+	Resting  []SeriesPoint `json:"resting"`
+	Postural []SeriesPoint `json:"postural"`
+}
+
+// getTremorSeries returns the resting and postural scores of the tremors recorded from ?from= to ?to=,
+// oldest first, of the ?hand= or with the ?tag= if they are set, downsampled to at most ?points= points
+// each so charts of years of tremors stay quick.
+func getTremorSeries(tremorRepo TremorRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid of the user whose tremors are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
+
+		points := defaultSeriesPoints
+		if value := r.URL.Query().Get("points"); value != "" {
+			var err error
+			if points, err = strconv.Atoi(value); err != nil || points < 3 || points > maxSeriesPoints {
+				err = errors.New("points must be between 3 and " + strconv.Itoa(maxSeriesPoints))
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+		from, to, err := requestWindow(r)
+		if err != nil {
+			return err
+		}
+		filter, err := requestTremorFilter(r)
+		if err != nil {
+			return err
+		}
+
+		// only read tremors in the shared window
+		from, to = requestGrant(r).Window(from, to)
+		var tremors []Tremor
+		if from == nil || to == nil || !to.Before(*from) {
+			if tremors, err = tremorRepo.GetRange(forUid, from, to, filter); err != nil {
+				return err
+			}
+		}
+		series := TremorSeries{Resting: make([]SeriesPoint, len(tremors)), Postural: make([]SeriesPoint, len(tremors))}
+		for i, tremor := range tremors {
+			series.Resting[i] = SeriesPoint{tremor.Date, float64(tremor.Resting)}
+			series.Postural[i] = SeriesPoint{tremor.Date, float64(tremor.Postural)}
+		}
+		series.Resting, series.Postural = lttb(series.Resting, points), lttb(series.Postural, points)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(series)
+		return nil
+	}
+}
+
+// lttb downsamples data to threshold points with largest-triangle-three-buckets, which keeps the shape of
+// a series, peaks included. The first and last points are always kept, and every point in between is the
+// one of its bucket making the largest triangle with the point kept before it and the average of the
+// bucket after it. See Sveinn Steinarsson, Downsampling Time Series for Visual Representation, 2013.
+func lttb(data []SeriesPoint, threshold int) []SeriesPoint {
+	if threshold >= len(data) || threshold < 3 {
+		return data
+	}
+	x := func(i int) float64 { return float64(data[i].Date.Unix()) }
+	// buckets are the size of every, leaving out the first and last points
+	every := float64(len(data)-2) / float64(threshold-2)
+	bucket := func(i int) int {
+		return int(math.Floor(float64(i)*every)) + 1
+	}
+
+	sampled := make([]SeriesPoint, 0, threshold)
+	sampled = append(sampled, data[0])
+	previous := 0
+	for i := 0; i < threshold-2; i++ {
+		// average the bucket after this one, which for the last bucket is the last point
+		nextStart, nextEnd := bucket(i+1), bucket(i+2)
+		if nextEnd > len(data) {
+			nextEnd = len(data)
+		}
+		var avgX, avgY float64
+		for j := nextStart; j < nextEnd; j++ {
+			avgX += x(j)
+			avgY += data[j].Value
+		}
+		avgX /= float64(nextEnd - nextStart)
+		avgY /= float64(nextEnd - nextStart)
+
+		prevX, prevY := x(previous), data[previous].Value
+		maxArea, chosen := -1.0, bucket(i)
+		for j := bucket(i); j < bucket(i+1); j++ {
+			area := math.Abs((prevX-avgX)*(data[j].Value-prevY)-(prevX-x(j))*(avgY-prevY)) / 2
+			if area > maxArea {
+				maxArea, chosen = area, j
+			}
+		}
+		sampled = append(sampled, data[chosen])
+		previous = chosen
+	}
+	return append(sampled, data[len(data)-1])
+}
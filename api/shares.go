@@ -0,0 +1,211 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// shares are for showing a report to someone, not for ongoing access, so they always expire
+	defaultShareLifetime = 7 * 24 * time.Hour
+	maxShareLifetime     = 90 * 24 * time.Hour
+)
+
+// A Share lets anyone with its token read part of a user's data without an account, eg. a neurologist
+// looking at a patient's chart. What is shared is the Grant, which always has an EndsAt.
+// The token is a JWT with the Sid in its "shr" claim, the share has to still exist for it to work,
+// so deleting it revokes the token.
+type Share struct {
+	Sid  int64  `json:"sid"`
+	Uid  int64  `json:"-"`
+	Name string `json:"name"`
+	Grant
+	Created time.Time `json:"created"`
+}
+
+// SharedData is the response body of GET /share/{token}, categories which are not shared are null
+type SharedData struct {
+	Name string `json:"name"`
+	Grant
+	Tremors   []Tremor   `json:"tremors"`
+	Medicines []Medicine `json:"meds"`
+	Exercises []Exercise `json:"exercises"`
+}
+
+type ShareRepo interface {
+	AddShare(share *Share) error
+	// returns the user's shares which haven't expired
+	GetShares(uid int64) ([]Share, error)
+	GetShare(sid int64) (Share, error)
+	// returns false if the user has no share with this sid
+	DeleteShare(uid, sid int64) (bool, error)
+}
+
+var ErrNoShare = errors.New("share does not exist")
+
+func getShares(shareRepo ShareRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		shares, err := shareRepo.GetShares(uid)
+		if err != nil {
+			return err
+		}
+		if shares == nil {
+			shares = []Share{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shares)
+		return nil
+	}
+}
+
+// createShare takes the same scopes, window, days and endsAt as an invitation, and returns the token
+func createShare(shareRepo ShareRepo, keys *Keyring) HttpErrorHandler {
+	type shareRequest struct {
+		Name string `json:"name"`
+		Grant
+		Days int `json:"days"`
+	}
+	type newShare struct {
+		Share
+		Token string `json:"token"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var req shareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := grantWithDays(&req.Grant, req.Days); err != nil {
+			return err
+		}
+		if req.CanWrite {
+			return HandlerError{errors.New("shares are read-only"), http.StatusBadRequest}
+		}
+		now := time.Now()
+		if req.EndsAt == nil {
+			endsAt := now.Add(defaultShareLifetime)
+			req.EndsAt = &endsAt
+		}
+		if req.EndsAt.After(now.Add(maxShareLifetime)) {
+			return HandlerError{errors.New("shares can't last more than 90 days"), http.StatusBadRequest}
+		}
+
+		share := Share{Uid: uid, Name: req.Name, Grant: req.Grant, Created: now}
+		if err := shareRepo.AddShare(&share); err != nil {
+			return err
+		}
+		token, err := keys.Sign(jwt.MapClaims{
+			"shr": share.Sid,
+			"iat": now.Unix(),
+			"exp": share.EndsAt.Unix(),
+		})
+		if err != nil {
+			return err
+		}
+
+		// the token isn't stored, so this is the only time it is shown
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newShare{share, token})
+		return nil
+	}
+}
+
+func revokeShare(shareRepo ShareRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		sid, err := strconv.ParseInt(mux.Vars(r)["sid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		found, err := shareRepo.DeleteShare(uid, sid)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("no such share"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+// getSharedData is public, the token in the url is the only thing which grants access
+func getSharedData(shareRepo ShareRepo, userRepo UserRepo, tremorRepo TremorRepo, medicineRepo MedicineRepo,
+	exerciseRepo ExerciseRepo, keys *Keyring) HttpErrorHandler {
+	parser := keys.parser()
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// browsers would otherwise send the url, token and all, to any site the report links to
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		var claims jwt.MapClaims
+		if _, err := parser.ParseWithClaims(mux.Vars(r)["token"], &claims, keys.keyFunc); err != nil {
+			return HandlerError{err, http.StatusUnauthorized}
+		}
+		sidJSON, ok := claims["shr"].(json.Number)
+		if !claims.VerifyExpiresAt(time.Now().Unix(), true) || !ok {
+			return HandlerError{errors.New("invalid share token"), http.StatusUnauthorized}
+		}
+		sid, err := sidJSON.Int64()
+		if err != nil {
+			return HandlerError{err, http.StatusUnauthorized}
+		}
+		share, err := shareRepo.GetShare(sid)
+		if err == ErrNoShare {
+			return HandlerError{errors.New("share has been revoked"), http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+		auditSubject(r, share.Uid)
+		grant := &share.Grant
+		if !grant.EndsAt.After(time.Now()) {
+			return HandlerError{errors.New("share has expired"), http.StatusNotFound}
+		}
+
+		data := SharedData{Grant: share.Grant}
+		if grant.Has(ScopeProfile) {
+			user, err := userRepo.GetFromUid(share.Uid)
+			if err != nil {
+				return err
+			}
+			data.Name = user.Name
+		}
+		if grant.Has(ScopeTremors) {
+			tremors, err := tremorRepo.GetAll(share.Uid)
+			if err != nil {
+				return err
+			}
+			data.Tremors = append([]Tremor{}, filterTremors(grant, tremors)...)
+		}
+		if grant.Has(ScopeMeds) {
+			medicines, err := medicineRepo.GetAll(share.Uid)
+			if err != nil {
+				return err
+			}
+			data.Medicines = append([]Medicine{}, filterMedicines(grant, medicines)...)
+		}
+		if grant.Has(ScopeExercises) {
+			exercises, err := exerciseRepo.GetAll(share.Uid)
+			if err != nil {
+				return err
+			}
+			data.Exercises = append([]Exercise{}, filterExercises(grant, exercises)...)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"time"
+)
+
+const (
+	// access tokens are only checked against the database for revocation, so keep them short-lived
+	accessTokenLifetime = 15 * time.Minute
+	// refresh tokens are single-use, each refresh returns a new one in the same family
+	refreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// A RefreshToken is stored server side so it can be rotated and revoked.
+// Every refresh token issued from the same signin shares a Family, and every access token
+// carries its family in the "fam" claim, so revoking a family signs out that session entirely.
+type RefreshToken struct {
+	Hash    string
+	Family  string
+	Uid     int64
+	Expires time.Time
+}
+
+type TokenRepo interface {
+	AddRefreshToken(*RefreshToken) error
+	UseRefreshToken(hash string) (RefreshToken, error)
+	RevokeFamily(family string) error
+	IsFamilyActive(family string) (bool, error)
+	RevokeUser(uid int64, except string) error
+
+	// single-use tokens which are sent to users by email, eg. for password resets
+	AddUserToken(uid int64, purpose, hash string, expires time.Time) error
+	UseUserToken(purpose, hash string) (int64, error)
+}
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+	ErrInvalidUserToken    = errors.New("invalid or expired token")
+)
+
+// Tokens is the response body of every endpoint which signs a user in
+type Tokens struct {
+	Token   string    `json:"token"`
+	Refresh string    `json:"refresh"`
+	Expires time.Time `json:"expires"`
+}
+
+// returns a url-safe random string with n bytes of entropy
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// only hashes of secrets are stored, a sha256 is enough since the secrets are random
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates a new access token and refresh token for the user.
+// Pass an empty family to start a new session.
+func issueTokens(tokenRepo TokenRepo, keys *Keyring, uid int64, family string) (tokens Tokens, err error) {
+	if family == "" {
+		if family, err = randomString(16); err != nil {
+			return
+		}
+	}
+	jti, err := randomString(16)
+	if err != nil {
+		return
+	}
+
+	// the access token embeds the user's UID
+	// this token should be used in the Authorization header of requests to authenticated endpoints
+	now := time.Now()
+	tokens.Expires = now.Add(accessTokenLifetime)
+	tokens.Token, err = keys.Sign(jwt.MapClaims{
+		"uid": uid,
+		"iat": now.Unix(),
+		"exp": tokens.Expires.Unix(),
+		"jti": jti,
+		"fam": family,
+	})
+	if err != nil {
+		return
+	}
+
+	// the refresh token is an opaque random string, only its hash is stored
+	if tokens.Refresh, err = randomString(32); err != nil {
+		return
+	}
+	err = tokenRepo.AddRefreshToken(&RefreshToken{
+		Hash:    hashToken(tokens.Refresh),
+		Family:  family,
+		Uid:     uid,
+		Expires: now.Add(refreshTokenLifetime),
+	})
+	return
+}
+
+func writeTokens(w http.ResponseWriter, tokens Tokens) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func refresh(tokenRepo TokenRepo, keys *Keyring) HttpErrorHandler {
+	type refreshRequest struct {
+		Refresh string `json:"refresh"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		stored, err := tokenRepo.UseRefreshToken(hashToken(req.Refresh))
+		switch err {
+		case nil:
+		case ErrRefreshTokenReused:
+			// somebody else has a copy of this token, sign out every holder of the family
+			if err := tokenRepo.RevokeFamily(stored.Family); err != nil {
+				return err
+			}
+			return HandlerError{err, http.StatusUnauthorized}
+		case ErrInvalidRefreshToken:
+			return HandlerError{err, http.StatusUnauthorized}
+		default:
+			return err
+		}
+
+		auditActor(r, stored.Uid)
+
+		// rotate: issue a new refresh token in the same family
+		tokens, err := issueTokens(tokenRepo, keys, stored.Uid, stored.Family)
+		if err != nil {
+			return err
+		}
+		writeTokens(w, tokens)
+		return nil
+	}
+}
+
+func signout(tokenRepo TokenRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get token family, added to context by authMiddleware
+		family := r.Context().Value("family").(string)
+		return tokenRepo.RevokeFamily(family)
+	}
+}
@@ -1,11 +1,34 @@
 package api
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
-	"time"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultTremorLimit = 500
+	maxTremorLimit     = 5000
+
+	maxScore         = 100
+	maxDeviceLength  = 100
+	maxVersionLength = 32
+	maxNoteLength    = 1000
+	maxTags          = 20
+	maxTagLength     = 32
+)
+
+// The hand a tremor test was done with
+const (
+	HandLeft  = "left"
+	HandRight = "right"
 )
 
 type Tremor struct {
@@ -14,18 +37,99 @@ type Tremor struct {
 	Resting  int       `json:"resting"`
 	Postural int       `json:"postural"`
 	Date     time.Time `json:"date"`
+	// the user who added the tremor, if it was someone else on the user's behalf
+	EnteredBy *int64 `json:"enteredBy"`
+	// the version of the scoring package which scored the tremor, or null if the phone did
+	Algorithm *string `json:"algorithm"`
+	// left or right, or null if the app didn't say
+	Hand       *string `json:"hand"`
+	Device     *string `json:"device"`
+	AppVersion *string `json:"appVersion"`
+	// the user stopped the test before it finished
+	Aborted bool    `json:"aborted"`
+	Note    *string `json:"note"`
+	Tags    Tags    `json:"tags"`
+}
+
+// Tags are labels users give their tests, eg. "coffee"
+type Tags = Words
+
+// A TremorFilter picks the tremors of one hand, or with a tag. Empty fields match every tremor.
+type TremorFilter struct {
+	Hand string
+	Tag  string
+}
+
+// Buckets tremors can be aggregated by. Weeks start on Monday.
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+// TremorStats describes the scores of the tremors in a bucket, StdDev is the population standard deviation
+type TremorStats struct {
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// A TremorBucket aggregates the tremors recorded in the day, week or month starting at Start
+type TremorBucket struct {
+	Start    time.Time   `json:"start"`
+	Count    int         `json:"count"`
+	Resting  TremorStats `json:"resting"`
+	Postural TremorStats `json:"postural"`
+}
+
+// A TremorCursor is the last tremor on a page, the next page starts after it. Tremors are ordered by
+// date to the second, then by tid, so pages stay stable when tremors are added in between.
+type TremorCursor struct {
+	Date time.Time
+	TID  int64
+}
+
+// A TremorPage is a page of tremors, Next is the cursor for the next one or null if this is the last
+type TremorPage struct {
+	Tremors []Tremor `json:"tremors"`
+	Next    *string  `json:"next"`
 }
 
+var ErrNoTremor = errors.New("no such tremor")
+
 type TremorRepo interface {
-	Add(uid int64, tremor *Tremor) error
+	// adds the tremor together with its samples, unless they are nil, setting its TID
+	Add(uid int64, tremor *Tremor, samples *Samples) error
 	GetAll(uid int64) ([]Tremor, error)
-	GetSince(uid int64, since time.Time) ([]Tremor, error)
+	// returns ErrNoTremor if uid has no tremor with this tid
+	Get(uid, tid int64) (Tremor, error)
+	GetSince(uid int64, since time.Time, filter TremorFilter) ([]Tremor, error)
+	// returns up to limit tremors from from to to, either of which can be nil, starting after the cursor if it is set
+	GetPage(uid int64, from, to *time.Time, filter TremorFilter, after *TremorCursor, limit int) ([]Tremor, error)
+	// returns every tremor from from to to, either of which can be nil, oldest first
+	GetRange(uid int64, from, to *time.Time, filter TremorFilter) ([]Tremor, error)
+	// aggregates the tremors from from to to, either of which can be nil, into buckets starting at midnight
+	// in loc. Aborted tests and buckets without tremors are left out.
+	Aggregate(uid int64, from, to *time.Time, filter TremorFilter, bucket string, loc *time.Location) (
+		[]TremorBucket, error)
+	// summarizes each user's tremors in their window, averaging the ones since weekStart. Aborted tests are
+	// left out, and so are users without other tremors in their window.
+	Summarize(windows []SummaryWindow, weekStart time.Time) (map[int64]TremorSummary, error)
 }
 
-func tremorsRouter(repo TremorRepo) *mux.Router {
+func tremorsRouter(repo TremorRepo, sampleRepo SampleRepo) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(auditRoute)
+	router.Handle("/tremors/{tid:[0-9]+}/samples", getSamples(repo, sampleRepo)).Methods(http.MethodGet)
+	router.Handle("/tremors/{tid:[0-9]+}/samples", addSamples(repo, sampleRepo)).Methods(http.MethodPost)
+	router.Handle("/tremors/{tid:[0-9]+}/analysis", getAnalysis(repo, sampleRepo)).Methods(http.MethodGet)
+	router.Handle("/tremors/aggregate", getTremorAggregate(repo)).Methods(http.MethodGet)
+	router.Handle("/tremors/series", getTremorSeries(repo)).Methods(http.MethodGet)
 	router.Handle("/tremors", getTremorsSince(repo)).Queries("since", "{since}").Methods(http.MethodGet)
-	router.Handle("/tremors", getTremors(repo)).Queries("uid", "{uid}").Methods(http.MethodGet)
+	router.Handle("/tremors", getTremorPage(repo)).MatcherFunc(hasQuery("from", "to", "limit", "cursor")).
+		Methods(http.MethodGet)
 	router.Handle("/tremors", getTremors(repo)).Methods(http.MethodGet)
 	router.Handle("/tremors", addTremor(repo)).Methods(http.MethodPost)
 	return router
@@ -33,29 +137,18 @@ func tremorsRouter(repo TremorRepo) *mux.Router {
 
 func getTremors(tremorRepo TremorRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		var forUid int64
-		var err error
-		// get uid from token, added to context by authMiddleware
-		tokenUid := r.Context().Value("uid").(int64)
+		// get uid of the user whose tremors are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 
-		// if the logged in user is trying to read the tremors of another user
-		requestedUidString := r.FormValue("uid")
-		if requestedUidString == "" {
-			// default to the logged in user
-			forUid = tokenUid
-		} else {
-			// else get the tremors for the uid requested in the url
-			// FIXME: need to add authentication here - make sure that user has actually shared with us
-			forUid, err = strconv.ParseInt(requestedUidString, 10, 64)
-			if err != nil {
-				return HandlerError{err, http.StatusBadRequest}
-			}
+		filter, err := requestTremorFilter(r)
+		if err != nil {
+			return err
 		}
-
-		tremors, err := tremorRepo.GetAll(forUid)
+		tremors, err := tremorRepo.GetRange(forUid, nil, nil, filter)
 		if err != nil {
 			return err
 		}
+		tremors = filterTremors(requestGrant(r), tremors)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(tremors)
 		return nil
@@ -64,8 +157,8 @@ func getTremors(tremorRepo TremorRepo) HttpErrorHandler {
 
 func getTremorsSince(tremorRepo TremorRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		// get uid from token, added to context by authMiddleware
-		tokenUid := r.Context().Value("uid").(int64)
+		// get uid of the user whose tremors are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 
 		// get since timestamp from url
 		timestring := r.FormValue("since")
@@ -74,11 +167,17 @@ func getTremorsSince(tremorRepo TremorRepo) HttpErrorHandler {
 			return HandlerError{err, http.StatusBadRequest}
 		}
 
-		// get all tremors for the logged in user since the requested date
-		tremors, err := tremorRepo.GetSince(tokenUid, timestamp)
+		filter, err := requestTremorFilter(r)
+		if err != nil {
+			return err
+		}
+
+		// get all tremors for the user since the requested date
+		tremors, err := tremorRepo.GetSince(forUid, timestamp, filter)
 		if err != nil {
 			return HandlerError{err, http.StatusInternalServerError}
 		}
+		tremors = filterTremors(requestGrant(r), tremors)
 
 		// return the tremors in a JSON array
 		w.Header().Set("Content-Type", "application/json")
@@ -87,18 +186,266 @@ func getTremorsSince(tremorRepo TremorRepo) HttpErrorHandler {
 	}
 }
 
+// parses the ?from= and ?to= of a request, either of which can be left out
+func requestWindow(r *http.Request) (from, to *time.Time, err error) {
+	query := r.URL.Query()
+	for param, date := range map[string]**time.Time{"from": &from, "to": &to} {
+		if value := query.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, nil, HandlerError{err, http.StatusBadRequest}
+			}
+			*date = &t
+		}
+	}
+	if from != nil && to != nil && to.Before(*from) {
+		return nil, nil, HandlerError{errors.New("to is before from"), http.StatusBadRequest}
+	}
+	return from, to, nil
+}
+
+// parses the ?hand= and ?tag= of a request, either of which can be left out
+func requestTremorFilter(r *http.Request) (filter TremorFilter, err error) {
+	query := r.URL.Query()
+	filter.Hand, filter.Tag = query.Get("hand"), query.Get("tag")
+	if filter.Hand != "" && filter.Hand != HandLeft && filter.Hand != HandRight {
+		return filter, HandlerError{errHand, http.StatusBadRequest}
+	}
+	if filter.Tag != "" && !validTag(filter.Tag) {
+		return filter, HandlerError{errTag, http.StatusBadRequest}
+	}
+	return filter, nil
+}
+
+// matches requests with any of the query parameters
+func hasQuery(params ...string) mux.MatcherFunc {
+	return func(r *http.Request, match *mux.RouteMatch) bool {
+		query := r.URL.Query()
+		for _, param := range params {
+			if _, ok := query[param]; ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// cursors are opaque to clients, they are the unix time and tid of the last tremor
+func encodeTremorCursor(tremor Tremor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", tremor.Date.Unix(), tremor.TID)))
+}
+
+func decodeTremorCursor(cursor string) (*TremorCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var seconds, tid int64
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &seconds, &tid); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &TremorCursor{time.Unix(seconds, 0).UTC(), tid}, nil
+}
+
+// getTremorPage returns a page of tremors recorded from ?from= to ?to=, oldest first, of the ?hand= or
+// with the ?tag= if they are set. There are ?limit= tremors on each page, and ?cursor= is the next cursor of
+// the page before.
+func getTremorPage(tremorRepo TremorRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid of the user whose tremors are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
+
+		from, to, err := requestWindow(r)
+		if err != nil {
+			return err
+		}
+		filter, err := requestTremorFilter(r)
+		if err != nil {
+			return err
+		}
+		query := r.URL.Query()
+		limit := defaultTremorLimit
+		if value := query.Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxTremorLimit {
+				err = errors.New("limit must be between 1 and " + strconv.Itoa(maxTremorLimit))
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+		var after *TremorCursor
+		if value := query.Get("cursor"); value != "" {
+			if after, err = decodeTremorCursor(value); err != nil {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+
+		// only read tremors in the shared window, so every page is full. The window is empty
+		// if what was asked for is outside of what is shared.
+		from, to = requestGrant(r).Window(from, to)
+		page := TremorPage{Tremors: []Tremor{}}
+		if from == nil || to == nil || !to.Before(*from) {
+			// get one more than the page, to know whether there is a next one
+			tremors, err := tremorRepo.GetPage(forUid, from, to, filter, after, limit+1)
+			if err != nil {
+				return err
+			}
+			if len(tremors) > limit {
+				tremors = tremors[:limit]
+				next := encodeTremorCursor(tremors[limit-1])
+				page.Next = &next
+			}
+			page.Tremors = append(page.Tremors, tremors...)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+		return nil
+	}
+}
+
+// getTremorAggregate returns statistics of the tremors recorded from ?from= to ?to= for each
+// ?bucket=day, week or month, oldest first, filtered by ?hand= and ?tag= like getTremorPage. Buckets start
+// at midnight in the ?tz= time zone, eg. America/Vancouver, or UTC if it is left out.
+func getTremorAggregate(tremorRepo TremorRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid of the user whose tremors are being read, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
+
+		bucket := r.URL.Query().Get("bucket")
+		if bucket != BucketDay && bucket != BucketWeek && bucket != BucketMonth {
+			err := errors.New("bucket must be " + BucketDay + ", " + BucketWeek + " or " + BucketMonth)
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		loc := time.UTC
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			var err error
+			if loc, err = time.LoadLocation(tz); err != nil {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+		}
+		from, to, err := requestWindow(r)
+		if err != nil {
+			return err
+		}
+		filter, err := requestTremorFilter(r)
+		if err != nil {
+			return err
+		}
+
+		// only aggregate tremors in the shared window
+		from, to = requestGrant(r).Window(from, to)
+		buckets := []TremorBucket{}
+		if from == nil || to == nil || !to.Before(*from) {
+			if buckets, err = tremorRepo.Aggregate(forUid, from, to, filter, bucket, loc); err != nil {
+				return err
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buckets)
+		return nil
+	}
+}
+
+// drops the tremors recorded outside the window shared by grant
+func filterTremors(grant *Grant, tremors []Tremor) []Tremor {
+	if grant == nil {
+		return tremors
+	}
+	filtered := tremors[:0]
+	for _, tremor := range tremors {
+		if grant.Covers(tremor.Date) {
+			filtered = append(filtered, tremor)
+		}
+	}
+	return filtered
+}
+
+var (
+	errScore   = errors.New("scores must be between 0 and " + strconv.Itoa(maxScore))
+	errHand    = errors.New("hand must be " + HandLeft + " or " + HandRight)
+	errTag     = errors.New("tags must be 1 to " + strconv.Itoa(maxTagLength) + " characters without spaces")
+	errTooLong = errors.New("device must be at most " + strconv.Itoa(maxDeviceLength) + " characters, appVersion " +
+		strconv.Itoa(maxVersionLength) + " and note " + strconv.Itoa(maxNoteLength))
+)
+
+func validTag(tag string) bool {
+	return tag != "" && len(tag) <= maxTagLength && strings.IndexFunc(tag, unicode.IsSpace) < 0
+}
+
+func (t *Tremor) validate() error {
+	if t.Resting < 0 || t.Resting > maxScore || t.Postural < 0 || t.Postural > maxScore {
+		return errScore
+	}
+	if t.Hand != nil && *t.Hand != HandLeft && *t.Hand != HandRight {
+		return errHand
+	}
+	for _, field := range []struct {
+		value *string
+		max   int
+	}{{t.Device, maxDeviceLength}, {t.AppVersion, maxVersionLength}, {t.Note, maxNoteLength}} {
+		if field.value != nil && len(*field.value) > field.max {
+			return errTooLong
+		}
+	}
+	if len(t.Tags) > maxTags {
+		return errors.New("a tremor can have at most " + strconv.Itoa(maxTags) + " tags")
+	}
+	for _, tag := range t.Tags {
+		if !validTag(tag) {
+			return errTag
+		}
+	}
+	return nil
+}
+
+// addTremor adds a tremor scored on the phone, or one with just the raw samples of the test, which the
+// server scores itself. Scores sent with samples are ignored.
 func addTremor(tremorRepo TremorRepo) HttpErrorHandler {
+	type tremorRequest struct {
+		Tremor
+		Samples *Samples `json:"samples"`
+	}
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// get uid from token, added to context by authMiddleware
 		tokenUid := r.Context().Value("uid").(int64)
+		// get uid of the user the tremor is for, added to context by accessMiddleware
+		forUid := r.Context().Value("forUid").(int64)
 
 		// decode the tremor from JSON in the request body
-		var tremor Tremor
-		if err := json.NewDecoder(r.Body).Decode(&tremor); err != nil {
+		var req tremorRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSampleBytes)).Decode(&req); err != nil {
 			return HandlerError{err, http.StatusBadRequest}
 		}
+		tremor := req.Tremor
+		tremor.EnteredBy = enteredBy(tokenUid, forUid)
+		tremor.Algorithm = nil
+		if req.Samples != nil {
+			if err := req.Samples.validate(); err != nil {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+			req.Samples.round()
+			analysis, err := req.Samples.analyze()
+			if err != nil {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+			tremor.Resting, tremor.Postural = analysis.Resting.Score, analysis.Postural.Score
+			tremor.Algorithm = &analysis.Algorithm
+		}
+		if err := tremor.validate(); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if tremor.Date.IsZero() {
+			tremor.Date = time.Now()
+		}
+		if !requestGrant(r).Covers(tremor.Date) {
+			return HandlerError{errOutsideGrant, http.StatusForbidden}
+		}
 
-		// add the tremor to the db and return any error
-		return tremorRepo.Add(tokenUid, &tremor)
+		// add the tremor to the db and return its tid
+		if err := tremorRepo.Add(forUid, &tremor, req.Samples); err != nil {
+			return err
+		}
+		w.Write([]byte(strconv.FormatInt(tremor.TID, 10)))
+		return nil
 	}
 }
@@ -4,18 +4,25 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/mux"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type UserWithoutPassword struct {
-	Uid   int64  `json:"uid"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	Uid      int64  `json:"uid"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Verified bool   `json:"verified"`
+	Role     string `json:"role"`
 }
 type User struct {
 	UserWithoutPassword
-	Password string `json:"password"`
+	Password     string     `json:"password"`
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"-"`
 }
 
 type Link struct {
@@ -23,40 +30,115 @@ type Link struct {
 	Dest   int64 `json:"to"`
 }
 
+// A LinkedUser is the other user in an accepted link, with when the link was made and what it shares.
+// Links made before invitations existed have no times.
+type LinkedUser struct {
+	UserWithoutPassword
+	Grant
+	Lid      int64      `json:"lid"`
+	Created  *time.Time `json:"created"`
+	Accepted *time.Time `json:"accepted"`
+}
+
 type UserRepo interface {
 	Add(*User) error
 	GetFromUid(int64) (User, error)
 	GetFromEmail(string) (User, error)
-	AddLink(from, to int64) error
-	GetIncomingLinks(int64) ([]UserWithoutPassword, error)
-	GetOutgoingLinks(int64) ([]UserWithoutPassword, error)
+	UpdatePassword(uid int64, hash string) error
+	SetVerified(uid int64) error
+	SetRole(uid int64, role string) error
+	RecordLoginFailure(uid int64) (int, error)
+	SetLockedUntil(uid int64, until time.Time) error
+	ClearLoginFailures(uid int64) error
+	Delete(uid int64) error
+	// invites to to see what grant shares of from's data,
+	// returns ErrLinkExists if there is already a pending or accepted link,
+	// or ErrRecentlyDeclined if to declined an invitation within DeclinedCooldown
+	AddLink(from, to int64, expires time.Time, grant Grant) error
+	// returns what owner shares with viewer, or nil if there is no accepted link which hasn't ended
+	GetGrant(owner, viewer int64) (*Grant, error)
+	// changes what a pending or accepted link shares, returns false if there is none
+	UpdateGrant(from, to int64, grant Grant) (bool, error)
+	GetInvitations(uid int64) ([]Invitation, error)
+	// returns false if there is no pending invitation with this lid sent to uid
+	RespondToInvitation(lid, uid int64, accept bool) (bool, error)
+	// returns false if there is no pending invitation with this lid sent by uid
+	RevokeInvitation(lid, uid int64) (bool, error)
+	GetIncomingLinks(int64) ([]LinkedUser, error)
+	GetOutgoingLinks(int64) ([]LinkedUser, error)
+	// removes the link from one user to another whatever its status, returns false if there is none
+	DeleteLink(from, to int64) (bool, error)
 }
 
-func userRouter(repo UserRepo) *mux.Router {
+func userRouter(repo UserRepo, tokenRepo TokenRepo, mfaRepo MFARepo, apiKeyRepo APIKeyRepo, shareRepo ShareRepo,
+	orgRepo OrgRepo, auditRepo AuditRepo, keys *Keyring, mailer Mailer, policy Policy, limits Limits) *mux.Router {
 	router := mux.NewRouter()
-	router.Handle("/users/{uid}", getUserInfo(repo)).Methods(http.MethodGet)
+	router.Use(auditRoute)
+	router.Handle("/users/{uid}", getUserInfo(repo, orgRepo)).Methods(http.MethodGet)
+	router.Handle("/users/{uid}", deleteUser(repo, mfaRepo, orgRepo, limits.Account)).Methods(http.MethodDelete)
+	router.Handle("/users/{uid}/password", changePassword(repo, tokenRepo, limits.Account)).Methods(http.MethodPut)
+	router.Handle("/users/{uid}/role", setRole(repo)).Methods(http.MethodPut)
+	router.Handle("/users/{uid}/verify", resendVerification(repo, tokenRepo, mailer)).Methods(http.MethodPost)
+	router.Handle("/users/{uid}/mfa", enrollMFA(repo, mfaRepo, limits.Account)).Methods(http.MethodPost)
+	router.Handle("/users/{uid}/mfa/confirm", confirmMFA(mfaRepo)).Methods(http.MethodPost)
+	router.Handle("/users/{uid}/mfa", disableMFA(repo, mfaRepo, limits.Account)).Methods(http.MethodDelete)
+	router.Handle("/users/{uid}/keys", getAPIKeys(apiKeyRepo)).Methods(http.MethodGet)
+	router.Handle("/users/{uid}/keys", createAPIKey(apiKeyRepo)).Methods(http.MethodPost)
+	router.Handle("/users/{uid}/keys/{kid}", revokeAPIKey(apiKeyRepo)).Methods(http.MethodDelete)
+	router.Handle("/users/{uid}/shares", getShares(shareRepo)).Methods(http.MethodGet)
+	router.Handle("/users/{uid}/shares", createShare(shareRepo, keys)).Methods(http.MethodPost)
+	router.Handle("/users/{uid}/shares/{sid}", revokeShare(shareRepo)).Methods(http.MethodDelete)
+	router.Handle("/users/{uid}/audit", getAudit(auditRepo)).Methods(http.MethodGet)
 	router.Handle("/users/links/in", getIncomingLinks(repo)).Methods(http.MethodGet)
 	router.Handle("/users/links/out", getOutgoingLinks(repo)).Methods(http.MethodGet)
-	router.Handle("/users/links/out", link(repo)).Methods(http.MethodPost)
+	router.Handle("/users/links/out", link(repo, mailer, policy)).Methods(http.MethodPost)
+	router.Handle("/users/links/out/{uid}", updateLink(repo)).Methods(http.MethodPut)
+	router.Handle("/users/links/out/{uid}", unlink(repo, true)).Methods(http.MethodDelete)
+	router.Handle("/users/links/in/{uid}", unlink(repo, false)).Methods(http.MethodDelete)
+	router.Handle("/users/links/invitations", getInvitations(repo)).Methods(http.MethodGet)
+	router.Handle("/users/links/invitations/{lid}/accept", respondToInvitation(repo, true)).Methods(http.MethodPost)
+	router.Handle("/users/links/invitations/{lid}/decline", respondToInvitation(repo, false)).Methods(http.MethodPost)
+	router.Handle("/users/links/invitations/{lid}/revoke", revokeInvitation(repo)).Methods(http.MethodPost)
 	return router
 }
 
-func getUserInfo(userRepo UserRepo) HttpErrorHandler {
-	return func(w http.ResponseWriter, r *http.Request) error {
-		// get uid from token, added to context by authMiddleware
-		tokenUid := r.Context().Value("uid").(int64)
+// returns the uid from the url, making sure it is the logged-in user
+func selfUid(r *http.Request) (int64, error) {
+	// get uid from token, added to context by authMiddleware
+	tokenUid := r.Context().Value("uid").(int64)
 
-		// get uid from url
-		vars := mux.Vars(r)
-		urlUid, err := strconv.ParseInt(vars["uid"], 10, 64)
-		if err != nil {
-			return HandlerError{err, http.StatusBadRequest}
-		}
+	// get uid from url
+	vars := mux.Vars(r)
+	urlUid, err := strconv.ParseInt(vars["uid"], 10, 64)
+	if err != nil {
+		return 0, HandlerError{err, http.StatusBadRequest}
+	}
 
-		// make sure only the logged-in user can see their profile
-		if tokenUid != urlUid {
-			status := http.StatusUnauthorized
-			return HandlerError{errors.New(http.StatusText(status)), status}
+	if tokenUid != urlUid {
+		status := http.StatusUnauthorized
+		return 0, HandlerError{errors.New(http.StatusText(status)), status}
+	}
+	return urlUid, nil
+}
+
+func getUserInfo(userRepo UserRepo, orgRepo OrgRepo) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// make sure only the logged-in user, or someone they share their profile with, can see it
+		urlUid, err := selfUid(r)
+		if err != nil {
+			otherUid, parseErr := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+			if parseErr != nil {
+				return err
+			}
+			auditSubject(r, otherUid)
+			grant, grantErr := findGrant(userRepo, orgRepo, otherUid, r.Context().Value("uid").(int64), ScopeProfile)
+			if grantErr != nil {
+				return grantErr
+			}
+			if grant == nil {
+				return err
+			}
+			urlUid = otherUid
 		}
 
 		// get stored user details
@@ -71,26 +153,32 @@ func getUserInfo(userRepo UserRepo) HttpErrorHandler {
 		}
 
 		// don't want to send password hash from database
-		userWithoutPassword := UserWithoutPassword{user.Uid, user.Email, user.Name}
-
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(userWithoutPassword)
+		json.NewEncoder(w).Encode(user.UserWithoutPassword)
 		return nil
 	}
 }
 
-func link(userRepo UserRepo) HttpErrorHandler {
-	type email struct {
+// link invites another user to see the logged in user's data, they have to accept before they can.
+// By default everything is shared for good, the request can limit it to some scopes and a window
+// of data, and end the link after a number of days or at a given time.
+func link(userRepo UserRepo, mailer Mailer, policy Policy) HttpErrorHandler {
+	type linkRequest struct {
 		Email string `json:"email"`
+		Grant
+		Days int `json:"days"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// get uid from token, added to context by authMiddleware
 		tokenUid := r.Context().Value("uid").(int64)
 
-		var e email
+		var e linkRequest
 		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
 			return HandlerError{err, http.StatusBadRequest}
 		}
+		if err := grantWithDays(&e.Grant, e.Days); err != nil {
+			return err
+		}
 
 		otherUser, err := userRepo.GetFromEmail(e.Email)
 		if err != nil {
@@ -102,10 +190,115 @@ func link(userRepo UserRepo) HttpErrorHandler {
 			}
 		}
 
-		return userRepo.AddLink(tokenUid, otherUser.Uid)
+		// a mistyped email could belong to a stranger, so deployments can insist the address is proven
+		if policy.RequireVerifiedLinks && !otherUser.Verified {
+			return HandlerError{errors.New("user has not verified their email"), http.StatusForbidden}
+		}
+
+		if otherUser.Uid == tokenUid {
+			return HandlerError{errors.New("can't share with yourself"), http.StatusBadRequest}
+		}
+
+		err = userRepo.AddLink(tokenUid, otherUser.Uid, time.Now().Add(invitationLifetime), e.Grant)
+		if err == ErrLinkExists || err == ErrRecentlyDeclined {
+			return HandlerError{err, http.StatusConflict}
+		} else if err != nil {
+			return err
+		}
+
+		// let the other user know, the invitation still works if this fails
+		user, err := userRepo.GetFromUid(tokenUid)
+		if err != nil {
+			return err
+		}
+		invited := "see their " + describeScopes(e.Scopes)
+		if e.CanWrite {
+			invited += ", and add records for them,"
+		}
+		err = mailer.Send(otherUser.Email, user.Name+" wants to share their Tremr data with you",
+			"Hi "+otherUser.Name+",\n\n"+
+				user.Name+" ("+user.Email+") has invited you to "+invited+" on Tremr. "+
+				"Sign in to accept or decline the invitation within the next two weeks.\n")
+		if err != nil {
+			log.Print("failed to send invitation email: ", err)
+		}
+		return nil
 	}
 }
 
+// updateLink changes what the logged in user shares with the user in the url,
+// taking the same scopes, window and end as link
+func updateLink(userRepo UserRepo) HttpErrorHandler {
+	type updateRequest struct {
+		Grant
+		Days int `json:"days"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		otherUid, err := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		var req updateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		if err := grantWithDays(&req.Grant, req.Days); err != nil {
+			return err
+		}
+		found, err := userRepo.UpdateGrant(tokenUid, otherUid, req.Grant)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("no link with this user"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+// validates a grant from a request, where days is an alternative to setting EndsAt
+func grantWithDays(grant *Grant, days int) error {
+	if days < 0 || (days > 0 && grant.EndsAt != nil) {
+		return HandlerError{errors.New("days must be positive and can't be used with endsAt"), http.StatusBadRequest}
+	}
+	if days > 0 {
+		endsAt := time.Now().AddDate(0, 0, days)
+		grant.EndsAt = &endsAt
+	}
+	if err := grant.validate(); err != nil {
+		return HandlerError{err, http.StatusBadRequest}
+	}
+	return nil
+}
+
+// describes what is shared for the invitation email, eg. "tremor and medicine data and profile"
+func describeScopes(scopes Scopes) string {
+	names := map[string]string{ScopeTremors: "tremor", ScopeMeds: "medicine", ScopeExercises: "exercise"}
+	var data []string
+	for _, scope := range scopes {
+		if name, ok := names[scope]; ok {
+			data = append(data, name)
+		}
+	}
+	description := ""
+	if len(data) > 0 {
+		description = data[len(data)-1] + " data"
+		if len(data) > 1 {
+			description = strings.Join(data[:len(data)-1], ", ") + " and " + description
+		}
+	}
+	if hasScope(scopes, ScopeProfile) {
+		if description != "" {
+			description += " and "
+		}
+		description += "profile"
+	}
+	return description
+}
+
 func getIncomingLinks(userRepo UserRepo) HttpErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		// get uid from token, added to context by authMiddleware
@@ -135,3 +328,87 @@ func getOutgoingLinks(userRepo UserRepo) HttpErrorHandler {
 		return nil
 	}
 }
+
+// unlink stops sharing the logged in user's data with the user in the url if outgoing is set,
+// otherwise it stops the logged in user seeing the data of the user in the url
+func unlink(userRepo UserRepo, outgoing bool) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// get uid from token, added to context by authMiddleware
+		tokenUid := r.Context().Value("uid").(int64)
+
+		otherUid, err := strconv.ParseInt(mux.Vars(r)["uid"], 10, 64)
+		if err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+		from, to := tokenUid, otherUid
+		if !outgoing {
+			from, to = otherUid, tokenUid
+		}
+		found, err := userRepo.DeleteLink(from, to)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return HandlerError{errors.New("no link with this user"), http.StatusNotFound}
+		}
+		return nil
+	}
+}
+
+func deleteUser(userRepo UserRepo, mfaRepo MFARepo, orgRepo OrgRepo, limiter RateLimiter) HttpErrorHandler {
+	type deleteRequest struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		var req deleteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		// this can't be undone, so make sure it's really the user and not just someone with their token
+		user, err := userRepo.GetFromUid(uid)
+		if err != nil {
+			return err
+		}
+		if err := checkPassword(userRepo, limiter, w, user, req.Password); err != nil {
+			return err
+		}
+		mfa, err := mfaRepo.GetMFA(uid)
+		if err != nil && err != ErrNoMFA {
+			return err
+		}
+		if mfa.Enabled {
+			if err := checkCode(userRepo, mfaRepo, limiter, w, user, mfa, req.Code); err != nil {
+				return err
+			}
+		}
+
+		// organizations can't be left without an admin. Ones the user is the only member of are deleted too.
+		orgs, err := orgRepo.GetOrgs(uid)
+		if err != nil {
+			return err
+		}
+		for _, org := range orgs {
+			if org.Role != OrgRoleAdmin {
+				continue
+			}
+			members, err := orgRepo.GetMembers(org.Oid)
+			if err != nil {
+				return err
+			}
+			if len(members) > 1 {
+				if err := checkOtherAdmin(orgRepo, org.Oid, uid); err != nil {
+					return err
+				}
+			}
+		}
+
+		// this also deletes every refresh token, which signs out every session
+		return userRepo.Delete(uid)
+	}
+}
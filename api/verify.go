@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	verifyTokenLifetime = 48 * time.Hour
+	verifyTokenPurpose  = "verify"
+)
+
+// Policy holds the rules which can be configured per deployment
+type Policy struct {
+	// only allow sharing data with users who have verified their email address
+	RequireVerifiedLinks bool
+}
+
+func validEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	// reject display names and comments, eg. "Bob <bob@example.com>"
+	if err != nil || addr.Address != email {
+		return errors.New("invalid email")
+	}
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	// ParseAddress accepts addresses like bob@localhost, which can't be delivered to from the internet
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return errors.New("invalid email")
+	}
+	return nil
+}
+
+// emails the user a single-use token which proves they own their email address
+func sendVerification(tokenRepo TokenRepo, mailer Mailer, user UserWithoutPassword) error {
+	token, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	err = tokenRepo.AddUserToken(user.Uid, verifyTokenPurpose, hashToken(token), time.Now().Add(verifyTokenLifetime))
+	if err != nil {
+		return err
+	}
+	return mailer.Send(user.Email, "Verify your Tremr email address",
+		"Hi "+user.Name+",\n\n"+
+			"Welcome to Tremr! Use this code within the next two days to verify your email address:\n\n"+
+			token+"\n\n"+
+			"Until you do, other users will not be able to share their data with you.\n")
+}
+
+func verifyEmail(userRepo UserRepo, tokenRepo TokenRepo) HttpErrorHandler {
+	type verification struct {
+		Token string `json:"token"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var v verification
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return HandlerError{err, http.StatusBadRequest}
+		}
+
+		uid, err := tokenRepo.UseUserToken(verifyTokenPurpose, hashToken(v.Token))
+		if err != nil {
+			if err == ErrInvalidUserToken {
+				return HandlerError{err, http.StatusBadRequest}
+			}
+			return err
+		}
+		auditActor(r, uid)
+		return userRepo.SetVerified(uid)
+	}
+}
+
+func resendVerification(userRepo UserRepo, tokenRepo TokenRepo, mailer Mailer) HttpErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		uid, err := selfUid(r)
+		if err != nil {
+			return err
+		}
+		user, err := userRepo.GetFromUid(uid)
+		if err != nil {
+			return err
+		}
+		if user.Verified {
+			return HandlerError{errors.New("email is already verified"), http.StatusConflict}
+		}
+		if err := sendVerification(tokenRepo, mailer, user.UserWithoutPassword); err != nil {
+			log.Print("failed to send verification email: ", err)
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"time"
+)
+
+const (
+	apiKeysCreate = `create table if not exists api_keys(
+		kid INTEGER PRIMARY KEY AUTOINCREMENT,
+		hash TEXT UNIQUE NOT NULL,
+		uid INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created DATETIME NOT NULL,
+		lastused DATETIME
+	)`
+	apiKeyInsert = `insert into api_keys(hash, uid, name, prefix, scopes, created)
+		values(?, ?, ?, ?, ?, ?)`
+	apiKeysSelect      = "select kid, uid, name, prefix, scopes, created, lastused from api_keys where uid = ? order by kid"
+	apiKeySelectByHash = "select kid, uid, name, prefix, scopes, created, lastused from api_keys where hash = ?"
+	apiKeyTouch        = "update api_keys set lastused = ? where hash = ?"
+	apiKeyDelete       = "delete from api_keys where uid = ? and kid = ?"
+	apiKeysDelete      = "delete from api_keys where uid = ?"
+)
+
+type apiKeyRepo struct {
+	add       *sqlx.Stmt
+	getAll    *sqlx.Stmt
+	getByHash *sqlx.Stmt
+	touch     *sqlx.Stmt
+	delete    *sqlx.Stmt
+	deleteAll *sqlx.Stmt
+}
+
+func NewAPIKeyRepo(db *sqlx.DB) (a *apiKeyRepo, err error) {
+	if _, err = db.Exec(apiKeysCreate); err != nil {
+		return
+	}
+	a = new(apiKeyRepo)
+	if a.add, err = db.Preparex(apiKeyInsert); err != nil {
+		return
+	}
+	if a.getAll, err = db.Preparex(apiKeysSelect); err != nil {
+		return
+	}
+	if a.getByHash, err = db.Preparex(apiKeySelectByHash); err != nil {
+		return
+	}
+	if a.touch, err = db.Preparex(apiKeyTouch); err != nil {
+		return
+	}
+	if a.delete, err = db.Preparex(apiKeyDelete); err != nil {
+		return
+	}
+	if a.deleteAll, err = db.Preparex(apiKeysDelete); err != nil {
+		return
+	}
+	return
+}
+
+func (a *apiKeyRepo) AddAPIKey(key *api.APIKey, hash string) error {
+	result, err := a.add.Exec(hash, key.Uid, key.Name, key.Prefix, key.Scopes, key.Created)
+	if err != nil {
+		return err
+	}
+	key.Kid, err = result.LastInsertId()
+	return err
+}
+
+func (a *apiKeyRepo) GetAPIKeys(uid int64) (keys []api.APIKey, err error) {
+	err = a.getAll.Select(&keys, uid)
+	return
+}
+
+// Returns api.ErrInvalidAPIKey if no key has this hash
+func (a *apiKeyRepo) UseAPIKey(hash string) (key api.APIKey, err error) {
+	result, err := a.touch.Exec(time.Now(), hash)
+	if err != nil {
+		return
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows != 1 {
+		err = api.ErrInvalidAPIKey
+		return
+	}
+	err = a.getByHash.Get(&key, hash)
+	return
+}
+
+func (a *apiKeyRepo) DeleteAPIKey(uid, kid int64) (bool, error) {
+	result, err := a.delete.Exec(uid, kid)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
+
+func (a *apiKeyRepo) DeleteAPIKeys(uid int64) error {
+	_, err := a.deleteAll.Exec(uid)
+	return err
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+)
+
+const (
+	auditCreate = `create table if not exists audit_log(
+		aid INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor INTEGER,
+		subject INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		resource TEXT NOT NULL,
+		time DATETIME NOT NULL,
+		requestid TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		outcome TEXT NOT NULL
+	)`
+	auditSubjectIndex = "create index if not exists audit_log_subject on audit_log(subject, aid)"
+	// the database refuses to change the log, so nothing in the app can rewrite history by mistake
+	auditNoUpdate = `create trigger if not exists audit_log_no_update before update on audit_log
+		begin select raise(abort, 'the audit log is append-only'); end`
+	auditNoDelete = `create trigger if not exists audit_log_no_delete before delete on audit_log
+		begin select raise(abort, 'the audit log is append-only'); end`
+	auditInsert = `insert into audit_log(actor, subject, action, resource, time, requestid, status, outcome)
+		values(?, ?, ?, ?, ?, ?, ?, ?)`
+	// empty filters match everything, see api.AuditFilter
+	auditSelect = `select aid, actor, subject, action, resource, time, requestid, status, outcome from audit_log
+		where (?1 is null or actor = ?1) and (?2 is null or subject = ?2) and (?3 = '' or action = ?3)
+		and (?4 = '' or outcome = ?4) and (?5 is null or datetime(time) >= datetime(?5))
+		and (?6 is null or datetime(time) < datetime(?6)) and (?7 is null or aid < ?7)
+		and (not ?8 or actor is null or actor != subject)
+		order by aid desc limit ?9`
+)
+
+type auditRepo struct {
+	add   *sqlx.Stmt
+	query *sqlx.Stmt
+}
+
+func NewAuditRepo(db *sqlx.DB) (a *auditRepo, err error) {
+	for _, create := range []string{auditCreate, auditSubjectIndex, auditNoUpdate, auditNoDelete} {
+		if _, err = db.Exec(create); err != nil {
+			return
+		}
+	}
+	a = new(auditRepo)
+	if a.add, err = db.Preparex(auditInsert); err != nil {
+		return
+	}
+	if a.query, err = db.Preparex(auditSelect); err != nil {
+		return
+	}
+	return
+}
+
+func (a *auditRepo) Record(entry *api.AuditEntry) error {
+	result, err := a.add.Exec(entry.Actor, entry.Subject, entry.Action, entry.Resource, entry.Time, entry.RequestId,
+		entry.Status, entry.Outcome)
+	if err != nil {
+		return err
+	}
+	entry.Aid, err = result.LastInsertId()
+	return err
+}
+
+func (a *auditRepo) Query(filter api.AuditFilter) (entries []api.AuditEntry, err error) {
+	err = a.query.Select(&entries, filter.Actor, filter.Subject, filter.Action, filter.Outcome, filter.From,
+		filter.To, filter.Before, filter.OthersOnly, filter.Limit)
+	return
+}
@@ -22,5 +22,41 @@ func GetDataStore(db *sqlx.DB) (ds api.DataStore, err error) {
 	if err != nil {
 		return
 	}
+	ds.TokenRepo, err = NewTokenRepo(db)
+	if err != nil {
+		return
+	}
+	ds.MFARepo, err = NewMFARepo(db)
+	if err != nil {
+		return
+	}
+	ds.APIKeyRepo, err = NewAPIKeyRepo(db)
+	if err != nil {
+		return
+	}
+	ds.OIDCRepo, err = NewOIDCRepo(db)
+	if err != nil {
+		return
+	}
+	ds.ShareRepo, err = NewShareRepo(db)
+	if err != nil {
+		return
+	}
+	ds.OrgRepo, err = NewOrgRepo(db)
+	if err != nil {
+		return
+	}
+	ds.AuditRepo, err = NewAuditRepo(db)
+	if err != nil {
+		return
+	}
+	ds.SampleRepo, err = NewSampleRepo(db)
+	if err != nil {
+		return
+	}
+	ds.RescoreRepo, err = NewRescoreRepo(db)
+	if err != nil {
+		return
+	}
 	return
 }
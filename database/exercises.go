@@ -23,7 +23,8 @@ const (
 		su BOOL NOT NULL,
 		reminder BOOL NOT NULL,
 		startdate DATETIME NOT NULL,
-		enddate DATETIME)`
+		enddate DATETIME,
+		enteredby INTEGER)`
 	exerciseInsert = `insert into exercises(
 		uid,
 		name,
@@ -31,8 +32,9 @@ const (
 		mo,	tu, we, th, fr, sa, su,
 		reminder,
 		startdate,
-		enddate)
-		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		enddate,
+		enteredby)
+		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	exerciseSelectBase = "select * from exercises where uid = ?"
 	//orderByStartDate   = " order by datetime(startdate) desc" defined in medicines.go
 	exerciseSelectAll = exerciseSelectBase + orderByStartDate
@@ -68,6 +70,9 @@ func NewExerciseRepo(db *sqlx.DB) (e *exerciseRepo, err error) {
 	if _, err = db.Exec(exercisesCreate); err != nil {
 		return
 	}
+	if err = addColumn(db, "exercises", "enteredby", "INTEGER"); err != nil {
+		return
+	}
 	e = new(exerciseRepo)
 	if e.add, err = db.Preparex(exerciseInsert); err != nil {
 		return
@@ -103,7 +108,8 @@ func (e *exerciseRepo) Add(uid int64, exercise *api.Exercise) (eid int64, err er
 		exercise.Schedule.Su,
 		exercise.Reminder,
 		exercise.StartDate,
-		exercise.EndDate)
+		exercise.EndDate,
+		exercise.EnteredBy)
 	if err != nil {
 		return
 	}
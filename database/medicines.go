@@ -23,7 +23,8 @@ const (
 		su BOOL NOT NULL,
 		reminder BOOL NOT NULL,
 		startdate DATETIME NOT NULL,
-		enddate DATETIME)`
+		enddate DATETIME,
+		enteredby INTEGER)`
 	medicineInsert = `insert into medicines(
 		uid,
 		name,
@@ -31,8 +32,9 @@ const (
 		mo,	tu, we, th, fr, sa, su,
 		reminder,
 		startdate,
-		enddate)
-		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		enddate,
+		enteredby)
+		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	medicineSelectBase = "select * from medicines where uid = ?"
 	orderByStartDate   = " order by datetime(startdate) desc"
 	medicineSelectAll  = medicineSelectBase + orderByStartDate
@@ -68,6 +70,9 @@ func NewMedicineRepo(db *sqlx.DB) (m *medicineRepo, err error) {
 	if _, err = db.Exec(medicinesCreate); err != nil {
 		return
 	}
+	if err = addColumn(db, "medicines", "enteredby", "INTEGER"); err != nil {
+		return
+	}
 	m = new(medicineRepo)
 	if m.add, err = db.Preparex(medicineInsert); err != nil {
 		return
@@ -103,7 +108,8 @@ func (m *medicineRepo) Add(uid int64, medicine *api.Medicine) (mid int64, err er
 		medicine.Schedule.Su,
 		medicine.Reminder,
 		medicine.StartDate,
-		medicine.EndDate)
+		medicine.EndDate,
+		medicine.EnteredBy)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+)
+
+const (
+	// the secret has to be stored as is, since it is needed to compute the expected codes
+	mfaCreate = `create table if not exists mfa(
+		uid INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled BOOL NOT NULL DEFAULT 0,
+		lastcounter INTEGER NOT NULL DEFAULT 0
+	)`
+	mfaSelect    = "select uid, secret, enabled, lastcounter from mfa where uid = ?"
+	mfaSetSecret = `insert into mfa(uid, secret) values(?1, ?2)
+		on conflict(uid) do update set secret = ?2, lastcounter = 0 where enabled = 0`
+	mfaEnable     = "update mfa set enabled = 1 where uid = ?"
+	mfaDelete     = "delete from mfa where uid = ?"
+	mfaUseCounter = "update mfa set lastcounter = ?1 where uid = ?2 and lastcounter < ?1"
+
+	recoveryCodesCreate = `create table if not exists recovery_codes(
+		hash TEXT NOT NULL,
+		uid INTEGER NOT NULL,
+		used BOOL NOT NULL DEFAULT 0
+	)`
+	recoveryCodeInsert  = "insert into recovery_codes(hash, uid) values(?, ?)"
+	recoveryCodesDelete = "delete from recovery_codes where uid = ?"
+	recoveryCodeUse     = "update recovery_codes set used = 1 where hash = ? and uid = ? and used = 0"
+)
+
+type mfaRepo struct {
+	db         *sqlx.DB
+	get        *sqlx.Stmt
+	setSecret  *sqlx.Stmt
+	enable     *sqlx.Stmt
+	delete     *sqlx.Stmt
+	useCounter *sqlx.Stmt
+
+	addRecoveryCode     *sqlx.Stmt
+	deleteRecoveryCodes *sqlx.Stmt
+	useRecoveryCode     *sqlx.Stmt
+}
+
+func NewMFARepo(db *sqlx.DB) (m *mfaRepo, err error) {
+	if _, err = db.Exec(mfaCreate); err != nil {
+		return
+	}
+	if _, err = db.Exec(recoveryCodesCreate); err != nil {
+		return
+	}
+	m = &mfaRepo{db: db}
+	if m.get, err = db.Preparex(mfaSelect); err != nil {
+		return
+	}
+	if m.setSecret, err = db.Preparex(mfaSetSecret); err != nil {
+		return
+	}
+	if m.enable, err = db.Preparex(mfaEnable); err != nil {
+		return
+	}
+	if m.delete, err = db.Preparex(mfaDelete); err != nil {
+		return
+	}
+	if m.useCounter, err = db.Preparex(mfaUseCounter); err != nil {
+		return
+	}
+	if m.addRecoveryCode, err = db.Preparex(recoveryCodeInsert); err != nil {
+		return
+	}
+	if m.deleteRecoveryCodes, err = db.Preparex(recoveryCodesDelete); err != nil {
+		return
+	}
+	if m.useRecoveryCode, err = db.Preparex(recoveryCodeUse); err != nil {
+		return
+	}
+	return
+}
+
+// Returns api.ErrNoMFA if the user has never started enrolling
+func (m *mfaRepo) GetMFA(uid int64) (mfa api.MFA, err error) {
+	var rows []api.MFA
+	if err = m.get.Select(&rows, uid); err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		err = api.ErrNoMFA
+		return
+	}
+	mfa = rows[0]
+	return
+}
+
+func (m *mfaRepo) SetMFASecret(uid int64, secret string) error {
+	_, err := m.setSecret.Exec(uid, secret)
+	return err
+}
+
+// Enables two-factor authentication and replaces the recovery codes in one transaction,
+// so the user is never left without working recovery codes
+func (m *mfaRepo) EnableMFA(uid int64, recoveryHashes []string) error {
+	tx, err := m.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(m.enable).Exec(uid); err != nil {
+		return err
+	}
+	if _, err := tx.Stmtx(m.deleteRecoveryCodes).Exec(uid); err != nil {
+		return err
+	}
+	add := tx.Stmtx(m.addRecoveryCode)
+	for _, hash := range recoveryHashes {
+		if _, err := add.Exec(hash, uid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *mfaRepo) DisableMFA(uid int64) error {
+	tx, err := m.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(m.delete).Exec(uid); err != nil {
+		return err
+	}
+	if _, err := tx.Stmtx(m.deleteRecoveryCodes).Exec(uid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *mfaRepo) UseTOTPCounter(uid int64, counter int64) (bool, error) {
+	result, err := m.useCounter.Exec(counter, uid)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
+
+func (m *mfaRepo) UseRecoveryCode(uid int64, hash string) (bool, error) {
+	result, err := m.useRecoveryCode.Exec(hash, uid)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
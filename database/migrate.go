@@ -0,0 +1,29 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// addColumn adds a column to a table created by an older version of the server.
+// "create table if not exists" leaves existing tables alone, so new columns have to be added this way.
+// The definition's default value is given to every existing row.
+func addColumn(db *sqlx.DB, table, column, definition string) error {
+	var columns []struct {
+		Cid        int
+		Name       string
+		Type       string
+		NotNull    bool    `db:"notnull"`
+		Default    *string `db:"dflt_value"`
+		PrimaryKey int     `db:"pk"`
+	}
+	if err := db.Select(&columns, "pragma table_info("+table+")"); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if c.Name == column {
+			return nil
+		}
+	}
+	_, err := db.Exec("alter table " + table + " add column " + column + " " + definition)
+	return err
+}
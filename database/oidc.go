@@ -0,0 +1,123 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"time"
+)
+
+const (
+	oidcStatesCreate = `create table if not exists oidc_states(
+		hash TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		verifier TEXT NOT NULL,
+		expires DATETIME NOT NULL
+	)`
+	oidcStateInsert       = "insert into oidc_states(hash, provider, nonce, verifier, expires) values(?, ?, ?, ?, ?)"
+	oidcStateSelect       = "select hash, provider, nonce, verifier, expires from oidc_states where hash = ?"
+	oidcStateDelete       = "delete from oidc_states where hash = ?"
+	oidcStatesDeleteStale = "delete from oidc_states where datetime(expires) < datetime(?)"
+
+	identitiesCreate = `create table if not exists identities(
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		uid INTEGER NOT NULL,
+		PRIMARY KEY (provider, subject)
+	)`
+	identityInsert = "insert into identities(provider, subject, uid) values(?, ?, ?)"
+	identitySelect = "select uid from identities where provider = ? and subject = ?"
+)
+
+type oidcRepo struct {
+	addState         *sqlx.Stmt
+	getState         *sqlx.Stmt
+	deleteState      *sqlx.Stmt
+	deleteStaleState *sqlx.Stmt
+
+	addIdentity *sqlx.Stmt
+	getIdentity *sqlx.Stmt
+}
+
+func NewOIDCRepo(db *sqlx.DB) (o *oidcRepo, err error) {
+	if _, err = db.Exec(oidcStatesCreate); err != nil {
+		return
+	}
+	if _, err = db.Exec(identitiesCreate); err != nil {
+		return
+	}
+	o = new(oidcRepo)
+	if o.addState, err = db.Preparex(oidcStateInsert); err != nil {
+		return
+	}
+	if o.getState, err = db.Preparex(oidcStateSelect); err != nil {
+		return
+	}
+	if o.deleteState, err = db.Preparex(oidcStateDelete); err != nil {
+		return
+	}
+	if o.deleteStaleState, err = db.Preparex(oidcStatesDeleteStale); err != nil {
+		return
+	}
+	if o.addIdentity, err = db.Preparex(identityInsert); err != nil {
+		return
+	}
+	if o.getIdentity, err = db.Preparex(identitySelect); err != nil {
+		return
+	}
+	return
+}
+
+func (o *oidcRepo) AddOIDCState(state *api.OIDCState) error {
+	// signins which were never finished are cleaned up here
+	if _, err := o.deleteStaleState.Exec(time.Now()); err != nil {
+		return err
+	}
+	_, err := o.addState.Exec(state.Hash, state.Provider, state.Nonce, state.Verifier, state.Expires)
+	return err
+}
+
+// Returns api.ErrInvalidOIDCState if the state does not exist, has expired or was already used
+func (o *oidcRepo) UseOIDCState(hash string) (state api.OIDCState, err error) {
+	var states []api.OIDCState
+	if err = o.getState.Select(&states, hash); err != nil {
+		return
+	}
+	if len(states) == 0 {
+		err = api.ErrInvalidOIDCState
+		return
+	}
+	// only whoever deletes the state gets to use it
+	result, err := o.deleteState.Exec(hash)
+	if err != nil {
+		return
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	state = states[0]
+	if numRows != 1 || state.Expires.Before(time.Now()) {
+		err = api.ErrInvalidOIDCState
+	}
+	return
+}
+
+// Returns api.ErrNoIdentity if the identity has never signed in
+func (o *oidcRepo) GetIdentity(provider, subject string) (uid int64, err error) {
+	var uids []int64
+	if err = o.getIdentity.Select(&uids, provider, subject); err != nil {
+		return
+	}
+	if len(uids) == 0 {
+		err = api.ErrNoIdentity
+		return
+	}
+	uid = uids[0]
+	return
+}
+
+func (o *oidcRepo) AddIdentity(provider, subject string, uid int64) error {
+	_, err := o.addIdentity.Exec(provider, subject, uid)
+	return err
+}
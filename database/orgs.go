@@ -0,0 +1,258 @@
+package database
+
+import (
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"time"
+)
+
+const (
+	orgsCreate = `create table if not exists orgs(
+		oid INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created DATETIME NOT NULL,
+		sharecode TEXT
+	)`
+	orgMembersCreate = `create table if not exists org_members(
+		oid INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		added DATETIME NOT NULL,
+		PRIMARY KEY(oid, uid)
+	)`
+	// what a patient shares with an organization, see api.Grant
+	orgSharesCreate = `create table if not exists org_shares(
+		oid INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		shared DATETIME NOT NULL,
+		scopes TEXT NOT NULL,
+		datafrom DATETIME,
+		datato DATETIME,
+		endsat DATETIME,
+		PRIMARY KEY(oid, uid)
+	)`
+	// organizations from before share codes get a random one
+	orgShareCodesFill = "update orgs set sharecode = lower(hex(randomblob(12))) where sharecode is null"
+	orgInsert         = "insert into orgs(name, created, sharecode) values(?, ?, ?)"
+	orgSelect         = "select oid, name, created, sharecode from orgs where oid = ?"
+	orgsSelectForUser = `select orgs.oid, name, created, sharecode, role from orgs
+		inner join org_members on org_members.oid = orgs.oid and org_members.uid = ? order by orgs.oid`
+	orgMembersSelect = `select users.uid, email, name, verified, users.role, org_members.role as orgrole, added
+		from users inner join org_members on org_members.uid = users.uid and org_members.oid = ? order by name`
+	orgMemberRole   = "select role from org_members where oid = ? and uid = ?"
+	orgMemberInsert = "insert or ignore into org_members(oid, uid, role, added) values(?, ?, ?, ?)"
+	// members stop being an admin, or are removed, only if someone else is still an admin. Checking in the
+	// same statement means two admins can't both step down at once.
+	orgOtherAdmin = "exists (select 1 from org_members where oid = ?1 and uid != ?2 and role = '" +
+		api.OrgRoleAdmin + "')"
+	orgMemberUpdate = "update org_members set role = ?3 where oid = ?1 and uid = ?2 and (?3 = '" + api.OrgRoleAdmin +
+		"' or " + orgOtherAdmin + ")"
+	orgMemberDelete = "delete from org_members where oid = ?1 and uid = ?2 and " + orgOtherAdmin
+	orgShareUpsert  = `insert into org_shares(oid, uid, shared, scopes, datafrom, datato, endsat)
+		values(?1, ?2, ?3, ?4, ?5, ?6, ?7) on conflict(oid, uid) do update set
+		shared = ?3, scopes = ?4, datafrom = ?5, datato = ?6, endsat = ?7`
+	orgShareDelete  = "delete from org_shares where oid = ? and uid = ?"
+	orgSharesSelect = `select orgs.oid, name, created, shared, scopes, datafrom, datato, endsat from orgs
+		inner join org_shares on org_shares.oid = orgs.oid and org_shares.uid = ? order by orgs.oid`
+	// only shares which haven't ended give access, so patients whose share ended aren't listed
+	orgPatientsSelect = `select users.uid, email, name, verified, role, shared as created, shared as accepted,
+		scopes, datafrom, datato, endsat from users
+		inner join org_shares on org_shares.uid = users.uid and org_shares.oid = ?1
+		and (endsat is null or datetime(endsat) > datetime(?2))`
+	orgGrantsSelect = `select org_shares.scopes, datafrom, datato, endsat from org_shares
+		inner join org_members on org_members.oid = org_shares.oid and org_members.uid = ?2
+		where org_shares.uid = ?1 and (endsat is null or datetime(endsat) > datetime(?3))`
+)
+
+type orgRepo struct {
+	db            *sqlx.DB
+	get           *sqlx.Stmt
+	getForUser    *sqlx.Stmt
+	getMembers    *sqlx.Stmt
+	getMemberRole *sqlx.Stmt
+	addMember     *sqlx.Stmt
+	updateMember  *sqlx.Stmt
+	deleteMember  *sqlx.Stmt
+	share         *sqlx.Stmt
+	unshare       *sqlx.Stmt
+	getShares     *sqlx.Stmt
+	getPatients   *sqlx.Stmt
+	getGrants     *sqlx.Stmt
+}
+
+func NewOrgRepo(db *sqlx.DB) (o *orgRepo, err error) {
+	for _, create := range []string{orgsCreate, orgMembersCreate, orgSharesCreate} {
+		if _, err = db.Exec(create); err != nil {
+			return
+		}
+	}
+	if err = addColumn(db, "orgs", "sharecode", "TEXT"); err != nil {
+		return
+	}
+	if _, err = db.Exec(orgShareCodesFill); err != nil {
+		return
+	}
+	o = &orgRepo{db: db}
+	if o.get, err = db.Preparex(orgSelect); err != nil {
+		return
+	}
+	if o.getForUser, err = db.Preparex(orgsSelectForUser); err != nil {
+		return
+	}
+	if o.getMembers, err = db.Preparex(orgMembersSelect); err != nil {
+		return
+	}
+	if o.getMemberRole, err = db.Preparex(orgMemberRole); err != nil {
+		return
+	}
+	if o.addMember, err = db.Preparex(orgMemberInsert); err != nil {
+		return
+	}
+	if o.updateMember, err = db.Preparex(orgMemberUpdate); err != nil {
+		return
+	}
+	if o.deleteMember, err = db.Preparex(orgMemberDelete); err != nil {
+		return
+	}
+	if o.share, err = db.Preparex(orgShareUpsert); err != nil {
+		return
+	}
+	if o.unshare, err = db.Preparex(orgShareDelete); err != nil {
+		return
+	}
+	if o.getShares, err = db.Preparex(orgSharesSelect); err != nil {
+		return
+	}
+	if o.getPatients, err = db.Preparex(orgPatientsSelect); err != nil {
+		return
+	}
+	if o.getGrants, err = db.Preparex(orgGrantsSelect); err != nil {
+		return
+	}
+	return
+}
+
+// Adds the organization and its first admin in one transaction, so there is never an organization nobody can manage
+func (o *orgRepo) AddOrg(org *api.Org, uid int64) error {
+	tx, err := o.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(orgInsert, org.Name, org.Created, org.ShareCode)
+	if err != nil {
+		return err
+	}
+	if org.Oid, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(orgMemberInsert, org.Oid, uid, api.OrgRoleAdmin, org.Created); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns api.ErrNoOrg if there is no organization with this oid
+func (o *orgRepo) GetOrg(oid int64) (org api.Org, err error) {
+	var orgs []api.Org
+	if err = o.get.Select(&orgs, oid); err != nil {
+		return
+	}
+	if len(orgs) == 0 {
+		err = api.ErrNoOrg
+		return
+	}
+	org = orgs[0]
+	return
+}
+
+func (o *orgRepo) GetOrgs(uid int64) (orgs []api.OrgMembership, err error) {
+	err = o.getForUser.Select(&orgs, uid)
+	return
+}
+
+func (o *orgRepo) GetMembers(oid int64) (members []api.OrgMember, err error) {
+	err = o.getMembers.Select(&members, oid)
+	return
+}
+
+func (o *orgRepo) GetMemberRole(oid, uid int64) (string, error) {
+	var roles []string
+	if err := o.getMemberRole.Select(&roles, oid, uid); err != nil || len(roles) == 0 {
+		return "", err
+	}
+	return roles[0], nil
+}
+
+// Returns api.ErrMemberExists if uid is already a member, whatever their role
+func (o *orgRepo) AddMember(oid, uid int64, role string) error {
+	result, err := o.addMember.Exec(oid, uid, role, time.Now())
+	if err != nil {
+		return err
+	}
+	numRows, err := result.RowsAffected()
+	if err == nil && numRows == 0 {
+		err = api.ErrMemberExists
+	}
+	return err
+}
+
+func (o *orgRepo) SetMemberRole(oid, uid int64, role string) (bool, error) {
+	result, err := o.updateMember.Exec(oid, uid, role)
+	if err != nil {
+		return false, err
+	}
+	return o.memberChanged(oid, uid, result)
+}
+
+func (o *orgRepo) RemoveMember(oid, uid int64) (bool, error) {
+	result, err := o.deleteMember.Exec(oid, uid)
+	if err != nil {
+		return false, err
+	}
+	return o.memberChanged(oid, uid, result)
+}
+
+// returns whether uid was a member, and api.ErrLastAdmin if they were but nothing changed
+func (o *orgRepo) memberChanged(oid, uid int64, result sql.Result) (bool, error) {
+	numRows, err := result.RowsAffected()
+	if err != nil || numRows == 1 {
+		return numRows == 1, err
+	}
+	role, err := o.GetMemberRole(oid, uid)
+	if err != nil || role == "" {
+		return false, err
+	}
+	return true, api.ErrLastAdmin
+}
+
+func (o *orgRepo) ShareWithOrg(oid, uid int64, grant api.Grant) error {
+	_, err := o.share.Exec(oid, uid, time.Now(), grant.Scopes, grant.DataFrom, grant.DataTo, grant.EndsAt)
+	return err
+}
+
+func (o *orgRepo) UnshareWithOrg(oid, uid int64) (bool, error) {
+	result, err := o.unshare.Exec(oid, uid)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
+
+func (o *orgRepo) GetOrgShares(uid int64) (shares []api.OrgShare, err error) {
+	err = o.getShares.Select(&shares, uid)
+	return
+}
+
+func (o *orgRepo) GetOrgPatients(oid int64) (patients []api.LinkedUser, err error) {
+	err = o.getPatients.Select(&patients, oid, time.Now())
+	return
+}
+
+func (o *orgRepo) GetOrgGrants(owner, viewer int64) (grants []api.Grant, err error) {
+	err = o.getGrants.Select(&grants, owner, viewer, time.Now())
+	return
+}
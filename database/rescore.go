@@ -0,0 +1,188 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"time"
+)
+
+const (
+	rescoreJobsCreate = `create table if not exists rescore_jobs(
+		jid INTEGER PRIMARY KEY AUTOINCREMENT,
+		algorithm TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created DATETIME NOT NULL,
+		updated DATETIME NOT NULL,
+		maxtid INTEGER NOT NULL,
+		lasttid INTEGER NOT NULL,
+		total INTEGER NOT NULL,
+		rescored INTEGER NOT NULL,
+		skipped INTEGER NOT NULL,
+		error TEXT
+	)`
+	// scores from the scoring package, beside the original ones in tremors
+	tremorScoresCreate = `create table if not exists tremor_scores(
+		tid INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		algorithm TEXT NOT NULL,
+		resting INTEGER NOT NULL,
+		postural INTEGER NOT NULL,
+		scored DATETIME NOT NULL,
+		PRIMARY KEY (tid, algorithm)
+	)`
+	rescoreJobInsert = `insert into rescore_jobs(algorithm, status, created, updated, maxtid, lasttid, total, rescored,
+		skipped, error) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	rescoreJobUpdate = `update rescore_jobs set status = ?, updated = ?, lasttid = ?, rescored = ?, skipped = ?, error = ?
+		where jid = ?`
+	rescoreJobSelect        = "select * from rescore_jobs where jid = ?"
+	rescoreJobSelectAll     = "select * from rescore_jobs order by jid desc"
+	rescoreJobSelectRunning = "select * from rescore_jobs where status = '" + api.JobRunning + "' order by jid"
+	sampledRangeSelect      = "select coalesce(max(tid), 0) as maxtid, count(*) as count from tremor_samples"
+	sampledSelectNext       = "select tid from tremor_samples where tid > ? and tid <= ? order by tid limit ?"
+	// the uid comes from the samples, so scores of a deleted user's tremor are never saved. where true
+	// tells sqlite the on conflict isn't part of a join
+	tremorScoreUpsert = `insert into tremor_scores(tid, uid, algorithm, resting, postural, scored)
+		select tid, uid, ?2, ?3, ?4, ?5 from tremor_samples where tid = ?1 and true
+		on conflict(tid, algorithm) do update set resting = excluded.resting, postural = excluded.postural,
+		scored = excluded.scored`
+	rescoreResultsSelect = `select t.tid, t.uid, t.date, t.algorithm as originalalgorithm,
+		t.resting as originalresting, t.postural as originalpostural, s.resting, s.postural, s.scored
+		from tremor_scores s join tremors t on t.tid = s.tid
+		where s.algorithm = ?1 and s.tid > ?2 order by s.tid limit ?3`
+)
+
+type rescoreResultRow struct {
+	Tid               int64
+	Uid               int64
+	Date              time.Time
+	OriginalAlgorithm *string
+	OriginalResting   int
+	OriginalPostural  int
+	Resting           int
+	Postural          int
+	Scored            time.Time
+}
+
+func (row rescoreResultRow) result(algorithm string) api.RescoreResult {
+	return api.RescoreResult{
+		TID:      row.Tid,
+		UID:      row.Uid,
+		Date:     row.Date,
+		Original: api.Scores{Algorithm: row.OriginalAlgorithm, Resting: row.OriginalResting, Postural: row.OriginalPostural},
+		Rescored: api.Scores{Algorithm: &algorithm, Resting: row.Resting, Postural: row.Postural},
+		Scored:   row.Scored,
+	}
+}
+
+type rescoreRepo struct {
+	addJob         *sqlx.Stmt
+	updateJob      *sqlx.Stmt
+	getJob         *sqlx.Stmt
+	getJobs        *sqlx.Stmt
+	getRunningJobs *sqlx.Stmt
+	sampledRange   *sqlx.Stmt
+	nextSampled    *sqlx.Stmt
+	saveRescore    *sqlx.Stmt
+	getResults     *sqlx.Stmt
+}
+
+func NewRescoreRepo(db *sqlx.DB) (r *rescoreRepo, err error) {
+	for _, create := range []string{rescoreJobsCreate, tremorScoresCreate} {
+		if _, err = db.Exec(create); err != nil {
+			return
+		}
+	}
+	r = new(rescoreRepo)
+	if r.addJob, err = db.Preparex(rescoreJobInsert); err != nil {
+		return
+	}
+	if r.updateJob, err = db.Preparex(rescoreJobUpdate); err != nil {
+		return
+	}
+	if r.getJob, err = db.Preparex(rescoreJobSelect); err != nil {
+		return
+	}
+	if r.getJobs, err = db.Preparex(rescoreJobSelectAll); err != nil {
+		return
+	}
+	if r.getRunningJobs, err = db.Preparex(rescoreJobSelectRunning); err != nil {
+		return
+	}
+	if r.sampledRange, err = db.Preparex(sampledRangeSelect); err != nil {
+		return
+	}
+	if r.nextSampled, err = db.Preparex(sampledSelectNext); err != nil {
+		return
+	}
+	if r.saveRescore, err = db.Preparex(tremorScoreUpsert); err != nil {
+		return
+	}
+	if r.getResults, err = db.Preparex(rescoreResultsSelect); err != nil {
+		return
+	}
+	return
+}
+
+func (r *rescoreRepo) AddJob(job *api.RescoreJob) error {
+	result, err := r.addJob.Exec(job.Algorithm, job.Status, job.Created, job.Updated, job.MaxTid, job.LastTid,
+		job.Total, job.Rescored, job.Skipped, job.Error)
+	if err != nil {
+		return err
+	}
+	job.Jid, err = result.LastInsertId()
+	return err
+}
+
+func (r *rescoreRepo) UpdateJob(job *api.RescoreJob) error {
+	_, err := r.updateJob.Exec(job.Status, job.Updated, job.LastTid, job.Rescored, job.Skipped, job.Error, job.Jid)
+	return err
+}
+
+func (r *rescoreRepo) GetJob(jid int64) (job api.RescoreJob, err error) {
+	var jobs []api.RescoreJob
+	if err = r.getJob.Select(&jobs, jid); err != nil {
+		return
+	}
+	if len(jobs) == 0 {
+		err = api.ErrNoJob
+		return
+	}
+	job = jobs[0]
+	return
+}
+
+func (r *rescoreRepo) GetJobs() (jobs []api.RescoreJob, err error) {
+	err = r.getJobs.Select(&jobs)
+	return
+}
+
+func (r *rescoreRepo) GetRunningJobs() (jobs []api.RescoreJob, err error) {
+	err = r.getRunningJobs.Select(&jobs)
+	return
+}
+
+func (r *rescoreRepo) SampledRange() (maxTid int64, count int, err error) {
+	err = r.sampledRange.QueryRow().Scan(&maxTid, &count)
+	return
+}
+
+func (r *rescoreRepo) NextSampled(after, until int64, limit int) (tids []int64, err error) {
+	err = r.nextSampled.Select(&tids, after, until, limit)
+	return
+}
+
+func (r *rescoreRepo) SaveRescore(tid int64, algorithm string, resting, postural int) error {
+	_, err := r.saveRescore.Exec(tid, algorithm, resting, postural, time.Now())
+	return err
+}
+
+func (r *rescoreRepo) GetResults(algorithm string, after int64, limit int) (results []api.RescoreResult, err error) {
+	var rows []rescoreResultRow
+	if err = r.getResults.Select(&rows, algorithm, after, limit); err != nil {
+		return
+	}
+	for _, row := range rows {
+		results = append(results, row.result(algorithm))
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"math"
+	"time"
+)
+
+const (
+	samplesCreate = `create table if not exists tremor_samples(
+		tid INTEGER PRIMARY KEY,
+		uid INTEGER NOT NULL,
+		rate REAL NOT NULL,
+		count INTEGER NOT NULL,
+		accel BLOB NOT NULL,
+		gyro BLOB,
+		created DATETIME NOT NULL,
+		posturalfrom INTEGER
+	)`
+	samplesInsert = `insert or ignore into tremor_samples(tid, uid, rate, count, accel, gyro, created, posturalfrom)
+		values(?, ?, ?, ?, ?, ?, ?, ?)`
+	samplesSelect = "select rate, count, accel, gyro, posturalfrom from tremor_samples where tid = ?"
+
+	// the first byte of every blob, so the encoding can change later
+	sampleFormat = 1
+)
+
+type sampleRow struct {
+	Rate         float64
+	Count        int
+	Accel        []byte
+	Gyro         []byte
+	PosturalFrom *int
+}
+
+type sampleRepo struct {
+	add *sqlx.Stmt
+	get *sqlx.Stmt
+}
+
+func NewSampleRepo(db *sqlx.DB) (s *sampleRepo, err error) {
+	if _, err = db.Exec(samplesCreate); err != nil {
+		return
+	}
+	if err = addColumn(db, "tremor_samples", "posturalfrom", "INTEGER"); err != nil {
+		return
+	}
+	s = new(sampleRepo)
+	if s.add, err = db.Preparex(samplesInsert); err != nil {
+		return
+	}
+	if s.get, err = db.Preparex(samplesSelect); err != nil {
+		return
+	}
+	return
+}
+
+// returns the arguments of samplesInsert
+func sampleArgs(uid, tid int64, samples *api.Samples) []interface{} {
+	var gyro []byte
+	if len(samples.Gyro) > 0 {
+		gyro = encodeSamples(samples.Gyro)
+	}
+	return []interface{}{tid, uid, samples.Rate, len(samples.Accel), encodeSamples(samples.Accel), gyro, time.Now(),
+		samples.PosturalFrom}
+}
+
+func (s *sampleRepo) AddSamples(uid, tid int64, samples *api.Samples) error {
+	result, err := s.add.Exec(sampleArgs(uid, tid, samples)...)
+	if err != nil {
+		return err
+	}
+	numRows, err := result.RowsAffected()
+	if err == nil && numRows == 0 {
+		err = api.ErrSamplesExist
+	}
+	return err
+}
+
+func (s *sampleRepo) GetSamples(tid int64) (samples api.Samples, err error) {
+	var rows []sampleRow
+	if err = s.get.Select(&rows, tid); err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		err = api.ErrNoSamples
+		return
+	}
+	samples.Rate, samples.PosturalFrom = rows[0].Rate, rows[0].PosturalFrom
+	if samples.Accel, err = decodeSamples(rows[0].Accel, rows[0].Count); err != nil {
+		return
+	}
+	if rows[0].Gyro != nil {
+		samples.Gyro, err = decodeSamples(rows[0].Gyro, rows[0].Count)
+	}
+	return
+}
+
+// Samples are stored in thousandths, one axis after another, as varints of the difference from the sample
+// before. Readings change little from one sample to the next, so most take a byte or two instead of eight.
+func encodeSamples(samples [][3]float64) []byte {
+	blob := make([]byte, 1, 1+len(samples)*3*2)
+	blob[0] = sampleFormat
+	var varint [binary.MaxVarintLen64]byte
+	for axis := 0; axis < 3; axis++ {
+		var previous int64
+		for _, sample := range samples {
+			value := int64(math.Round(sample[axis] * 1000))
+			n := binary.PutVarint(varint[:], value-previous)
+			blob = append(blob, varint[:n]...)
+			previous = value
+		}
+	}
+	return blob
+}
+
+func decodeSamples(blob []byte, count int) ([][3]float64, error) {
+	if len(blob) == 0 || blob[0] != sampleFormat {
+		return nil, errors.New("unknown sample format")
+	}
+	reader := bytes.NewReader(blob[1:])
+	samples := make([][3]float64, count)
+	for axis := 0; axis < 3; axis++ {
+		var value int64
+		for i := range samples {
+			delta, err := binary.ReadVarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			value += delta
+			samples[i][axis] = float64(value) / 1000
+		}
+	}
+	return samples, nil
+}
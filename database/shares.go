@@ -0,0 +1,91 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"time"
+)
+
+const (
+	sharesCreate = `create table if not exists shares(
+		sid INTEGER PRIMARY KEY AUTOINCREMENT,
+		uid INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		datafrom DATETIME,
+		datato DATETIME,
+		endsat DATETIME NOT NULL,
+		created DATETIME NOT NULL
+	)`
+	shareInsert = `insert into shares(uid, name, scopes, datafrom, datato, endsat, created)
+		values(?, ?, ?, ?, ?, ?, ?)`
+	sharesSelect = `select sid, uid, name, scopes, datafrom, datato, endsat, created from shares
+		where uid = ? and datetime(endsat) > datetime(?) order by sid`
+	shareSelect = "select sid, uid, name, scopes, datafrom, datato, endsat, created from shares where sid = ?"
+	shareDelete = "delete from shares where uid = ? and sid = ?"
+)
+
+type shareRepo struct {
+	add    *sqlx.Stmt
+	getAll *sqlx.Stmt
+	get    *sqlx.Stmt
+	delete *sqlx.Stmt
+}
+
+func NewShareRepo(db *sqlx.DB) (s *shareRepo, err error) {
+	if _, err = db.Exec(sharesCreate); err != nil {
+		return
+	}
+	s = new(shareRepo)
+	if s.add, err = db.Preparex(shareInsert); err != nil {
+		return
+	}
+	if s.getAll, err = db.Preparex(sharesSelect); err != nil {
+		return
+	}
+	if s.get, err = db.Preparex(shareSelect); err != nil {
+		return
+	}
+	if s.delete, err = db.Preparex(shareDelete); err != nil {
+		return
+	}
+	return
+}
+
+func (s *shareRepo) AddShare(share *api.Share) error {
+	result, err := s.add.Exec(share.Uid, share.Name, share.Scopes, share.DataFrom, share.DataTo, share.EndsAt,
+		share.Created)
+	if err != nil {
+		return err
+	}
+	share.Sid, err = result.LastInsertId()
+	return err
+}
+
+func (s *shareRepo) GetShares(uid int64) (shares []api.Share, err error) {
+	err = s.getAll.Select(&shares, uid, time.Now())
+	return
+}
+
+// Returns api.ErrNoShare if there is no share with this sid
+func (s *shareRepo) GetShare(sid int64) (share api.Share, err error) {
+	var shares []api.Share
+	if err = s.get.Select(&shares, sid); err != nil {
+		return
+	}
+	if len(shares) == 0 {
+		err = api.ErrNoShare
+		return
+	}
+	share = shares[0]
+	return
+}
+
+func (s *shareRepo) DeleteShare(uid, sid int64) (bool, error) {
+	result, err := s.delete.Exec(uid, sid)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/nklaassen/tremr-web/api"
+	"time"
+)
+
+const (
+	refreshTokensCreate = `create table if not exists refresh_tokens(
+		hash TEXT PRIMARY KEY,
+		family TEXT NOT NULL,
+		uid INTEGER NOT NULL,
+		expires DATETIME NOT NULL,
+		used BOOL NOT NULL DEFAULT 0,
+		revoked BOOL NOT NULL DEFAULT 0
+	)`
+	// every authenticated request checks its family is still active
+	refreshTokensFamilyIndex = "create index if not exists refresh_tokens_family on refresh_tokens(family)"
+	refreshTokenInsert       = "insert into refresh_tokens(hash, family, uid, expires) values(?, ?, ?, ?)"
+	refreshTokenSelect       = "select hash, family, uid, expires, used, revoked from refresh_tokens where hash = ?"
+	refreshTokenUse          = `update refresh_tokens set used = 1
+		where hash = ? and used = 0 and revoked = 0 and datetime(expires) > datetime(?)`
+	refreshTokenRevokeFamily = "update refresh_tokens set revoked = 1 where family = ?"
+	refreshTokenFamilyActive = "select count(*) from refresh_tokens where family = ? and revoked = 0"
+	refreshTokenRevokeUser   = "update refresh_tokens set revoked = 1 where uid = ? and family != ?"
+	// expired tokens can't be used, and access tokens of their family have long expired too
+	refreshTokenPrune = "delete from refresh_tokens where datetime(expires) <= datetime(?)"
+
+	userTokensCreate = `create table if not exists user_tokens(
+		hash TEXT PRIMARY KEY,
+		uid INTEGER NOT NULL,
+		purpose TEXT NOT NULL,
+		expires DATETIME NOT NULL,
+		used BOOL NOT NULL DEFAULT 0
+	)`
+	userTokenInsert = "insert into user_tokens(hash, uid, purpose, expires) values(?, ?, ?, ?)"
+	userTokenUse    = `update user_tokens set used = 1
+		where hash = ? and purpose = ? and used = 0 and datetime(expires) > datetime(?)`
+	userTokenSelectUid = "select uid from user_tokens where hash = ?"
+)
+
+type refreshTokenRow struct {
+	Hash    string
+	Family  string
+	Uid     int64
+	Expires time.Time
+	Used    bool
+	Revoked bool
+}
+
+type tokenRepo struct {
+	add          *sqlx.Stmt
+	get          *sqlx.Stmt
+	use          *sqlx.Stmt
+	revokeFamily *sqlx.Stmt
+	familyActive *sqlx.Stmt
+	revokeUser   *sqlx.Stmt
+	prune        *sqlx.Stmt
+
+	addUserToken *sqlx.Stmt
+	useUserToken *sqlx.Stmt
+	getUserToken *sqlx.Stmt
+}
+
+func NewTokenRepo(db *sqlx.DB) (t *tokenRepo, err error) {
+	if _, err = db.Exec(refreshTokensCreate); err != nil {
+		return
+	}
+	if _, err = db.Exec(refreshTokensFamilyIndex); err != nil {
+		return
+	}
+	t = new(tokenRepo)
+	if t.add, err = db.Preparex(refreshTokenInsert); err != nil {
+		return
+	}
+	if t.get, err = db.Preparex(refreshTokenSelect); err != nil {
+		return
+	}
+	if t.use, err = db.Preparex(refreshTokenUse); err != nil {
+		return
+	}
+	if t.revokeFamily, err = db.Preparex(refreshTokenRevokeFamily); err != nil {
+		return
+	}
+	if t.familyActive, err = db.Preparex(refreshTokenFamilyActive); err != nil {
+		return
+	}
+	if t.revokeUser, err = db.Preparex(refreshTokenRevokeUser); err != nil {
+		return
+	}
+	if t.prune, err = db.Preparex(refreshTokenPrune); err != nil {
+		return
+	}
+
+	if _, err = db.Exec(userTokensCreate); err != nil {
+		return
+	}
+	if t.addUserToken, err = db.Preparex(userTokenInsert); err != nil {
+		return
+	}
+	if t.useUserToken, err = db.Preparex(userTokenUse); err != nil {
+		return
+	}
+	if t.getUserToken, err = db.Preparex(userTokenSelectUid); err != nil {
+		return
+	}
+	return
+}
+
+func (t *tokenRepo) AddRefreshToken(token *api.RefreshToken) error {
+	_, err := t.add.Exec(token.Hash, token.Family, token.Uid, token.Expires)
+	return err
+}
+
+// Marks the refresh token as used so it can never be exchanged again, and returns it.
+// If the token was already used or revoked, it is returned along with api.ErrRefreshTokenReused.
+// Expired tokens are deleted first, so the table doesn't grow forever.
+func (t *tokenRepo) UseRefreshToken(hash string) (token api.RefreshToken, err error) {
+	now := time.Now()
+	if _, err = t.prune.Exec(now); err != nil {
+		return
+	}
+	result, err := t.use.Exec(hash, now)
+	if err != nil {
+		return
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	var rows []refreshTokenRow
+	if err = t.get.Select(&rows, hash); err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		err = api.ErrInvalidRefreshToken
+		return
+	}
+	row := rows[0]
+	token = api.RefreshToken{Hash: row.Hash, Family: row.Family, Uid: row.Uid, Expires: row.Expires}
+	switch {
+	case numRows == 1:
+		// we were the one to use it
+	case row.Used || row.Revoked:
+		err = api.ErrRefreshTokenReused
+	default:
+		// expired
+		err = api.ErrInvalidRefreshToken
+	}
+	return
+}
+
+func (t *tokenRepo) RevokeFamily(family string) error {
+	_, err := t.revokeFamily.Exec(family)
+	return err
+}
+
+func (t *tokenRepo) IsFamilyActive(family string) (bool, error) {
+	var count int
+	if err := t.familyActive.Get(&count, family); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Revokes every session of the user except the one with the given family, pass an empty family to revoke all
+func (t *tokenRepo) RevokeUser(uid int64, except string) error {
+	_, err := t.revokeUser.Exec(uid, except)
+	return err
+}
+
+func (t *tokenRepo) AddUserToken(uid int64, purpose, hash string, expires time.Time) error {
+	_, err := t.addUserToken.Exec(hash, uid, purpose, expires)
+	return err
+}
+
+// Marks the single-use token as used and returns the uid it was issued to.
+// Returns api.ErrInvalidUserToken if the token does not exist, is for another purpose, has expired or was already used.
+func (t *tokenRepo) UseUserToken(purpose, hash string) (uid int64, err error) {
+	result, err := t.useUserToken.Exec(hash, purpose, time.Now())
+	if err != nil {
+		return
+	}
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows != 1 {
+		err = api.ErrInvalidUserToken
+		return
+	}
+	err = t.getUserToken.Get(&uid, hash)
+	return
+}
@@ -1,8 +1,11 @@
 package database
 
 import (
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/nklaassen/tremr-web/api"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -12,19 +15,89 @@ const (
 		uid INTEGER NOT NULL,
 		postural INTEGER NOT NULL,
 		resting INTEGER NOT NULL,
-		date DATETIME NOT NULL
+		date DATETIME NOT NULL,
+		enteredby INTEGER,
+		algorithm TEXT,
+		hand TEXT,
+		device TEXT,
+		appversion TEXT,
+		aborted BOOL NOT NULL DEFAULT 0,
+		note TEXT,
+		tags TEXT NOT NULL DEFAULT ''
 	)`
-	tremorInsert      = "insert into tremors(uid, postural, resting, date) values(?, ?, ?, ?)"
-	tremorSelectBase  = "select * from tremors where uid = ?"
-	orderByDate       = " order by datetime(date)"
-	tremorSelectAll   = tremorSelectBase + orderByDate
-	tremorSelectSince = tremorSelectBase + " and datetime(date) > datetime(?)" + orderByDate
+	tremorInsert = `insert into tremors(uid, postural, resting, date, enteredby, algorithm, hand, device, appversion,
+		aborted, note, tags) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	tremorSelectBase = "select * from tremors where uid = ?"
+	orderByDate      = " order by datetime(date)"
+	tremorSelectAll  = tremorSelectBase + orderByDate
+	tremorSelect     = tremorSelectBase + " and tid = ?"
+	// tags are space separated, so padding them with spaces finds whole tags
+	tremorSelectSince = "select * from tremors where uid = ?1 and datetime(date) > datetime(?2)" +
+		" and (?3 = '' or hand = ?3) and (?4 = '' or instr(' ' || tags || ' ', ' ' || ?4 || ' ') > 0)" + orderByDate
+
+	// ?2 and ?3 are an optional window the tremors have to be in
+	tremorWindow = " and (?2 is null or datetime(date) >= datetime(?2)) and (?3 is null or datetime(date) <= datetime(?3))"
+	// ?4 and ?5 are an optional hand and tag the tremors must have, see api.TremorFilter
+	tremorMatch = " and (?4 = '' or hand = ?4) and (?5 = '' or instr(' ' || tags || ' ', ' ' || ?5 || ' ') > 0)"
+	// keyset pagination by date to the second and then tid, starting after ?6 and ?7 if they are set
+	tremorSelectPage = "select * from tremors where uid = ?1" + tremorWindow + tremorMatch +
+		" and (?6 is null or datetime(date) > datetime(?6) or (datetime(date) = datetime(?6) and tid > ?7))" +
+		" order by datetime(date), tid limit ?8"
+	tremorSelectWindow  = "select * from tremors where uid = ?1" + tremorWindow + tremorMatch + orderByDate
+	tremorsUidDateIndex = "create index if not exists tremors_uid_date on tremors(uid, datetime(date), tid)"
+	tremorDateRange     = "select min(datetime(date)), max(datetime(date)) from tremors where uid = ?"
+	// the local time of each tremor in the window, leaving out aborted tests. The offset from UTC is filled in
+	// by Aggregate, with a case for each part of the window if it changes, starting at ?6.
+	tremorLocal = "select datetime(date, %v) as local, resting, postural from tremors where uid = ?1 and not aborted" +
+		tremorWindow + tremorMatch
+	// statistics of the tremors in each bucket, with the buckets filled in by Aggregate. The standard
+	// deviation is the square root of the variance, which sqlite can't take. The median is the middle
+	// score, or the mean of the middle two when there are an even number.
+	tremorAggregate = `with scores as (select %v as start, resting, postural from (%v)),
+		ranked as (select start, resting, postural, count(*) over (partition by start) as n,
+			row_number() over (partition by start order by resting) as restingrank,
+			row_number() over (partition by start order by postural) as posturalrank from scores)
+		select start, count(*) as count,
+		avg(resting) as restingmean, min(resting) as restingmin, max(resting) as restingmax,
+		avg(resting * resting) - avg(resting) * avg(resting) as restingvariance,
+		avg(case when restingrank in ((n + 1) / 2, n / 2 + 1) then resting end) as restingmedian,
+		avg(postural) as posturalmean, min(postural) as posturalmin, max(postural) as posturalmax,
+		avg(postural * postural) - avg(postural) * avg(postural) as posturalvariance,
+		avg(case when posturalrank in ((n + 1) / 2, n / 2 + 1) then postural end) as posturalmedian
+		from ranked group by start order by start`
+	// the latest tremor of each user in their window with their averages since ?1, leaving out aborted tests.
+	// The windows are filled in by Summarize with a (uid, from, to) row for each user.
+	tremorSummarize = `with windows(uid, datafrom, datato) as (values %v),
+		shared as (select tremors.* from tremors join windows on tremors.uid = windows.uid
+			where not aborted and (datafrom is null or datetime(date) >= datetime(datafrom))
+			and (datato is null or datetime(date) <= datetime(datato))),
+		week as (select uid, avg(resting) as weekresting, avg(postural) as weekpostural from shared
+			where datetime(date) >= datetime(?1) group by uid),
+		latest as (select *, row_number() over (partition by uid order by datetime(date) desc, tid desc) as n
+			from shared)
+		select latest.*, week.weekresting, week.weekpostural from latest left join week on week.uid = latest.uid
+		where n = 1`
 )
 
+// users summarized by each query, so the number of parameters stays well below sqlite's limit
+const summarizeBatch = 500
+
+// the start of each bucket of local times, weeks start on Monday
+var bucketStarts = map[string]string{
+	api.BucketDay:   "date(local)",
+	api.BucketWeek:  "date(local, '-' || ((cast(strftime('%w', local) as integer) + 6) % 7) || ' days')",
+	api.BucketMonth: "strftime('%Y-%m-01', local)",
+}
+
 type tremorRepo struct {
+	db       *sqlx.DB
 	add      *sqlx.Stmt
 	getAll   *sqlx.Stmt
+	get      *sqlx.Stmt
 	getSince *sqlx.Stmt
+	getPage  *sqlx.Stmt
+	window   *sqlx.Stmt
+	dates    *sqlx.Stmt
 }
 
 func NewTremorRepo(db *sqlx.DB) (*tremorRepo, error) {
@@ -32,7 +105,27 @@ func NewTremorRepo(db *sqlx.DB) (*tremorRepo, error) {
 	if err != nil {
 		return nil, err
 	}
-	t := new(tremorRepo)
+	if err = addColumn(db, "tremors", "enteredby", "INTEGER"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "tremors", "algorithm", "TEXT"); err != nil {
+		return nil, err
+	}
+	for _, column := range []string{"hand", "device", "appversion", "note"} {
+		if err = addColumn(db, "tremors", column, "TEXT"); err != nil {
+			return nil, err
+		}
+	}
+	if err = addColumn(db, "tremors", "aborted", "BOOL NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "tremors", "tags", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(tremorsUidDateIndex); err != nil {
+		return nil, err
+	}
+	t := &tremorRepo{db: db}
 	t.add, err = db.Preparex(tremorInsert)
 	if err != nil {
 		return nil, err
@@ -41,19 +134,58 @@ func NewTremorRepo(db *sqlx.DB) (*tremorRepo, error) {
 	if err != nil {
 		return nil, err
 	}
+	t.get, err = db.Preparex(tremorSelect)
+	if err != nil {
+		return nil, err
+	}
 	t.getSince, err = db.Preparex(tremorSelectSince)
 	if err != nil {
 		return nil, err
 	}
+	t.getPage, err = db.Preparex(tremorSelectPage)
+	if err != nil {
+		return nil, err
+	}
+	t.window, err = db.Preparex(tremorSelectWindow)
+	if err != nil {
+		return nil, err
+	}
+	t.dates, err = db.Preparex(tremorDateRange)
+	if err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
-func (t *tremorRepo) Add(uid int64, tremor *api.Tremor) (err error) {
+func (t *tremorRepo) Add(uid int64, tremor *api.Tremor, samples *api.Samples) error {
 	if tremor.Date == (time.Time{}) {
 		tremor.Date = time.Now()
 	}
-	_, err = t.add.Exec(uid, tremor.Postural, tremor.Resting, tremor.Date)
-	return
+	tx, err := t.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Stmtx(t.add).Exec(uid, tremor.Postural, tremor.Resting, tremor.Date, tremor.EnteredBy,
+		tremor.Algorithm, tremor.Hand, tremor.Device, tremor.AppVersion, tremor.Aborted, tremor.Note, tremor.Tags)
+	if err != nil {
+		return err
+	}
+	tid, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if samples != nil {
+		if _, err := tx.Exec(samplesInsert, sampleArgs(uid, tid, samples)...); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	tremor.TID = tid
+	return nil
 }
 
 func (t *tremorRepo) GetAll(uid int64) (tremors []api.Tremor, err error) {
@@ -61,7 +193,183 @@ func (t *tremorRepo) GetAll(uid int64) (tremors []api.Tremor, err error) {
 	return
 }
 
-func (t *tremorRepo) GetSince(uid int64, timestamp time.Time) (tremors []api.Tremor, err error) {
-	err = t.getSince.Select(&tremors, uid, timestamp)
+func (t *tremorRepo) Get(uid, tid int64) (tremor api.Tremor, err error) {
+	var tremors []api.Tremor
+	if err = t.get.Select(&tremors, uid, tid); err != nil {
+		return
+	}
+	if len(tremors) == 0 {
+		err = api.ErrNoTremor
+		return
+	}
+	tremor = tremors[0]
+	return
+}
+
+func (t *tremorRepo) GetSince(uid int64, timestamp time.Time, filter api.TremorFilter) (tremors []api.Tremor,
+	err error) {
+	err = t.getSince.Select(&tremors, uid, timestamp, filter.Hand, filter.Tag)
+	return
+}
+
+func (t *tremorRepo) GetPage(uid int64, from, to *time.Time, filter api.TremorFilter, after *api.TremorCursor,
+	limit int) (tremors []api.Tremor, err error) {
+	var afterDate *time.Time
+	var afterTid int64
+	if after != nil {
+		afterDate, afterTid = &after.Date, after.TID
+	}
+	err = t.getPage.Select(&tremors, uid, from, to, filter.Hand, filter.Tag, afterDate, afterTid, limit)
+	return
+}
+
+// sqlite knows nothing about time zones, so the offset of loc from UTC through the window is worked out
+// here and handed to it, then the statistics of each bucket are computed in SQL. Medians too would take
+// a window function for each score, so they are worked out here from just the scores.
+func (t *tremorRepo) Aggregate(uid int64, from, to *time.Time, filter api.TremorFilter, bucket string,
+	loc *time.Location) (buckets []api.TremorBucket, err error) {
+	buckets = []api.TremorBucket{}
+	// the offsets only have to cover the tremors there are
+	var first, last *string
+	if err = t.dates.QueryRow(uid).Scan(&first, &last); err != nil || first == nil {
+		return
+	}
+	start, err := time.Parse(sqliteDateTime, *first)
+	if err != nil {
+		return
+	}
+	end, err := time.Parse(sqliteDateTime, *last)
+	if err != nil {
+		return
+	}
+	if from != nil && from.After(start) {
+		start = *from
+	}
+	if to != nil && to.Before(end) {
+		end = *to
+	}
+
+	// ?1 to ?5 are the same as for GetRange, and each change of offset after the first is another
+	args := []interface{}{uid, from, to, filter.Hand, filter.Tag}
+	changes, offsets := zoneOffsets(loc, start, end)
+	modifier := fmt.Sprintf("'%+d seconds'", offsets[len(offsets)-1])
+	if len(changes) > 0 {
+		cases := "case "
+		for i, change := range changes {
+			args = append(args, change)
+			cases += fmt.Sprintf("when datetime(date) < datetime(?%v) then '%+d seconds' ", 6+i, offsets[i])
+		}
+		modifier = cases + "else " + modifier + " end"
+	}
+	local := fmt.Sprintf(tremorLocal, modifier)
+
+	var rows []struct {
+		Start            string
+		Count            int
+		RestingMean      float64
+		RestingMin       float64
+		RestingMax       float64
+		RestingVariance  float64
+		RestingMedian    float64
+		PosturalMean     float64
+		PosturalMin      float64
+		PosturalMax      float64
+		PosturalVariance float64
+		PosturalMedian   float64
+	}
+	if err = t.db.Select(&rows, fmt.Sprintf(tremorAggregate, bucketStarts[bucket], local), args...); err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		day, err := time.Parse("2006-01-02", row.Start)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, api.TremorBucket{
+			Start: time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc),
+			Count: row.Count,
+			Resting: api.TremorStats{Mean: row.RestingMean, Median: row.RestingMedian,
+				Min: row.RestingMin, Max: row.RestingMax, StdDev: math.Sqrt(math.Max(row.RestingVariance, 0))},
+			Postural: api.TremorStats{Mean: row.PosturalMean, Median: row.PosturalMedian,
+				Min: row.PosturalMin, Max: row.PosturalMax, StdDev: math.Sqrt(math.Max(row.PosturalVariance, 0))},
+		})
+	}
+	return
+}
+
+// the format of sqlite's datetime(), which is always UTC
+const sqliteDateTime = "2006-01-02 15:04:05"
+
+// zoneOffsets returns loc's offsets from UTC in seconds from start to end, and the times at which each
+// after the first takes over, eg. when daylight saving time starts
+func zoneOffsets(loc *time.Location, start, end time.Time) (changes []time.Time, offsets []int) {
+	offset := func(t time.Time) int {
+		_, seconds := t.In(loc).Zone()
+		return seconds
+	}
+	offsets = []int{offset(start)}
+	// zones never change more than once a day, so look for changes a day at a time
+	for day := start; day.Before(end); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		if offset(next) == offsets[len(offsets)-1] {
+			continue
+		}
+		// then narrow down to the second it happened
+		before, after := day, next
+		for after.Sub(before) > time.Second {
+			middle := before.Add(after.Sub(before) / 2)
+			if offset(middle) == offsets[len(offsets)-1] {
+				before = middle
+			} else {
+				after = middle
+			}
+		}
+		after = after.Truncate(time.Second)
+		changes = append(changes, after)
+		offsets = append(offsets, offset(after))
+	}
+	return
+}
+
+func (t *tremorRepo) GetRange(uid int64, from, to *time.Time, filter api.TremorFilter) (tremors []api.Tremor,
+	err error) {
+	err = t.window.Select(&tremors, uid, from, to, filter.Hand, filter.Tag)
 	return
 }
+
+func (t *tremorRepo) Summarize(windows []api.SummaryWindow, weekStart time.Time) (map[int64]api.TremorSummary,
+	error) {
+	summaries := make(map[int64]api.TremorSummary)
+	for len(windows) > 0 {
+		batch := windows
+		if len(batch) > summarizeBatch {
+			batch = batch[:summarizeBatch]
+		}
+		windows = windows[len(batch):]
+
+		// the windows are numbered after weekStart, which is ?1
+		values := make([]string, len(batch))
+		args := []interface{}{weekStart}
+		for i, window := range batch {
+			n := 2 + 3*i
+			values[i] = fmt.Sprintf("(?%v, ?%v, ?%v)", n, n+1, n+2)
+			args = append(args, window.Uid, window.From, window.To)
+		}
+		var rows []struct {
+			api.Tremor
+			N            int
+			WeekResting  *float64
+			WeekPostural *float64
+		}
+		if err := t.db.Select(&rows, fmt.Sprintf(tremorSummarize, strings.Join(values, ", ")), args...); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			latest := row.Tremor
+			summaries[latest.UID] = api.TremorSummary{Latest: &latest, WeekResting: row.WeekResting,
+				WeekPostural: row.WeekPostural}
+		}
+	}
+	return summaries, nil
+}
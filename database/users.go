@@ -1,8 +1,13 @@
 package database
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/jmoiron/sqlx"
 	"github.com/nklaassen/tremr-web/api"
+	"strconv"
+	"time"
 )
 
 const (
@@ -10,31 +15,152 @@ const (
 		uid INTEGER PRIMARY KEY AUTOINCREMENT,
 		email TEXT UNIQUE NOT NULL,
 		password TEXT NOT NULL,
-		name TEXT NOT NULL
+		name TEXT NOT NULL,
+		verified BOOL NOT NULL DEFAULT 0,
+		failedlogins INTEGER NOT NULL DEFAULT 0,
+		lockeduntil DATETIME,
+		role TEXT NOT NULL DEFAULT 'patient'
 	)`
-	userInsert          = "insert into users(email, password, name) values(?1, ?2, ?3)"
+	// users are patients unless they say otherwise
+	userInsert = `insert into users(email, password, name, verified, role)
+		values(?1, ?2, ?3, 0, coalesce(nullif(?4, ''), 'patient'))`
 	userSelectFromUid   = "select * from users where uid = ?"
 	userSelectFromEmail = "select * from users where email = ?"
+	userUpdatePassword  = "update users set password = ? where uid = ?"
+	userSetVerified     = "update users set verified = 1 where uid = ?"
+	userSetRole         = "update users set role = ? where uid = ?"
+	userAddLoginFailure = "update users set failedlogins = failedlogins + 1 where uid = ?"
+	userSelectFailures  = "select failedlogins from users where uid = ?"
+	userSetLockedUntil  = "update users set lockeduntil = ? where uid = ?"
+	userClearFailures   = "update users set failedlogins = 0, lockeduntil = null where uid = ?"
+	userSelectEmail     = "select email from users where uid = ?"
+	// emails are stored as api.NormalizeEmail makes them. Older accounts are lowercased, unless another
+	// account already has the lowercase address, which keeps it.
+	usersNormalizeEmails = "update or ignore users set email = lower(email) where email != lower(email)"
 
+	// a record that an account existed and was deleted, without keeping any personal data.
+	// The email is hashed so we can still answer whether a given address had an account.
+	deletedUsersCreate = `create table if not exists deleted_users(
+		uid INTEGER PRIMARY KEY,
+		emailhash TEXT NOT NULL,
+		deleted DATETIME NOT NULL
+	)`
+	deletedUserInsert = "insert into deleted_users(uid, emailhash, deleted) values(?, ?, ?)"
+
+	// a link is an invitation from source to see their data, see api.Invitation.
+	// Links are identified by their rowid, what they share is described by api.Grant.
 	linksCreate = `create table if not exists links(
 		source INTEGER NOT NULL,
-		dest INTEGER NOT NULL
+		dest INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created DATETIME,
+		expires DATETIME,
+		accepted DATETIME,
+		responded DATETIME,
+		scopes TEXT NOT NULL DEFAULT 'tremors meds exercises profile',
+		datafrom DATETIME,
+		datato DATETIME,
+		endsat DATETIME,
+		canwrite BOOL NOT NULL DEFAULT 0
 	)`
-	linksInsert         = "insert into links(source, dest) values(?1, ?2)"
-	linksSelectIncoming = `select uid, email, name from users inner join links on
-		links.dest = ? and links.source = users.uid`
-	linksSelectOutgoing = `select uid, email, name from users inner join links on
-		links.source = ? and links.dest = users.uid`
+	linksInsert = `insert into links(source, dest, status, created, expires, scopes, datafrom, datato, endsat, canwrite)
+		values(?1, ?2, 'pending', ?3, ?4, ?5, ?6, ?7, ?8, ?9)`
+	// invitations can be sent again once they are declined, revoked, expired or ended
+	// declined links can be sent again once ?10 is past the time they were declined
+	linksReinvite = `update links set status = 'pending', created = ?3, expires = ?4, accepted = null,
+		responded = null, scopes = ?5, datafrom = ?6, datato = ?7, endsat = ?8, canwrite = ?9
+		where source = ?1 and dest = ?2 and (status = 'revoked' or
+		(status = 'declined' and (responded is null or datetime(responded) <= datetime(?10))) or
+		(status = 'pending' and datetime(expires) <= datetime(?3)) or
+		(status = 'accepted' and datetime(endsat) <= datetime(?3)))`
+	linksStatus = "select status from links where source = ? and dest = ?"
+	// only links which are accepted and haven't ended share anything
+	linksSelectIncoming = `select uid, email, name, links.rowid as lid, created, accepted,
+		scopes, datafrom, datato, endsat, canwrite from users
+		inner join links on links.dest = ?1 and links.source = users.uid and links.status = 'accepted'
+		and (endsat is null or datetime(endsat) > datetime(?2))`
+	linksSelectOutgoing = `select uid, email, name, links.rowid as lid, created, accepted,
+		scopes, datafrom, datato, endsat, canwrite from users
+		inner join links on links.source = ?1 and links.dest = users.uid and links.status = 'accepted'
+		and (endsat is null or datetime(endsat) > datetime(?2))`
+	linksSelectGrant = `select scopes, datafrom, datato, endsat, canwrite from links
+		where source = ?1 and dest = ?2 and status = 'accepted' and (endsat is null or datetime(endsat) > datetime(?3))`
+	linksUpdateGrant = `update links set scopes = ?3, datafrom = ?4, datato = ?5, endsat = ?6, canwrite = ?7
+		where source = ?1 and dest = ?2 and status in ('pending', 'accepted')`
+	linksDelete = "delete from links where source = ? and dest = ?"
+	// older versions allowed duplicate links, keep the accepted or else newest one of each
+	linksDedupe = `delete from links where rowid not in (
+		select (select l2.rowid from links l2 where l2.source = l1.source and l2.dest = l1.dest
+			order by l2.status = 'accepted' desc, l2.rowid desc limit 1)
+		from links l1 group by source, dest)`
+	linksUniqueIndex       = "create unique index if not exists links_source_dest on links(source, dest)"
+	linksSelectInvitations = `select links.rowid as lid, source, dest, email, name, created, expires,
+		scopes, datafrom, datato, endsat, canwrite,
+		case when status = 'pending' and datetime(expires) <= datetime(?2) then 'expired'
+			when status = 'accepted' and datetime(endsat) <= datetime(?2) then 'ended'
+			else status end as status
+		from links inner join users on
+		users.uid = case when links.source = ?1 then links.dest else links.source end
+		where links.source = ?1 or links.dest = ?1
+		order by links.rowid desc`
+	linksRespond = `update links set status = ?3, accepted = case when ?3 = 'accepted' then ?4 end, responded = ?4
+		where rowid = ?1 and dest = ?2 and status = 'pending' and datetime(expires) > datetime(?4)`
+	linksRevoke = "update links set status = 'revoked' where rowid = ? and source = ? and status = 'pending'"
 )
 
+// every row owned by a user, deleted along with their account. Records they entered for other users
+// belong to those users, so they are kept without saying who entered them.
+var userDataDeletes = []string{
+	"delete from tremors where uid = ?1",
+	"delete from medicines where uid = ?1",
+	"delete from exercises where uid = ?1",
+	"delete from tremor_samples where uid = ?1",
+	"delete from tremor_scores where uid = ?1",
+	"update tremors set enteredby = null where enteredby = ?1",
+	"update medicines set enteredby = null where enteredby = ?1",
+	"update exercises set enteredby = null where enteredby = ?1",
+	"delete from links where source = ?1 or dest = ?1",
+	"delete from refresh_tokens where uid = ?1",
+	"delete from user_tokens where uid = ?1",
+	"delete from mfa where uid = ?1",
+	"delete from recovery_codes where uid = ?1",
+	"delete from api_keys where uid = ?1",
+	"delete from identities where uid = ?1",
+	"delete from shares where uid = ?1",
+	// organizations nobody else is a member of go too, there is nobody left to manage them
+	"delete from org_shares where oid in (select oid from org_members where uid = ?1) and " +
+		"oid not in (select oid from org_members where uid != ?1)",
+	"delete from orgs where oid in (select oid from org_members where uid = ?1) and " +
+		"oid not in (select oid from org_members where uid != ?1)",
+	"delete from org_members where uid = ?1",
+	"delete from org_shares where uid = ?1",
+	"delete from users where uid = ?1",
+}
+
 type userRepo struct {
-	add          *sqlx.Stmt
-	getFromUid   *sqlx.Stmt
-	getFromEmail *sqlx.Stmt
+	db             *sqlx.DB
+	add            *sqlx.Stmt
+	getFromUid     *sqlx.Stmt
+	getFromEmail   *sqlx.Stmt
+	updatePassword *sqlx.Stmt
+	setVerified    *sqlx.Stmt
+	setRole        *sqlx.Stmt
+	addFailure     *sqlx.Stmt
+	getFailures    *sqlx.Stmt
+	setLockedUntil *sqlx.Stmt
+	clearFailures  *sqlx.Stmt
 
-	addLink         *sqlx.Stmt
+	addLink          *sqlx.Stmt
+	reinvite         *sqlx.Stmt
+	linkStatus       *sqlx.Stmt
 	getIncomingLinks *sqlx.Stmt
 	getOutgoingLinks *sqlx.Stmt
+	getGrant         *sqlx.Stmt
+	updateGrant      *sqlx.Stmt
+	getInvitations   *sqlx.Stmt
+	respondToInvite  *sqlx.Stmt
+	revokeInvite     *sqlx.Stmt
+	deleteLink       *sqlx.Stmt
 }
 
 func NewUserRepo(db *sqlx.DB) (*userRepo, error) {
@@ -42,7 +168,26 @@ func NewUserRepo(db *sqlx.DB) (*userRepo, error) {
 	if err != nil {
 		return nil, err
 	}
-	u := new(userRepo)
+	// users who signed up before email verification existed are trusted
+	if err = addColumn(db, "users", "verified", "BOOL NOT NULL DEFAULT 1"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "users", "failedlogins", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "users", "lockeduntil", "DATETIME"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "users", "role", "TEXT NOT NULL DEFAULT 'patient'"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(usersNormalizeEmails); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(deletedUsersCreate); err != nil {
+		return nil, err
+	}
+	u := &userRepo{db: db}
 	u.add, err = db.Preparex(userInsert)
 	if err != nil {
 		return nil, err
@@ -55,15 +200,85 @@ func NewUserRepo(db *sqlx.DB) (*userRepo, error) {
 	if err != nil {
 		return nil, err
 	}
+	u.updatePassword, err = db.Preparex(userUpdatePassword)
+	if err != nil {
+		return nil, err
+	}
+	u.setVerified, err = db.Preparex(userSetVerified)
+	if err != nil {
+		return nil, err
+	}
+	u.setRole, err = db.Preparex(userSetRole)
+	if err != nil {
+		return nil, err
+	}
+	u.addFailure, err = db.Preparex(userAddLoginFailure)
+	if err != nil {
+		return nil, err
+	}
+	u.getFailures, err = db.Preparex(userSelectFailures)
+	if err != nil {
+		return nil, err
+	}
+	u.setLockedUntil, err = db.Preparex(userSetLockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	u.clearFailures, err = db.Preparex(userClearFailures)
+	if err != nil {
+		return nil, err
+	}
 
 	_, err = db.Exec(linksCreate)
 	if err != nil {
 		return nil, err
 	}
+	// links made before invitations existed were never consented to, but were working shares
+	if err = addColumn(db, "links", "status", "TEXT NOT NULL DEFAULT 'accepted'"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "links", "created", "DATETIME"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "links", "expires", "DATETIME"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "links", "accepted", "DATETIME"); err != nil {
+		return nil, err
+	}
+	if err = addColumn(db, "links", "responded", "DATETIME"); err != nil {
+		return nil, err
+	}
+	// links made before scopes existed shared everything
+	if err = addColumn(db, "links", "scopes", "TEXT NOT NULL DEFAULT 'tremors meds exercises profile'"); err != nil {
+		return nil, err
+	}
+	for _, column := range []string{"datafrom", "datato", "endsat"} {
+		if err = addColumn(db, "links", column, "DATETIME"); err != nil {
+			return nil, err
+		}
+	}
+	if err = addColumn(db, "links", "canwrite", "BOOL NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(linksDedupe); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(linksUniqueIndex); err != nil {
+		return nil, err
+	}
 	u.addLink, err = db.Preparex(linksInsert)
 	if err != nil {
 		return nil, err
 	}
+	u.reinvite, err = db.Preparex(linksReinvite)
+	if err != nil {
+		return nil, err
+	}
+	u.linkStatus, err = db.Preparex(linksStatus)
+	if err != nil {
+		return nil, err
+	}
 	u.getIncomingLinks, err = db.Preparex(linksSelectIncoming)
 	if err != nil {
 		return nil, err
@@ -72,17 +287,43 @@ func NewUserRepo(db *sqlx.DB) (*userRepo, error) {
 	if err != nil {
 		return nil, err
 	}
+	u.getGrant, err = db.Preparex(linksSelectGrant)
+	if err != nil {
+		return nil, err
+	}
+	u.updateGrant, err = db.Preparex(linksUpdateGrant)
+	if err != nil {
+		return nil, err
+	}
+	u.getInvitations, err = db.Preparex(linksSelectInvitations)
+	if err != nil {
+		return nil, err
+	}
+	u.respondToInvite, err = db.Preparex(linksRespond)
+	if err != nil {
+		return nil, err
+	}
+	u.revokeInvite, err = db.Preparex(linksRevoke)
+	if err != nil {
+		return nil, err
+	}
+	u.deleteLink, err = db.Preparex(linksDelete)
+	if err != nil {
+		return nil, err
+	}
 
 	return u, nil
 }
 
 func (u *userRepo) Add(user *api.User) error {
-	_, err := u.add.Exec(user.Email, user.Password, user.Name)
+	user.Email = api.NormalizeEmail(user.Email)
+	result, err := u.add.Exec(user.Email, user.Password, user.Name, user.Role)
 	if err != nil {
 		// a user with the same email already exists
 		return api.ErrUserExists(err)
 	}
-	return nil
+	user.Uid, err = result.LastInsertId()
+	return err
 }
 
 func (u *userRepo) GetFromUid(uid int64) (user api.User, err error) {
@@ -91,35 +332,176 @@ func (u *userRepo) GetFromUid(uid int64) (user api.User, err error) {
 	if err != nil {
 		return
 	}
+	if len(users) == 0 {
+		err = api.ErrUserDoesNotExist(errors.New("no user with uid " + strconv.FormatInt(uid, 10)))
+		return
+	}
 	user = users[0]
 	return
 }
 
 func (u *userRepo) GetFromEmail(email string) (user api.User, err error) {
 	var users []api.User
-	err = u.getFromEmail.Select(&users, email)
-	if len(users) == 0 {
-		err = api.ErrUserDoesNotExist(err)
+	err = u.getFromEmail.Select(&users, api.NormalizeEmail(email))
+	if err != nil {
 		return
 	}
-	if err != nil {
+	if len(users) == 0 {
+		err = api.ErrUserDoesNotExist(errors.New("no user with email " + email))
 		return
 	}
 	user = users[0]
 	return
 }
 
-func (u *userRepo) AddLink(from, to int64) error {
-	_, err := u.addLink.Exec(from, to)
+func (u *userRepo) UpdatePassword(uid int64, hash string) error {
+	_, err := u.updatePassword.Exec(hash, uid)
 	return err
 }
 
-func (u *userRepo) GetIncomingLinks(uid int64) (users []api.UserWithoutPassword, err error) {
-	err = u.getIncomingLinks.Select(&users, uid)
+func (u *userRepo) SetVerified(uid int64) error {
+	_, err := u.setVerified.Exec(uid)
+	return err
+}
+
+func (u *userRepo) SetRole(uid int64, role string) error {
+	_, err := u.setRole.Exec(role, uid)
+	return err
+}
+
+// Increments the number of failed signins in a row, and returns the new count
+func (u *userRepo) RecordLoginFailure(uid int64) (failures int, err error) {
+	if _, err = u.addFailure.Exec(uid); err != nil {
+		return
+	}
+	err = u.getFailures.Get(&failures, uid)
 	return
 }
 
-func (u *userRepo) GetOutgoingLinks(uid int64) (users []api.UserWithoutPassword, err error) {
-	err = u.getOutgoingLinks.Select(&users, uid)
+func (u *userRepo) SetLockedUntil(uid int64, until time.Time) error {
+	_, err := u.setLockedUntil.Exec(until, uid)
+	return err
+}
+
+func (u *userRepo) ClearLoginFailures(uid int64) error {
+	_, err := u.clearFailures.Exec(uid)
+	return err
+}
+
+// Deletes the user and all of their data in one transaction, leaving only a tombstone
+func (u *userRepo) Delete(uid int64) error {
+	tx, err := u.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email string
+	if err := tx.Get(&email, userSelectEmail, uid); err != nil {
+		return err
+	}
+	emailHash := sha256.Sum256([]byte(api.NormalizeEmail(email)))
+	if _, err := tx.Exec(deletedUserInsert, uid, hex.EncodeToString(emailHash[:]), time.Now()); err != nil {
+		return err
+	}
+	for _, query := range userDataDeletes {
+		if _, err := tx.Exec(query, uid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (u *userRepo) AddLink(from, to int64, expires time.Time, grant api.Grant) error {
+	now := time.Now()
+	result, err := u.reinvite.Exec(from, to, now, expires, grant.Scopes, grant.DataFrom, grant.DataTo, grant.EndsAt,
+		grant.CanWrite, now.Add(-api.DeclinedCooldown))
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows > 0 {
+		return err
+	}
+
+	// anything left is pending, accepted or recently declined
+	var statuses []string
+	if err := u.linkStatus.Select(&statuses, from, to); err != nil {
+		return err
+	}
+	if len(statuses) > 0 {
+		if statuses[0] == api.InvitationDeclined {
+			return api.ErrRecentlyDeclined
+		}
+		return api.ErrLinkExists
+	}
+	_, err = u.addLink.Exec(from, to, now, expires, grant.Scopes, grant.DataFrom, grant.DataTo, grant.EndsAt,
+		grant.CanWrite)
+	return err
+}
+
+func (u *userRepo) GetIncomingLinks(uid int64) (users []api.LinkedUser, err error) {
+	err = u.getIncomingLinks.Select(&users, uid, time.Now())
+	return
+}
+
+func (u *userRepo) GetOutgoingLinks(uid int64) (users []api.LinkedUser, err error) {
+	err = u.getOutgoingLinks.Select(&users, uid, time.Now())
+	return
+}
+
+func (u *userRepo) GetGrant(owner, viewer int64) (*api.Grant, error) {
+	var grants []api.Grant
+	if err := u.getGrant.Select(&grants, owner, viewer, time.Now()); err != nil {
+		return nil, err
+	}
+	if len(grants) == 0 {
+		return nil, nil
+	}
+	return &grants[0], nil
+}
+
+func (u *userRepo) UpdateGrant(from, to int64, grant api.Grant) (bool, error) {
+	result, err := u.updateGrant.Exec(from, to, grant.Scopes, grant.DataFrom, grant.DataTo, grant.EndsAt,
+		grant.CanWrite)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
+
+func (u *userRepo) GetInvitations(uid int64) (invitations []api.Invitation, err error) {
+	err = u.getInvitations.Select(&invitations, uid, time.Now())
 	return
 }
+
+func (u *userRepo) RespondToInvitation(lid, uid int64, accept bool) (bool, error) {
+	status := api.InvitationDeclined
+	if accept {
+		status = api.InvitationAccepted
+	}
+	result, err := u.respondToInvite.Exec(lid, uid, status, time.Now())
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
+
+func (u *userRepo) RevokeInvitation(lid, uid int64) (bool, error) {
+	result, err := u.revokeInvite.Exec(lid, uid)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows == 1, err
+}
+
+func (u *userRepo) DeleteLink(from, to int64) (bool, error) {
+	result, err := u.deleteLink.Exec(from, to)
+	if err != nil {
+		return false, err
+	}
+	numRows, err := result.RowsAffected()
+	return numRows > 0, err
+}
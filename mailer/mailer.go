@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nklaassen/tremr-web/api"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP sends mail through an SMTP server, eg. smtp.gmail.com:587
+type SMTP struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+var errHeaderNewline = errors.New("mail header contains a line break")
+
+// header returns value for use in a header, encoded if it isn't plain ASCII. Line breaks would
+// let a value add headers of its own, so they are an error.
+func header(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", errHeaderNewline
+	}
+	return mime.QEncoding.Encode("utf-8", value), nil
+}
+
+func (m *SMTP) Send(to, subject, body string) error {
+	// addresses are never encoded, servers wouldn't understand them
+	if strings.ContainsAny(m.From+to, "\r\n") {
+		return errHeaderNewline
+	}
+	subject, err := header(subject)
+	if err != nil {
+		return err
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// Log writes every message to W instead of sending it, for running locally
+type Log struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+func (m *Log) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.W, "To: %v\nSubject: %v\n\n%v\n\n", to, subject, body)
+	return err
+}
+
+// FromEnv returns the mailer configured by the environment:
+// if TREMR_SMTP_ADDR is set mail is sent through that server, authenticating with
+// TREMR_SMTP_USER and TREMR_SMTP_PASSWORD if they are set, from TREMR_MAIL_FROM.
+// Otherwise mail is appended to the file TREMR_MAIL_FILE, or written to stdout.
+func FromEnv() (api.Mailer, error) {
+	if addr := os.Getenv("TREMR_SMTP_ADDR"); addr != "" {
+		m := &SMTP{Addr: addr, From: os.Getenv("TREMR_MAIL_FROM")}
+		if m.From == "" {
+			return nil, errors.New("TREMR_MAIL_FROM must be set to send mail")
+		}
+		if user := os.Getenv("TREMR_SMTP_USER"); user != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			m.Auth = smtp.PlainAuth("", user, os.Getenv("TREMR_SMTP_PASSWORD"), host)
+		}
+		return m, nil
+	}
+	if path := os.Getenv("TREMR_MAIL_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &Log{W: f}, nil
+	}
+	log.Print("TREMR_SMTP_ADDR not set, writing mail to stdout")
+	return &Log{W: os.Stdout}, nil
+}
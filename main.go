@@ -8,11 +8,15 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nklaassen/tremr-web/api"
 	"github.com/nklaassen/tremr-web/database"
+	"github.com/nklaassen/tremr-web/mailer"
+	"github.com/nklaassen/tremr-web/ratelimit"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 )
 
 func serve(portNum string, reboot chan struct{}, shutdown chan struct{}) {
@@ -29,8 +33,60 @@ func serve(portNum string, reboot chan struct{}, shutdown chan struct{}) {
 		log.Fatal(err)
 	}
 
+	// Load jwt signing keys
+	keys, err := api.LoadKeyring()
+	if err != nil {
+		log.Fatal("Failed to load signing keys: ", err)
+	}
+
+	// Get mailer for sending emails to users
+	m, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatal("Failed to set up mailer: ", err)
+	}
+
+	// Only allow sharing with verified email addresses if TREMR_REQUIRE_VERIFIED_LINKS is set
+	var policy api.Policy
+	policy.RequireVerifiedLinks, _ = strconv.ParseBool(os.Getenv("TREMR_REQUIRE_VERIFIED_LINKS"))
+
+	// Limit each kind of unauthenticated request per client, and password guesses per account
+	perClient := func() *ratelimit.Limiter {
+		return ratelimit.New(ratelimit.NewMemoryStore(), 20, 3*time.Second)
+	}
+	limits := api.Limits{
+		Signup:  perClient(),
+		Signin:  perClient(),
+		MFA:     perClient(),
+		Reset:   perClient(),
+		OIDC:    perClient(),
+		Share:   perClient(),
+		Account: ratelimit.New(ratelimit.NewMemoryStore(), 10, time.Minute),
+	}
+
+	// Load OpenID Connect identity providers users can sign in with
+	providers, err := api.LoadOIDCProviders()
+	if err != nil {
+		log.Fatal("Failed to load identity providers: ", err)
+	}
+
+	// Carry on with rescore jobs which were running when the server last stopped
+	rescorer := api.NewRescorer(ds.RescoreRepo, ds.SampleRepo)
+	if err := rescorer.Resume(); err != nil {
+		log.Fatal("Failed to resume rescore jobs: ", err)
+	}
+	defer rescorer.Stop()
+
 	// Create API server
-	apiserver := api.NewRouter(&api.Env{ds, reboot})
+	apiserver := api.NewRouter(&api.Env{
+		DataStore: ds,
+		Reboot:    reboot,
+		Keys:      keys,
+		Mailer:    m,
+		Policy:    policy,
+		Limits:    limits,
+		OIDC:      providers,
+		Rescorer:  rescorer,
+	})
 
 	// Create fileserver out of www/ directory
 	fileserver := http.FileServer(http.Dir("www"))
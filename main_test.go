@@ -2,31 +2,90 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	//	"github.com/gorilla/handlers"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nklaassen/tremr-web/api"
 	"github.com/nklaassen/tremr-web/database"
+	"github.com/nklaassen/tremr-web/ratelimit"
+	"github.com/nklaassen/tremr-web/scoring"
 	"io"
-	"math/rand"
+	"io/ioutil"
+	"math"
+	"math/big"
+	mathrand "math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 var router *mux.Router
+var datastore api.DataStore
+var db *sqlx.DB
+var signingKey ed25519.PrivateKey
+var keys *api.Keyring
+var rescorer *api.Rescorer
+var mail = new(testMailer)
+
+// testMailer keeps every email sent by the api so tests can read them
+type testMailer struct {
+	messages []testMessage
+}
+type testMessage struct {
+	to, subject, body string
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.messages = append(m.messages, testMessage{to, subject, body})
+	return nil
+}
+
+// returns the last email sent to the address
+func (m *testMailer) last(to string) (testMessage, bool) {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].to == to {
+			return m.messages[i], true
+		}
+	}
+	return testMessage{}, false
+}
+
+// returns the single-use code from the last email sent to the address, which is on its own line
+func mailedCode(to string) string {
+	message, _ := mail.last(to)
+	for _, line := range strings.Split(message.body, "\n") {
+		if len(line) == 43 && !strings.Contains(line, " ") {
+			return line
+		}
+	}
+	return ""
+}
+
 var globalAuthTokens []string
 
 func TestMain(m *testing.M) {
 	// open raw database
-	db, err := sqlx.Open("sqlite3", "test_db.sqlite3?_journal_mode=WAL")
+	var err error
+	db, err = sqlx.Open("sqlite3", "test_db.sqlite3?_journal_mode=WAL")
 	if err != nil {
 		panic(err)
 	}
@@ -36,51 +95,113 @@ func TestMain(m *testing.M) {
 		drop table if exists medicines;
 		drop table if exists exercises;
 		drop table if exists users;
-		drop table if exists links;`)
+		drop table if exists links;
+		drop table if exists refresh_tokens;
+		drop table if exists user_tokens;
+		drop table if exists mfa;
+		drop table if exists recovery_codes;
+		drop table if exists api_keys;
+		drop table if exists oidc_states;
+		drop table if exists identities;
+		drop table if exists deleted_users;
+		drop table if exists shares;
+		drop table if exists orgs;
+		drop table if exists org_members;
+		drop table if exists org_shares;
+		drop table if exists audit_log;
+		drop table if exists tremor_samples;
+		drop table if exists tremor_scores;
+		drop table if exists rescore_jobs;`)
 	if err != nil {
 		panic(err)
 	}
 
 	// initialize the datastore
-	datastore, err := database.GetDataStore(db)
+	datastore, err = database.GetDataStore(db)
 	if err != nil {
 		panic(err)
 	}
+	rescorer = api.NewRescorer(datastore.RescoreRepo, datastore.SampleRepo)
 
-	// set up the api router
-	apiEnv := &api.Env{datastore, make(chan struct{})}
-	apiRouter := api.NewRouter(apiEnv)
-
-	// setup the global router which strips the /api prefix before sending to the apiRouter
-	router = mux.NewRouter()
-	handler := http.StripPrefix("/api", apiRouter)
-	//handler = handlers.LoggingHandler(os.Stdout, handler)
-	router.PathPrefix("/api").Handler(handler)
+	// sign tokens with an asymmetric key so the jwks endpoint has something to publish
+	_, signingKey, err = ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	keys = api.NewKeyring(api.NewEd25519Key("test-1", signingKey))
+	router = newTestRouter(testEnv(keys))
 
 	// create some users and get authenticated tokens to use globally
 	users := []string{
 		`{"email": "test1@tremr.com", "password": "hunter1", "name": "tester 1"}`,
 		`{"email": "test2@tremr.com", "password": "hunter2", "name": "tester 2"}`,
 	}
-	for _, user := range users {
+	for i, user := range users {
 		_, err = request("POST", "/api/auth/signup", strings.NewReader(user), "", http.StatusOK)
 		if err != nil {
 			panic(err)
 		}
-		r, err := request("POST", "/api/auth/signin", strings.NewReader(user), "", http.StatusOK)
+		// verify the email address with the code from the signup email
+		body := fmt.Sprintf(`{"token": "%v"}`, mailedCode(fmt.Sprintf("test%v@tremr.com", i+1)))
+		if _, err = request("POST", "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+			panic(err)
+		}
+		tokens, err := signin(user)
 		if err != nil {
 			panic(err)
 		}
-		globalAuthTokens = append(globalAuthTokens, string(r.Body.Bytes()))
+		globalAuthTokens = append(globalAuthTokens, tokens.Token)
 	}
 
-	rand.Seed(0xdeadbeef)
+	mathrand.Seed(0xdeadbeef)
 
 	code := m.Run()
 	db.Close()
 	os.Exit(code)
 }
 
+// helper method to get the api environment used by most tests
+func testEnv(keys *api.Keyring) *api.Env {
+	return &api.Env{
+		DataStore: datastore,
+		Reboot:    make(chan struct{}),
+		Keys:      keys,
+		Mailer:    mail,
+		Policy:    api.Policy{RequireVerifiedLinks: true},
+		Rescorer:  rescorer,
+	}
+}
+
+// helper method to set up a router which strips the /api prefix before sending to the api router
+func newTestRouter(env *api.Env) *mux.Router {
+	apiRouter := api.NewRouter(env)
+
+	router := mux.NewRouter()
+	handler := http.StripPrefix("/api", apiRouter)
+	//handler = handlers.LoggingHandler(os.Stdout, handler)
+	router.PathPrefix("/api").Handler(handler)
+	return router
+}
+
+// helper method to accept every pending invitation sent to the user with this token
+func acceptInvitations(token string) error {
+	response, err := request(http.MethodGet, "/api/users/links/invitations", nil, token, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var invitations []api.Invitation
+	json.NewDecoder(response.Body).Decode(&invitations)
+	for _, invitation := range invitations {
+		if invitation.Status != api.InvitationPending {
+			continue
+		}
+		// invitations we sent can't be accepted by us, so ignore the error for those
+		url := fmt.Sprintf("/api/users/links/invitations/%v/accept", invitation.Lid)
+		request(http.MethodPost, url, nil, token, http.StatusOK)
+	}
+	return nil
+}
+
 // helper method for performing http requests
 func request(method, url string, body io.Reader, token string, expect int) (r *httptest.ResponseRecorder, err error) {
 	request, err := http.NewRequest(method, url, body)
@@ -99,6 +220,34 @@ func request(method, url string, body io.Reader, token string, expect int) (r *h
 	return
 }
 
+// helper method to sign up a user with a verified email, named after the email, and sign them in
+func signupVerified(email string) (token string, uid int64, err error) {
+	user := fmt.Sprintf(`{"email": "%v", "password": "hunter1", "name": "%v"}`, email, email)
+	if _, err = request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		return
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		return
+	}
+	body := fmt.Sprintf(`{"token": "%v"}`, mailedCode(email))
+	if _, err = request(http.MethodPost, "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+		return
+	}
+	stored, err := datastore.UserRepo.GetFromEmail(email)
+	return tokens.Token, stored.Uid, err
+}
+
+// helper method to sign in and decode the returned tokens
+func signin(user string) (tokens api.Tokens, err error) {
+	r, err := request("POST", "/api/auth/signin", strings.NewReader(user), "", http.StatusOK)
+	if err != nil {
+		return
+	}
+	err = json.NewDecoder(r.Body).Decode(&tokens)
+	return
+}
+
 // helper method to generate fractal pseudo-random tremor data
 func fractal(a []int) {
 	if len(a) <= 2 {
@@ -110,7 +259,7 @@ func fractal(a []int) {
 	if spread < 10 {
 		spread = 10
 	}
-	a[mid] += rand.Intn(spread) - spread/2
+	a[mid] += mathrand.Intn(spread) - spread/2
 	if a[mid] > 100 {
 		a[mid] = 200 - a[mid]
 	}
@@ -124,8 +273,8 @@ func fractal(a []int) {
 func TestPostTremor(t *testing.T) {
 	for _, token := range globalAuthTokens {
 		vals := [800]int{}
-		vals[0] = rand.Intn(10) + 25
-		vals[799] = rand.Intn(10) + 75
+		vals[0] = mathrand.Intn(10) + 25
+		vals[799] = mathrand.Intn(10) + 75
 		fractal(vals[:])
 		now := time.Now()
 		for i := 0; i < 365; i++ {
@@ -420,6 +569,18 @@ func TestAuth(t *testing.T) {
 		t.Error(err)
 	}
 
+	// emails are case-insensitive
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(`{
+		"name": "Tester 2",
+		"email": "Test2@Tremr.com",
+		"password": "hunter3"
+		}`), "", http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+	if _, err := signin(`{"email": "TEST2@tremr.com", "password": "hunter2"}`); err != nil {
+		t.Error(err)
+	}
+
 	// authenticated request
 	if _, err := request(http.MethodGet, "/api/exercises", nil, globalAuthTokens[0], http.StatusOK); err != nil {
 		t.Error(err)
@@ -432,91 +593,2910 @@ func TestAuth(t *testing.T) {
 	if _, err := request(http.MethodGet, "/api/exercises", nil, "0xdeadbeef", http.StatusUnauthorized); err != nil {
 		t.Error(err)
 	}
+	// tokens without an expiry or session are never accepted
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": 1}).
+		SignedString([]byte("Very Secret Key, Shhh....."))
+	if _, err := request(http.MethodGet, "/api/exercises", nil, legacy, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
 }
 
-func TestGetUser(t *testing.T) {
-	response, err := request(http.MethodGet, "/api/users/1", nil, globalAuthTokens[0], http.StatusOK)
+func TestRefreshAndSignout(t *testing.T) {
+	tokens, err := signin(`{"email": "test1@tremr.com", "password": "hunter1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Expires.After(time.Now().Add(time.Hour)) {
+		t.Error("access token lives longer than an hour:", tokens.Expires)
+	}
+
+	// expired refresh tokens are deleted on the next refresh
+	expired := api.RefreshToken{Hash: "expired", Family: "expired", Uid: 1, Expires: time.Now().Add(-time.Minute)}
+	if err := datastore.TokenRepo.AddRefreshToken(&expired); err != nil {
+		t.Fatal(err)
+	}
+
+	// exchange the refresh token for a new pair
+	body := fmt.Sprintf(`{"refresh": "%v"}`, tokens.Refresh)
+	response, err := request(http.MethodPost, "/api/auth/refresh", strings.NewReader(body), "", http.StatusOK)
 	if err != nil {
+		t.Fatal(err)
+	}
+	var refreshed api.Tokens
+	if err := json.NewDecoder(response.Body).Decode(&refreshed); err != nil {
+		t.Fatal("decode error:", err)
+	}
+	if refreshed.Refresh == tokens.Refresh {
+		t.Error("refresh token was not rotated")
+	}
+	var count int
+	if err := db.Get(&count, "select count(*) from refresh_tokens where hash = 'expired'"); err != nil || count != 0 {
+		t.Error("expected the expired refresh token to be deleted", count, err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors", nil, refreshed.Token, http.StatusOK); err != nil {
 		t.Error(err)
 	}
-	var user api.User
-	json.NewDecoder(response.Body).Decode(&user)
-	if user.Password != "" {
-		t.Error("GET /api/users/1 returned the users password!")
+
+	// reusing the old refresh token revokes the whole family, including the refreshed access token
+	if _, err := request(http.MethodPost, "/api/auth/refresh", strings.NewReader(body), "", http.StatusUnauthorized); err != nil {
+		t.Error(err)
 	}
-	if _, err = request(http.MethodGet, "/api/users/2", nil, globalAuthTokens[0], http.StatusUnauthorized); err != nil {
+	if _, err := request(http.MethodGet, "/api/tremors", nil, refreshed.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	body = fmt.Sprintf(`{"refresh": "%v"}`, refreshed.Refresh)
+	if _, err := request(http.MethodPost, "/api/auth/refresh", strings.NewReader(body), "", http.StatusUnauthorized); err != nil {
 		t.Error(err)
 	}
-}
 
-func TestLinks(t *testing.T) {
-	// test add link from user 1 to user 2
-	_, err := request(http.MethodPost, "/api/users/links/out",
-		strings.NewReader(`{"email":"test2@tremr.com"}`), globalAuthTokens[0], http.StatusOK)
+	// signing out revokes the session
+	tokens, err = signin(`{"email": "test1@tremr.com", "password": "hunter1"}`)
 	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, "/api/auth/signout", nil, tokens.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors", nil, tokens.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	body = fmt.Sprintf(`{"refresh": "%v"}`, tokens.Refresh)
+	if _, err := request(http.MethodPost, "/api/auth/refresh", strings.NewReader(body), "", http.StatusUnauthorized); err != nil {
 		t.Error(err)
 	}
 
-	// test add link from user 2 to user 1
-	if _, err := request(http.MethodPost, "/api/users/links/out",
-		strings.NewReader(`{"email":"test1@tremr.com"}`), globalAuthTokens[1], http.StatusOK); err != nil {
+	// other sessions are unaffected
+	if _, err := request(http.MethodGet, "/api/tremors", nil, globalAuthTokens[0], http.StatusOK); err != nil {
 		t.Error(err)
 	}
+}
 
-	// test get user 1 incoming links
-	response, err := request(http.MethodGet, "/api/users/links/in", nil, globalAuthTokens[0], http.StatusOK)
+func TestSigningKeys(t *testing.T) {
+	// the public key of the active key must be published
+	response, err := request(http.MethodGet, "/api/auth/jwks.json", nil, "", http.StatusOK)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	var users []api.UserWithoutPassword
-	json.NewDecoder(response.Body).Decode(&users)
-	if len(users) != 1 || users[0].Email != "test2@tremr.com" {
-		t.Error("failed to get incoming links for user 1")
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		t.Fatal("decode error:", err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Kid != "test-1" || set.Keys[0].Crv != "Ed25519" {
+		t.Fatal("unexpected jwks:", set)
 	}
 
-	// test get user 2 outgoing links
-	response, err = request(http.MethodGet, "/api/users/links/out", nil, globalAuthTokens[1], http.StatusOK)
+	// other services should be able to verify our tokens with only the published key
+	x, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].X)
+	token, err := jwt.Parse(globalAuthTokens[0], func(token *jwt.Token) (interface{}, error) {
+		return ed25519.PublicKey(x), nil
+	})
+	if err != nil || !token.Valid || token.Header["kid"] != "test-1" {
+		t.Error("failed to verify token with published key:", err)
+	}
+
+	// rotate to a new HMAC key, keeping the old one for verification
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	rotated := api.NewKeyring(api.NewHMACKey("test-2", secret), api.NewEd25519Key("test-1", signingKey))
+	defer func(old *mux.Router) { router = old }(router)
+	router = newTestRouter(testEnv(rotated))
+
+	// tokens signed with the old key still work
+	if _, err := request(http.MethodGet, "/api/tremors", nil, globalAuthTokens[0], http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	// new tokens are signed with the new key
+	tokens, err := signin(`{"email": "test1@tremr.com", "password": "hunter1"}`)
 	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _, _ := new(jwt.Parser).ParseUnverified(tokens.Token, jwt.MapClaims{}); token.Header["kid"] != "test-2" {
+		t.Error("token signed with wrong key:", token.Header)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors", nil, tokens.Token, http.StatusOK); err != nil {
 		t.Error(err)
 	}
-	json.NewDecoder(response.Body).Decode(&users)
-	if len(users) != 1 || users[0].Email != "test1@tremr.com" {
-		t.Error("failed to get outgoing links for user 2")
+	// secret keys are never published
+	response, err = request(http.MethodGet, "/api/auth/jwks.json", nil, "", http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(response.Body.String(), "test-2") {
+		t.Error("jwks published an HMAC key")
 	}
 
-	// test getting user 2 tremors while logged in as user 1
-	var tremors1 []api.Tremor
-	var tremors2 []api.Tremor
-	response, err = request(http.MethodGet, "/api/tremors?uid=2", nil, globalAuthTokens[0], http.StatusOK)
+	// once the old key is dropped its tokens stop working
+	router = newTestRouter(testEnv(api.NewKeyring(api.NewHMACKey("test-2", secret))))
+	if _, err := request(http.MethodGet, "/api/tremors", nil, globalAuthTokens[0], http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors", nil, tokens.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadKeyringFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tremr-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	if err := ioutil.WriteFile(filepath.Join(dir, "rsa.pem"), rsaPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keysJson := `{"active": "rsa", "keys": [
+		{"kid": "rsa", "alg": "RS256", "file": "rsa.pem"},
+		{"kid": "old", "alg": "HS256", "secret": "c2VjcmV0IGtleQ=="}
+	]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys.json"), []byte(keysJson), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := api.LoadKeyringFile(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *mux.Router) { router = old }(router)
+	router = newTestRouter(testEnv(loaded))
+
+	tokens, err := signin(`{"email": "test1@tremr.com", "password": "hunter1"}`)
 	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(tokens.Token, func(token *jwt.Token) (interface{}, error) {
+		return &rsaKey.PublicKey, nil
+	})
+	if err != nil || token.Method != jwt.SigningMethodRS256 {
+		t.Error("token not signed with RS256 key:", err)
+	}
+
+	// a token signed with the RSA public key as an HMAC secret must not be accepted
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": 1}).SignedString(rsaPem)
+	if _, err := request(http.MethodGet, "/api/tremors", nil, forged, http.StatusUnauthorized); err != nil {
 		t.Error(err)
 	}
-	json.NewDecoder(response.Body).Decode(&tremors1)
-	response, err = request(http.MethodGet, "/api/tremors", nil, globalAuthTokens[1], http.StatusOK)
+
+	// the active key must exist
+	ioutil.WriteFile(filepath.Join(dir, "keys.json"), []byte(`{"active": "missing", "keys": []}`), 0600)
+	if _, err := api.LoadKeyringFile(filepath.Join(dir, "keys.json")); err == nil {
+		t.Error("loaded a keyring without an active key")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	user := `{"email": "password@tremr.com", "password": "hunter1", "name": "password tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := signin(user)
 	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("password@tremr.com")
+	url := fmt.Sprintf("/api/users/%v/password", stored.Uid)
+
+	// wrong current password
+	if _, err := request(http.MethodPut, url, strings.NewReader(`{"current": "hunter2", "password": "hunter3"}`),
+		tokens.Token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	// new password too short
+	if _, err := request(http.MethodPut, url, strings.NewReader(`{"current": "hunter1", "password": "h3"}`),
+		tokens.Token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	// someone else's password
+	if _, err := request(http.MethodPut, "/api/users/1/password", strings.NewReader(`{"current": "hunter1", "password": "hunter3"}`),
+		tokens.Token, http.StatusUnauthorized); err != nil {
 		t.Error(err)
 	}
-	json.NewDecoder(response.Body).Decode(&tremors2)
 
-	if !reflect.DeepEqual(tremors1, tremors2) {
-		t.Error("failed to get user 2's tremors while logged in as user 1")
+	if _, err := request(http.MethodPut, url, strings.NewReader(`{"current": "hunter1", "password": "hunter3"}`),
+		tokens.Token, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signin(`{"email": "password@tremr.com", "password": "hunter1"}`); err == nil {
+		t.Error("signed in with old password")
+	}
+	if _, err := signin(`{"email": "password@tremr.com", "password": "hunter3"}`); err != nil {
+		t.Error("failed to sign in with new password:", err)
 	}
 
-	// test getting user 2 meds while logged in as user 1
-	var meds1 []api.Medicine
-	var meds2 []api.Medicine
-	response, err = request(http.MethodGet, "/api/meds?uid=2", nil, globalAuthTokens[0], http.StatusOK)
+	// other sessions are signed out, this one is not
+	if _, err := request(http.MethodGet, "/api/users/links/in", nil, other.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/users/links/in", nil, tokens.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+
+	// wrong passwords count towards the signin lockout, so a stolen token can't be used to guess it
+	for i := 0; i < 5; i++ {
+		if _, err := request(http.MethodPut, url, strings.NewReader(`{"current": "hunter2", "password": "hunter4"}`),
+			tokens.Token, http.StatusForbidden); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := request(http.MethodPut, url, strings.NewReader(`{"current": "hunter3", "password": "hunter4"}`),
+		tokens.Token, http.StatusTooManyRequests); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	user := `{"email": "reset@tremr.com", "password": "hunter1", "name": "reset tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
 	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("reset@tremr.com")
+	if _, err := request(http.MethodPost, fmt.Sprintf("/api/users/%v/keys", stored.Uid),
+		strings.NewReader(`{"name": "phone", "scopes": ["tremors:write"]}`), tokens.Token, http.StatusOK); err != nil {
 		t.Error(err)
 	}
-	json.NewDecoder(response.Body).Decode(&meds1)
-	response, err = request(http.MethodGet, "/api/meds", nil, globalAuthTokens[1], http.StatusOK)
+
+	// unknown emails look the same as known ones, but nothing is sent
+	sent := len(mail.messages)
+	if _, err := request(http.MethodPost, "/api/auth/reset/request", strings.NewReader(`{"email": "nobody@tremr.com"}`),
+		"", http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if len(mail.messages) != sent {
+		t.Error("sent a reset email to an unknown address")
+	}
+
+	if _, err := request(http.MethodPost, "/api/auth/reset/request", strings.NewReader(`{"email": "reset@tremr.com"}`),
+		"", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	code := mailedCode("reset@tremr.com")
+	if code == "" {
+		t.Fatal("no reset code emailed")
+	}
+
+	// a bad token or password does not reset anything
+	if _, err := request(http.MethodPost, "/api/auth/reset", strings.NewReader(`{"token": "abc", "password": "hunter3"}`),
+		"", http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	body := fmt.Sprintf(`{"token": "%v", "password": "h3"}`, code)
+	if _, err := request(http.MethodPost, "/api/auth/reset", strings.NewReader(body), "", http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+
+	body = fmt.Sprintf(`{"token": "%v", "password": "hunter3"}`, code)
+	if _, err := request(http.MethodPost, "/api/auth/reset", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signin(`{"email": "reset@tremr.com", "password": "hunter3"}`); err != nil {
+		t.Error("failed to sign in with new password:", err)
+	}
+	// every session is signed out
+	if _, err := request(http.MethodGet, "/api/users/links/in", nil, tokens.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if keys, _ := datastore.APIKeyRepo.GetAPIKeys(stored.Uid); len(keys) != 0 {
+		t.Error("api keys survived a password reset")
+	}
+
+	// reset tokens are single-use
+	body = fmt.Sprintf(`{"token": "%v", "password": "hunter4"}`, code)
+	if _, err := request(http.MethodPost, "/api/auth/reset", strings.NewReader(body), "", http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	// email addresses must be deliverable
+	invalid := []string{"abc", "bob@localhost", "Bob <bob@tremr.com>", "bob@tremr.", "bob tremr.com"}
+	for _, email := range invalid {
+		user := fmt.Sprintf(`{"email": "%v", "password": "hunter1", "name": "bob"}`, email)
+		if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusBadRequest); err != nil {
+			t.Error(email, err)
+		}
+	}
+
+	user := `{"email": "unverified@tremr.com", "password": "hunter1", "name": "unverified tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	firstCode := mailedCode("unverified@tremr.com")
+	if firstCode == "" {
+		t.Fatal("no verification code emailed on signup")
+	}
+
+	// unverified accounts can sign in
+	tokens, err := signin(user)
 	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("unverified@tremr.com")
+	if stored.Verified {
+		t.Error("new user is already verified")
+	}
+
+	// but nobody can share with them
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(`{"email": "unverified@tremr.com"}`),
+		globalAuthTokens[0], http.StatusForbidden); err != nil {
 		t.Error(err)
 	}
-	json.NewDecoder(response.Body).Decode(&meds2)
 
-	if !reflect.DeepEqual(meds1, meds2) {
-		t.Error("failed to get user 2's meds while logged in as user 1")
+	// ask for a new code, and use it
+	url := fmt.Sprintf("/api/users/%v/verify", stored.Uid)
+	if _, err := request(http.MethodPost, url, nil, tokens.Token, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	code := mailedCode("unverified@tremr.com")
+	if code == firstCode {
+		t.Fatal("no new verification code emailed")
+	}
+	if _, err := request(http.MethodPost, "/api/auth/verify", strings.NewReader(`{"token": "abc"}`), "", http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	body := fmt.Sprintf(`{"token": "%v"}`, code)
+	if _, err := request(http.MethodPost, "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, url, nil, tokens.Token, http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+	response, err := request(http.MethodGet, fmt.Sprintf("/api/users/%v", stored.Uid), nil, tokens.Token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info api.UserWithoutPassword
+	json.NewDecoder(response.Body).Decode(&info)
+	if !info.Verified {
+		t.Error("user not verified after using code")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	env := testEnv(keys)
+	env.Limits = api.Limits{
+		Signin:  ratelimit.New(ratelimit.NewMemoryStore(), 3, time.Hour),
+		Signup:  ratelimit.New(ratelimit.NewMemoryStore(), 1, time.Hour),
+		Account: ratelimit.New(ratelimit.NewMemoryStore(), 2, time.Hour),
+	}
+	old := router
+	defer func() { router = old }()
+	router = newTestRouter(env)
+
+	requestFrom := func(addr, url, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		request.RemoteAddr = addr
+		r := httptest.NewRecorder()
+		router.ServeHTTP(r, request)
+		return r
+	}
+	expect := func(r *httptest.ResponseRecorder, code int) {
+		t.Helper()
+		if r.Code != code {
+			t.Errorf("Returned %v instead of %v", r.Code, code)
+		}
+		if code == http.StatusTooManyRequests && r.Header().Get("Retry-After") == "" {
+			t.Error("429 response without Retry-After")
+		}
+	}
+
+	// guesses at one account are limited, even with the right password
+	expect(requestFrom("10.0.0.1:1234", "/api/auth/signin", `{"email": "test1@tremr.com", "password": "guess1"}`),
+		http.StatusUnauthorized)
+	expect(requestFrom("10.0.0.2:1234", "/api/auth/signin", `{"email": "test1@tremr.com", "password": "guess2"}`),
+		http.StatusUnauthorized)
+	expect(requestFrom("10.0.0.1:1234", "/api/auth/signin", `{"email": "TEST1@tremr.com", "password": "hunter1"}`),
+		http.StatusTooManyRequests)
+
+	// and so are requests from one address, whichever account they are for
+	expect(requestFrom("10.0.0.1:1234", "/api/auth/signin", `{"email": "test2@tremr.com", "password": "hunter2"}`),
+		http.StatusOK)
+	expect(requestFrom("10.0.0.1:5678", "/api/auth/signin", `{"email": "test2@tremr.com", "password": "hunter2"}`),
+		http.StatusTooManyRequests)
+
+	// signups have their own limit
+	expect(requestFrom("10.0.0.1:1234", "/api/auth/signup", `{"email": "ratelimit@tremr.com", "password": "hunter1", "name": "r"}`),
+		http.StatusOK)
+	expect(requestFrom("10.0.0.1:1234", "/api/auth/signup", `{"email": "ratelimit2@tremr.com", "password": "hunter1", "name": "r"}`),
+		http.StatusTooManyRequests)
+
+	// other addresses are unaffected
+	expect(requestFrom("10.0.0.3:1234", "/api/auth/signin", `{"email": "test2@tremr.com", "password": "hunter2"}`),
+		http.StatusOK)
+
+	// a successful signin resets the failure count used for lockouts
+	router = old
+	if _, err := signin(`{"email": "test1@tremr.com", "password": "hunter1"}`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	user := `{"email": "lockout@tremr.com", "password": "hunter1", "name": "lockout tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	wrong := `{"email": "lockout@tremr.com", "password": "hunter2"}`
+	for i := 0; i < 5; i++ {
+		if _, err := request(http.MethodPost, "/api/auth/signin", strings.NewReader(wrong), "", http.StatusUnauthorized); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the account is now locked, even for the right password, and looks just like an unknown email
+	response, err := request(http.MethodPost, "/api/auth/signin", strings.NewReader(user), "", http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := request(http.MethodPost, "/api/auth/signin",
+		strings.NewReader(`{"email": "nobody@tremr.com", "password": "hunter1"}`), "", http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Body.String() != unknown.Body.String() || response.Header().Get("Retry-After") != "" {
+		t.Error("a locked account can be told apart from an unknown email:", response.Body, unknown.Body)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("LOCKOUT@tremr.com")
+	if stored.LockedUntil == nil || time.Until(*stored.LockedUntil) > time.Minute || stored.FailedLogins != 5 {
+		t.Error("lockout not stored:", stored.FailedLogins, stored.LockedUntil)
+	}
+
+	// resetting the password unlocks the account
+	if _, err := request(http.MethodPost, "/api/auth/reset/request", strings.NewReader(`{"email": "lockout@tremr.com"}`),
+		"", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"token": "%v", "password": "hunter3"}`, mailedCode("lockout@tremr.com"))
+	if _, err := request(http.MethodPost, "/api/auth/reset", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signin(`{"email": "lockout@tremr.com", "password": "hunter3"}`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMFA(t *testing.T) {
+	user := `{"email": "mfa@tremr.com", "password": "hunter1", "name": "mfa tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("mfa@tremr.com")
+	url := fmt.Sprintf("/api/users/%v/mfa", stored.Uid)
+
+	// enrolling needs the password
+	if _, err := request(http.MethodPost, url, strings.NewReader(`{"password": "hunter2"}`),
+		tokens.Token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	response, err := request(http.MethodPost, url, strings.NewReader(`{"password": "hunter1"}`), tokens.Token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enrollment struct {
+		Secret string
+		URI    string
+	}
+	json.NewDecoder(response.Body).Decode(&enrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/Tremr:mfa@tremr.com?") ||
+		!strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Error("unexpected otpauth uri:", enrollment.URI)
+	}
+
+	// not enabled until it is confirmed
+	if _, err := signin(user); err != nil {
+		t.Error(err)
+	}
+	now := time.Now()
+	wrong, _ := api.TOTP(enrollment.Secret, now.Add(time.Hour))
+	if _, err := request(http.MethodPost, url+"/confirm", strings.NewReader(`{"code": "`+wrong+`"}`),
+		tokens.Token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	code, err := api.TOTP(enrollment.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = request(http.MethodPost, url+"/confirm", strings.NewReader(`{"code": "`+code+`"}`), tokens.Token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recovery struct {
+		RecoveryCodes []string
+	}
+	json.NewDecoder(response.Body).Decode(&recovery)
+	if len(recovery.RecoveryCodes) != 10 {
+		t.Fatal("expected 10 recovery codes, got", recovery.RecoveryCodes)
+	}
+	if _, err := request(http.MethodPost, url, strings.NewReader(`{"password": "hunter1"}`),
+		tokens.Token, http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+
+	// signing in now takes two steps
+	challenge := func() api.MFAChallenge {
+		t.Helper()
+		response, err := request(http.MethodPost, "/api/auth/signin", strings.NewReader(user), "", http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var challenge api.MFAChallenge
+		json.NewDecoder(response.Body).Decode(&challenge)
+		if !challenge.Required || challenge.Token == "" {
+			t.Fatal("expected an mfa challenge")
+		}
+		return challenge
+	}
+	pending := challenge()
+	// the pending token can't be used as an access token
+	if _, err := request(http.MethodGet, "/api/users/links/in", nil, pending.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	mfaSignin := func(token, code string, expect int) (tokens api.Tokens) {
+		t.Helper()
+		body := fmt.Sprintf(`{"mfaToken": "%v", "code": "%v"}`, token, code)
+		response, err := request(http.MethodPost, "/api/auth/signin/mfa", strings.NewReader(body), "", expect)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		json.NewDecoder(response.Body).Decode(&tokens)
+		return
+	}
+	// codes can't be replayed
+	mfaSignin(pending.Token, code, http.StatusUnauthorized)
+	// and access tokens can't stand in for pending tokens
+	next, _ := api.TOTP(enrollment.Secret, now.Add(30*time.Second))
+	mfaSignin(tokens.Token, next, http.StatusUnauthorized)
+	signedIn := mfaSignin(pending.Token, next, http.StatusOK)
+	if _, err := request(http.MethodGet, "/api/users/links/in", nil, signedIn.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+
+	// each recovery code works once, ignoring case
+	pending = challenge()
+	mfaSignin(pending.Token, strings.ToUpper(recovery.RecoveryCodes[0]), http.StatusOK)
+	mfaSignin(pending.Token, recovery.RecoveryCodes[0], http.StatusUnauthorized)
+
+	// turning it off needs a code too, and wrong ones count towards the lockout
+	before, _ := datastore.UserRepo.GetFromEmail("mfa@tremr.com")
+	if _, err := request(http.MethodDelete, url, strings.NewReader(`{"code": "`+recovery.RecoveryCodes[0]+`"}`),
+		signedIn.Token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if after, _ := datastore.UserRepo.GetFromEmail("mfa@tremr.com"); after.FailedLogins != before.FailedLogins+1 {
+		t.Error("expected a wrong code to be counted, got", before.FailedLogins, after.FailedLogins)
+	}
+	if _, err := request(http.MethodDelete, url, strings.NewReader(`{"code": "`+recovery.RecoveryCodes[1]+`"}`),
+		signedIn.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := signin(user); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	user := `{"email": "keys@tremr.com", "password": "hunter1", "name": "api key tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("keys@tremr.com")
+	url := fmt.Sprintf("/api/users/%v/keys", stored.Uid)
+
+	if _, err := request(http.MethodPost, url, strings.NewReader(`{"name": "watch", "scopes": ["tremors:delete"]}`),
+		tokens.Token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPost, url, strings.NewReader(`{"name": "watch", "scopes": []}`),
+		tokens.Token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	response, err := request(http.MethodPost, url, strings.NewReader(`{"name": "watch", "scopes": ["tremors:write"]}`),
+		tokens.Token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		Kid    int64
+		Prefix string
+		Key    string
+	}
+	json.NewDecoder(response.Body).Decode(&created)
+	if !strings.HasPrefix(created.Key, "tremr_") || !strings.HasPrefix(created.Key, created.Prefix) {
+		t.Fatal("unexpected api key:", created)
+	}
+
+	// the key can only do what its scopes allow
+	tremor := fmt.Sprintf(`{"resting": 40, "postural": 50, "date": "%v"}`, time.Now().Format(time.RFC3339))
+	if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), created.Key, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors", nil, created.Key, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/meds", nil, created.Key, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	// and never manage the account
+	if _, err := request(http.MethodGet, url, nil, created.Key, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), "tremr_notakey", http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+
+	// the list never includes the key itself
+	response, err = request(http.MethodGet, url, nil, tokens.Token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(response.Body.String(), created.Key) {
+		t.Error("api key list contains the key")
+	}
+	var listed []api.APIKey
+	json.NewDecoder(response.Body).Decode(&listed)
+	if len(listed) != 1 || listed[0].Name != "watch" || listed[0].LastUsed == nil ||
+		!reflect.DeepEqual(listed[0].Scopes, api.Scopes{"tremors:write"}) {
+		t.Error("unexpected api keys:", listed)
+	}
+
+	// revoked keys stop working
+	revoke := fmt.Sprintf("%v/%v", url, created.Kid)
+	if _, err := request(http.MethodDelete, fmt.Sprintf("/api/users/1/keys/%v", created.Kid), nil,
+		tokens.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, revoke, nil, tokens.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, revoke, nil, tokens.Token, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), created.Key, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+}
+
+// testIdP is a stand-in OpenID Connect identity provider. Instead of showing a login page,
+// authorize hands out a code for whichever claims the test wants to sign in with.
+type testIdP struct {
+	*httptest.Server
+	keys  *api.Keyring
+	jwks  []byte
+	mu    sync.Mutex
+	codes map[string]testIdPCode
+}
+
+type testIdPCode struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newTestIdP(clientID, clientSecret, redirectURL string) (*testIdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	idp := &testIdP{keys: api.NewKeyring(api.NewRSAKey("idp-1", key)), codes: make(map[string]testIdPCode)}
+	idp.jwks, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "idp-1",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(idp.jwks)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != clientID || secret != clientSecret {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		idp.mu.Lock()
+		code, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != redirectURL ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":   idp.URL,
+			"aud":   clientID,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": code.nonce,
+		}
+		for k, v := range code.claims {
+			claims[k] = v
+		}
+		idToken, err := idp.keys.Sign(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp, nil
+}
+
+// authorize plays the part of the user signing in at the provider, returning the code for the callback
+func (idp *testIdP) authorize(authURL string, claims jwt.MapClaims) (code, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		err = fmt.Errorf("unexpected authorization request %v", authURL)
+		return
+	}
+	code = fmt.Sprint(mathrand.Int63())
+	idp.mu.Lock()
+	idp.codes[code] = testIdPCode{query.Get("code_challenge"), query.Get("nonce"), claims}
+	idp.mu.Unlock()
+	return code, query.Get("state"), nil
+}
+
+func TestOIDC(t *testing.T) {
+	provider := &api.OIDCProvider{
+		Name:         "idp",
+		DisplayName:  "Test Hospital",
+		ClientID:     "tremr",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://tremr.test/api/auth/oidc/idp/callback",
+	}
+	idp, err := newTestIdP(provider.ClientID, provider.ClientSecret, provider.RedirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	provider.Issuer = idp.URL
+
+	env := testEnv(keys)
+	env.OIDC = map[string]*api.OIDCProvider{"idp": provider}
+	defer func(old *mux.Router) { router = old }(router)
+	router = newTestRouter(env)
+
+	response, err := request(http.MethodGet, "/api/auth/oidc", nil, "", http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(response.Body.String(), `"displayName":"Test Hospital"`) {
+		t.Error("provider not listed:", response.Body.String())
+	}
+
+	// starts a signin, returning the authorization url and the browser's state cookie
+	login := func() (string, *http.Cookie) {
+		t.Helper()
+		response, err := request(http.MethodGet, "/api/auth/oidc/idp/login", nil, "", http.StatusFound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies := response.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatal("expected a state cookie")
+		}
+		return response.Header().Get("Location"), cookies[0]
+	}
+	// returns the url fragment the signin page is sent
+	callback := func(code, state string, cookie *http.Cookie) url.Values {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet,
+			"/api/auth/oidc/idp/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, req)
+		location, _ := url.Parse(response.Header().Get("Location"))
+		if response.Code != http.StatusFound || location.Path != "/signin.html" {
+			t.Fatal("unexpected callback response", response.Code, location)
+		}
+		result, _ := url.ParseQuery(location.Fragment)
+		return result
+	}
+	signin := func(claims jwt.MapClaims) url.Values {
+		t.Helper()
+		authURL, cookie := login()
+		code, state, err := idp.authorize(authURL, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return callback(code, state, cookie)
+	}
+
+	// new identities get a new, verified account
+	alice := jwt.MapClaims{"sub": "alice", "email": "alice@hospital.org", "email_verified": true, "name": "Alice"}
+	result := signin(alice)
+	if result.Get("error") != "" || result.Get("token") == "" || result.Get("refresh") == "" {
+		t.Fatal("oidc signin failed:", result)
+	}
+	stored, err := datastore.UserRepo.GetFromEmail("alice@hospital.org")
+	if err != nil || !stored.Verified || stored.Name != "Alice" {
+		t.Error("unexpected user for new identity:", stored, err)
+	}
+	if _, err := request(http.MethodGet, fmt.Sprintf("/api/users/%v", stored.Uid), nil, result.Get("token"), http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	// and sign in to the same account next time, even if their email changes
+	alice["email"] = "alice@example.org"
+	if result := signin(alice); result.Get("token") == "" {
+		t.Error("second oidc signin failed:", result)
+	}
+	if _, err := datastore.UserRepo.GetFromEmail("alice@example.org"); err == nil {
+		t.Error("created a second account for the same identity")
+	}
+
+	// identities with the email of an existing user are linked to them
+	test1, _ := datastore.UserRepo.GetFromEmail("test1@tremr.com")
+	result = signin(jwt.MapClaims{"sub": "t1", "email": "test1@tremr.com", "email_verified": true})
+	if _, err := request(http.MethodGet, fmt.Sprintf("/api/users/%v", test1.Uid), nil, result.Get("token"), http.StatusOK); err != nil {
+		t.Error("identity not linked to existing user:", err)
+	}
+
+	// but only if the provider has verified the email
+	result = signin(jwt.MapClaims{"sub": "mallory", "email": "test2@tremr.com", "email_verified": false})
+	if result.Get("token") != "" || !strings.Contains(result.Get("error"), "verified") {
+		t.Error("signed in with an unverified email:", result)
+	}
+
+	// id tokens for other clients are rejected
+	result = signin(jwt.MapClaims{"sub": "bob", "email": "bob@hospital.org", "email_verified": true, "aud": "other"})
+	if result.Get("token") != "" || result.Get("error") == "" {
+		t.Error("signed in with an id token for another client:", result)
+	}
+
+	// a signin can only be finished once, and only by the browser which started it
+	authURL, cookie := login()
+	code, state, _ := idp.authorize(authURL, alice)
+	if result := callback(code, state, nil); result.Get("token") != "" {
+		t.Error("finished a signin without the state cookie")
+	}
+	if result := callback(code, state, cookie); result.Get("token") == "" {
+		t.Error("oidc signin failed:", result)
+	}
+	if result := callback(code, state, cookie); result.Get("token") != "" {
+		t.Error("finished a signin twice")
+	}
+
+	if _, err := request(http.MethodGet, "/api/auth/oidc/nobody/login", nil, "", http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	user := `{"email": "delete@tremr.com", "password": "hunter1", "name": "delete tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("delete@tremr.com")
+	body := fmt.Sprintf(`{"token": "%v"}`, mailedCode("delete@tremr.com"))
+	if _, err := request(http.MethodPost, "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("/api/users/%v", stored.Uid)
+
+	// give the user some data in every table
+	setup := []struct{ url, body, token string }{
+		{"/api/tremors", `{"resting": 40, "postural": 50, "date": "2018-11-15T00:00:00Z"}`, tokens.Token},
+		{"/api/meds", `{"name": "med", "dosage": "20 mL", "schedule": {"mo": true}, "startdate": "2018-11-15T00:00:00Z"}`,
+			tokens.Token},
+		{"/api/exercises", `{"name": "walk", "unit": "2 miles", "schedule": {"su": true}, "startdate": "2018-11-15T00:00:00Z"}`,
+			tokens.Token},
+		{"/api/users/links/out", `{"email": "test1@tremr.com"}`, tokens.Token},
+		{"/api/users/links/out", `{"email": "delete@tremr.com"}`, globalAuthTokens[0]},
+		{url + "/keys", `{"name": "watch", "scopes": ["tremors:write"]}`, tokens.Token},
+		{url + "/shares", `{"name": "neurologist"}`, tokens.Token},
+	}
+	for _, s := range setup {
+		if _, err := request(http.MethodPost, s.url, strings.NewReader(s.body), s.token, http.StatusOK); err != nil {
+			t.Fatal(s.url, err)
+		}
+	}
+
+	if _, err := request(http.MethodDelete, "/api/users/1", strings.NewReader(`{"password": "hunter1"}`),
+		tokens.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, url, strings.NewReader(`{"password": "hunter2"}`),
+		tokens.Token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if failed, _ := datastore.UserRepo.GetFromEmail("delete@tremr.com"); failed.FailedLogins != 1 {
+		t.Error("expected the wrong password to count towards the lockout, got", failed.FailedLogins)
+	}
+	if _, err := request(http.MethodDelete, url, strings.NewReader(`{"password": "hunter1"}`),
+		tokens.Token, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing owned by the user is left
+	for _, query := range []string{
+		"select count(*) from tremors where uid = ?1",
+		"select count(*) from medicines where uid = ?1",
+		"select count(*) from exercises where uid = ?1",
+		"select count(*) from tremor_samples where uid = ?1",
+		"select count(*) from tremor_scores where uid = ?1",
+		"select count(*) from links where source = ?1 or dest = ?1",
+		"select count(*) from refresh_tokens where uid = ?1",
+		"select count(*) from user_tokens where uid = ?1",
+		"select count(*) from api_keys where uid = ?1",
+		"select count(*) from shares where uid = ?1",
+		"select count(*) from org_members where uid = ?1",
+		"select count(*) from org_shares where uid = ?1",
+		"select count(*) from users where uid = ?1",
+	} {
+		var count int
+		if err := db.Get(&count, query, stored.Uid); err != nil || count != 0 {
+			t.Error("rows left after deleting user:", query, count, err)
+		}
+	}
+	// except a tombstone
+	var deleted int
+	if err := db.Get(&deleted, "select count(*) from deleted_users where uid = ?", stored.Uid); err != nil || deleted != 1 {
+		t.Error("no tombstone for deleted user:", err)
+	}
+
+	if _, err := request(http.MethodGet, "/api/tremors", nil, tokens.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if _, err := signin(user); err == nil {
+		t.Error("signed in to a deleted account")
+	}
+}
+
+func TestInvitations(t *testing.T) {
+	user := `{"email": "invite@tremr.com", "password": "hunter1", "name": "invitation tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"token": "%v"}`, mailedCode("invite@tremr.com"))
+	if _, err := request(http.MethodPost, "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invitee := globalAuthTokens[1]
+	stored, _ := datastore.UserRepo.GetFromEmail("invite@tremr.com")
+	read := fmt.Sprintf("/api/tremors?uid=%v", stored.Uid)
+
+	invite := func(expect int) {
+		t.Helper()
+		if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(`{"email": "test2@tremr.com"}`),
+			tokens.Token, expect); err != nil {
+			t.Error(err)
+		}
+	}
+	// returns the invitation from the tester, as seen by token
+	invitation := func(token string) (invitation api.Invitation) {
+		t.Helper()
+		response, err := request(http.MethodGet, "/api/users/links/invitations", nil, token, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var invitations []api.Invitation
+		json.NewDecoder(response.Body).Decode(&invitations)
+		for _, i := range invitations {
+			if i.Source == stored.Uid {
+				return i
+			}
+		}
+		t.Fatal("invitation not found")
+		return
+	}
+	respond := func(token, action string, expect int) {
+		t.Helper()
+		url := fmt.Sprintf("/api/users/links/invitations/%v/%v", invitation(tokens.Token).Lid, action)
+		if _, err := request(http.MethodPost, url, nil, token, expect); err != nil {
+			t.Error(action, err)
+		}
+	}
+
+	invite(http.StatusOK)
+	if _, ok := mail.last("test2@tremr.com"); !ok {
+		t.Error("no invitation email sent")
+	}
+	invite(http.StatusConflict)
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(`{"email": "invite@tremr.com"}`),
+		tokens.Token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+
+	// pending invitations don't grant access, and only the invitee can accept them
+	if i := invitation(invitee); i.Status != api.InvitationPending || i.Email != "invite@tremr.com" || i.Expires == nil {
+		t.Error("unexpected invitation:", i)
+	}
+	if _, err := request(http.MethodGet, read, nil, invitee, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	respond(tokens.Token, "accept", http.StatusNotFound)
+
+	// declined invitations can be sent again once the cooldown is over
+	respond(invitee, "decline", http.StatusOK)
+	if i := invitation(tokens.Token); i.Status != api.InvitationDeclined {
+		t.Error("expected a declined invitation:", i)
+	}
+	respond(invitee, "accept", http.StatusNotFound)
+	invite(http.StatusConflict)
+	declined := time.Now().Add(-api.DeclinedCooldown - time.Minute)
+	if _, err := db.Exec("update links set responded = ? where source = ?", declined, stored.Uid); err != nil {
+		t.Fatal(err)
+	}
+	invite(http.StatusOK)
+
+	// revoked ones too
+	respond(invitee, "revoke", http.StatusNotFound)
+	respond(tokens.Token, "revoke", http.StatusOK)
+	if i := invitation(invitee); i.Status != api.InvitationRevoked {
+		t.Error("expected a revoked invitation:", i)
+	}
+	invite(http.StatusOK)
+
+	// expired invitations can't be accepted
+	if _, err := db.Exec("update links set expires = ? where source = ?", time.Now().Add(-time.Minute), stored.Uid); err != nil {
+		t.Fatal(err)
+	}
+	if i := invitation(invitee); i.Status != api.InvitationExpired {
+		t.Error("expected an expired invitation:", i)
+	}
+	respond(invitee, "accept", http.StatusNotFound)
+	invite(http.StatusOK)
+
+	respond(invitee, "accept", http.StatusOK)
+	if _, err := request(http.MethodGet, read, nil, invitee, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	invite(http.StatusConflict)
+
+	// names go in the subject of invitation emails, so they can't add headers
+	user = `{"email": "inject@tremr.com", "password": "hunter1", "name": "Eve\r\nBcc: victim@tremr.com"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnlink(t *testing.T) {
+	// user 1 shares with a new user, who accepts
+	user := `{"email": "unlink@tremr.com", "password": "hunter1", "name": "unlink tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"token": "%v"}`, mailedCode("unlink@tremr.com"))
+	if _, err := request(http.MethodPost, "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("unlink@tremr.com")
+	owner := globalAuthTokens[0]
+	share := func() {
+		t.Helper()
+		if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(`{"email": "unlink@tremr.com"}`),
+			owner, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+		if err := acceptInvitations(tokens.Token); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := request(http.MethodGet, "/api/tremors?uid=1", nil, tokens.Token, http.StatusOK); err != nil {
+			t.Error(err)
+		}
+	}
+	share()
+
+	// links come with when they were made
+	response, err := request(http.MethodGet, "/api/users/links/out", nil, owner, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var links []api.LinkedUser
+	json.NewDecoder(response.Body).Decode(&links)
+	found := false
+	for _, link := range links {
+		if link.Uid == stored.Uid {
+			found = true
+			if link.Lid == 0 || link.Created == nil || link.Accepted == nil || link.Accepted.Before(*link.Created) {
+				t.Error("unexpected link metadata:", link)
+			}
+		}
+	}
+	if !found {
+		t.Error("accepted link not listed")
+	}
+
+	// the viewer can drop the link
+	if _, err := request(http.MethodDelete, "/api/users/links/in/1", nil, tokens.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors?uid=1", nil, tokens.Token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, "/api/users/links/in/1", nil, tokens.Token, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// and so can the owner
+	share()
+	url := fmt.Sprintf("/api/users/links/out/%v", stored.Uid)
+	if _, err := request(http.MethodDelete, url, nil, owner, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors?uid=1", nil, tokens.Token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, "/api/users/links/out/abc", nil, owner, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLinkScopes(t *testing.T) {
+	user := `{"email": "scopes@tremr.com", "password": "hunter1", "name": "scopes tester"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := datastore.UserRepo.GetFromEmail("scopes@tremr.com")
+	viewer := globalAuthTokens[1]
+	read := func(url string, expect int, v interface{}) {
+		t.Helper()
+		response, err := request(http.MethodGet, fmt.Sprintf(url, stored.Uid), nil, viewer, expect)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if v != nil {
+			json.NewDecoder(response.Body).Decode(v)
+		}
+	}
+
+	// ten days of tremors, and a medicine which was stopped before the shared window
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		tremor := fmt.Sprintf(`{"resting": 1, "postural": 2, "date": "%v"}`, now.AddDate(0, 0, -i).Format(time.RFC3339))
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), tokens.Token, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meds := []string{
+		fmt.Sprintf(`{"name": "old", "dosage": "1", "schedule": {"mo": true}, "startdate": "%v", "enddate": "%v"}`,
+			now.AddDate(0, 0, -30).Format(time.RFC3339), now.AddDate(0, 0, -20).Format(time.RFC3339)),
+		fmt.Sprintf(`{"name": "current", "dosage": "1", "schedule": {"mo": true}, "startdate": "%v"}`,
+			now.AddDate(0, 0, -30).Format(time.RFC3339)),
+	}
+	for _, med := range meds {
+		if _, err := request(http.MethodPost, "/api/meds", strings.NewReader(med), tokens.Token, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// bad grants
+	for _, body := range []string{
+		`{"email": "test2@tremr.com", "scopes": ["everything"]}`,
+		`{"email": "test2@tremr.com", "dataFrom": "2020-02-01T00:00:00Z", "dataTo": "2020-01-01T00:00:00Z"}`,
+		`{"email": "test2@tremr.com", "endsAt": "2020-01-01T00:00:00Z"}`,
+		`{"email": "test2@tremr.com", "days": -1}`,
+	} {
+		if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(body), tokens.Token,
+			http.StatusBadRequest); err != nil {
+			t.Error(body, err)
+		}
+	}
+
+	// share only tremors from the last four and a half days, for a month
+	from := now.Add(-108 * time.Hour).Format(time.RFC3339)
+	body := fmt.Sprintf(`{"email": "test2@tremr.com", "scopes": ["tremors"], "dataFrom": "%v", "days": 30}`, from)
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(body), tokens.Token, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if message, _ := mail.last("test2@tremr.com"); !strings.Contains(message.body, "their tremor data on Tremr") {
+		t.Error("invitation email doesn't say what is shared:", message.body)
+	}
+	if err := acceptInvitations(viewer); err != nil {
+		t.Fatal(err)
+	}
+
+	var tremors []api.Tremor
+	read("/api/tremors?uid=%v", http.StatusOK, &tremors)
+	if len(tremors) != 5 {
+		t.Error("expected 5 tremors in the shared window, got", len(tremors))
+	}
+	read("/api/tremors?uid=%v&since="+now.AddDate(0, 0, -8).Format(time.RFC3339), http.StatusOK, &tremors)
+	if len(tremors) != 5 {
+		t.Error("expected 5 tremors since in the shared window, got", len(tremors))
+	}
+	read("/api/meds?uid=%v", http.StatusForbidden, nil)
+	read("/api/exercises?uid=%v", http.StatusForbidden, nil)
+	read("/api/users/%v", http.StatusUnauthorized, nil)
+
+	// the owner can widen what is shared without a new invitation
+	url := fmt.Sprintf("/api/users/links/out/%v", 2)
+	body = fmt.Sprintf(`{"scopes": ["tremors", "meds", "profile"], "dataFrom": "%v"}`, from)
+	if _, err := request(http.MethodPut, url, strings.NewReader(body), tokens.Token, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	var medicines []api.Medicine
+	read("/api/meds?uid=%v", http.StatusOK, &medicines)
+	if len(medicines) != 1 || medicines[0].Name != "current" {
+		t.Error("expected only the current medicine, got", medicines)
+	}
+	read("/api/meds?uid=%v&date="+now.AddDate(0, 0, -6).Format(time.RFC3339), http.StatusOK, &medicines)
+	if len(medicines) != 0 {
+		t.Error("got medicines from before the shared window:", medicines)
+	}
+	var profile api.UserWithoutPassword
+	read("/api/users/%v", http.StatusOK, &profile)
+	if profile.Email != "scopes@tremr.com" {
+		t.Error("unexpected profile:", profile)
+	}
+	if _, err := request(http.MethodPut, "/api/users/links/out/9999", strings.NewReader(`{}`), tokens.Token,
+		http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// once the link ends nothing is shared, and it can be sent again
+	if _, err := db.Exec("update links set endsat = ? where source = ?", now.Add(-time.Minute), stored.Uid); err != nil {
+		t.Fatal(err)
+	}
+	read("/api/tremors?uid=%v", http.StatusForbidden, nil)
+	read("/api/users/%v", http.StatusUnauthorized, nil)
+	response, err := request(http.MethodGet, "/api/users/links/invitations", nil, tokens.Token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var invitations []api.Invitation
+	json.NewDecoder(response.Body).Decode(&invitations)
+	if len(invitations) != 1 || invitations[0].Status != api.InvitationEnded {
+		t.Error("expected an ended link:", invitations)
+	}
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(`{"email": "test2@tremr.com"}`),
+		tokens.Token, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShares(t *testing.T) {
+	owner := globalAuthTokens[0]
+	read := func(token string, expect int) (data api.SharedData) {
+		t.Helper()
+		response, err := request(http.MethodGet, "/api/share/"+token, nil, "", expect)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// the token in the url mustn't leak to the sites a report links to
+		if policy := response.Header().Get("Referrer-Policy"); policy != "no-referrer" {
+			t.Error("expected no referrer, got", policy)
+		}
+		json.NewDecoder(response.Body).Decode(&data)
+		return
+	}
+
+	for _, body := range []string{
+		`{"scopes": ["everything"]}`,
+		`{"days": 91}`,
+		`{"endsAt": "2020-01-01T00:00:00Z"}`,
+	} {
+		if _, err := request(http.MethodPost, "/api/users/1/shares", strings.NewReader(body), owner,
+			http.StatusBadRequest); err != nil {
+			t.Error(body, err)
+		}
+	}
+	if _, err := request(http.MethodPost, "/api/users/2/shares", strings.NewReader(`{}`), owner,
+		http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+
+	// share the last ten days of tremors and the user's name
+	now := time.Now()
+	body := fmt.Sprintf(`{"name": "neurologist", "scopes": ["tremors", "profile"], "dataFrom": "%v", "days": 7}`,
+		now.AddDate(0, 0, -10).Format(time.RFC3339))
+	response, err := request(http.MethodPost, "/api/users/1/shares", strings.NewReader(body), owner, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var share struct {
+		api.Share
+		Token string `json:"token"`
+	}
+	json.NewDecoder(response.Body).Decode(&share)
+	if share.Token == "" || share.EndsAt == nil || share.EndsAt.Before(now.AddDate(0, 0, 6)) {
+		t.Fatal("unexpected share:", share)
+	}
+
+	// anyone can read it without signing in
+	data := read(share.Token, http.StatusOK)
+	if data.Name != "tester 1" || len(data.Tremors) == 0 || data.Medicines != nil || data.Exercises != nil {
+		t.Error("unexpected shared data:", data.Name, len(data.Tremors), data.Medicines, data.Exercises)
+	}
+	for _, tremor := range data.Tremors {
+		if tremor.Date.Before(now.AddDate(0, 0, -10)) {
+			t.Error("shared a tremor from before the window:", tremor)
+		}
+	}
+
+	// share tokens and access tokens can't be swapped
+	if _, err := request(http.MethodGet, "/api/tremors", nil, share.Token, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	read(owner, http.StatusUnauthorized)
+	read("abc", http.StatusUnauthorized)
+
+	response, err = request(http.MethodGet, "/api/users/1/shares", nil, owner, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shares []api.Share
+	json.NewDecoder(response.Body).Decode(&shares)
+	if len(shares) != 1 || shares[0].Sid != share.Sid || shares[0].Name != "neurologist" {
+		t.Error("unexpected shares:", shares)
+	}
+
+	// revoked shares stop working straight away
+	url := fmt.Sprintf("/api/users/1/shares/%v", share.Sid)
+	if _, err := request(http.MethodDelete, url, nil, globalAuthTokens[1], http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, url, nil, owner, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, url, nil, owner, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	read(share.Token, http.StatusNotFound)
+}
+
+func TestRoster(t *testing.T) {
+	if _, err := request(http.MethodPost, "/api/auth/signup",
+		strings.NewReader(`{"email": "admin@tremr.com", "password": "hunter1", "name": "admin", "role": "admin"}`), "",
+		http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	// only admins make clinicians
+	user := `{"email": "clinician@tremr.com", "password": "hunter1", "name": "clinician", "role": "clinician"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	user = `{"email": "clinician@tremr.com", "password": "hunter1", "name": "clinician"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"token": "%v"}`, mailedCode("clinician@tremr.com"))
+	if _, err := request(http.MethodPost, "/api/auth/verify", strings.NewReader(body), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := signin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clinician, _ := datastore.UserRepo.GetFromEmail("clinician@tremr.com")
+	roleUrl := fmt.Sprintf("/api/users/%v/role", clinician.Uid)
+	if _, err := request(http.MethodPut, roleUrl, strings.NewReader(`{"role": "clinician"}`), tokens.Token,
+		http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	adminRoleUrl := fmt.Sprintf("/api/admin/users/%v/role", clinician.Uid)
+	if _, err := request(http.MethodPut, adminRoleUrl, strings.NewReader(`{"role": "clinician"}`), tokens.Token,
+		http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Exec("update users set role = 'admin' where uid = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPut, adminRoleUrl, strings.NewReader(`{"role": "admin"}`), globalAuthTokens[0],
+		http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPut, "/api/admin/users/9999/role", strings.NewReader(`{"role": "clinician"}`),
+		globalAuthTokens[0], http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPut, adminRoleUrl, strings.NewReader(`{"role": "clinician"}`), globalAuthTokens[0],
+		http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Exec("update users set role = 'patient' where uid = 1"); err != nil {
+		t.Fatal(err)
+	}
+	clinician, _ = datastore.UserRepo.GetFromEmail("clinician@tremr.com")
+	if clinician.Role != api.RoleClinician {
+		t.Error("expected a clinician, got", clinician.Role)
+	}
+
+	// users 1 and 2 share everything, and another patient shares only their medicines
+	patient := `{"email": "patient@tremr.com", "password": "hunter1", "name": "another patient"}`
+	if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(patient), "", http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	patientTokens, err := signin(patient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares := []struct{ body, token string }{
+		{`{"email": "clinician@tremr.com"}`, globalAuthTokens[0]},
+		{`{"email": "clinician@tremr.com"}`, globalAuthTokens[1]},
+		{`{"email": "clinician@tremr.com", "scopes": ["meds"]}`, patientTokens.Token},
+	}
+	for _, share := range shares {
+		if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(share.body), share.token,
+			http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := acceptInvitations(tokens.Token); err != nil {
+		t.Fatal(err)
+	}
+	// other tests count the links of users 1 and 2
+	defer func() {
+		for _, token := range globalAuthTokens {
+			url := fmt.Sprintf("/api/users/links/out/%v", clinician.Uid)
+			if _, err := request(http.MethodDelete, url, nil, token, http.StatusOK); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	roster := func(query string, expect int) (patients []api.RosterPatient) {
+		t.Helper()
+		response, err := request(http.MethodGet, "/api/clinician/roster"+query, nil, tokens.Token, expect)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		json.NewDecoder(response.Body).Decode(&patients)
+		return
+	}
+	names := func(patients []api.RosterPatient) (names []string) {
+		for _, p := range patients {
+			names = append(names, p.Name)
+		}
+		return
+	}
+
+	patients := roster("", http.StatusOK)
+	if got := names(patients); !reflect.DeepEqual(got, []string{"another patient", "tester 1", "tester 2"}) {
+		t.Fatal("unexpected roster:", got)
+	}
+	if p := patients[0]; p.Latest != nil || p.WeekResting != nil || p.LastActivity != nil {
+		t.Error("summarized tremors which aren't shared:", p)
+	}
+	if p := patients[1]; p.Latest == nil || p.WeekResting == nil || p.WeekPostural == nil || p.LastActivity == nil {
+		t.Error("expected a tremor summary:", p)
+	}
+
+	// patients without tremors come last whichever way they're sorted
+	for _, sort := range []string{"resting", "-resting", "postural", "activity", "-activity"} {
+		patients := roster("?sort="+sort, http.StatusOK)
+		if len(patients) != 3 || patients[2].Name != "another patient" {
+			t.Error("unexpected order sorting by", sort, names(patients))
+		}
+	}
+	if patients := roster("?sort=-resting", http.StatusOK); len(patients) == 3 &&
+		*patients[0].WeekResting < *patients[1].WeekResting {
+		t.Error("not sorted by resting average:", *patients[0].WeekResting, *patients[1].WeekResting)
+	}
+	if got := names(roster("?sort=-name", http.StatusOK)); !reflect.DeepEqual(got, []string{"tester 2", "tester 1", "another patient"}) {
+		t.Error("unexpected roster sorted by name:", got)
+	}
+	roster("?sort=email", http.StatusBadRequest)
+
+	// filters
+	if got := names(roster("?q=TEST2", http.StatusOK)); !reflect.DeepEqual(got, []string{"tester 2"}) {
+		t.Error("unexpected search results:", got)
+	}
+	if got := roster("?minResting=1000", http.StatusOK); len(got) != 0 {
+		t.Error("expected nobody with that high an average:", names(got))
+	}
+	if got := names(roster("?inactiveDays=30", http.StatusOK)); !reflect.DeepEqual(got, []string{"another patient"}) {
+		t.Error("unexpected inactive patients:", got)
+	}
+	roster("?minPostural=abc", http.StatusBadRequest)
+
+	// a link without tremors doesn't hide tremors shared through an organization
+	response, err := request(http.MethodPost, "/api/orgs", strings.NewReader(`{"name": "roster clinic"}`), tokens.Token,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var org api.Org
+	json.NewDecoder(response.Body).Decode(&org)
+	complete := fmt.Sprintf(`{"resting": 3, "postural": 4, "date": "%v"}`,
+		time.Now().Add(-time.Hour).Format(time.RFC3339))
+	for _, body := range []string{complete, `{"resting": 90, "postural": 90, "aborted": true}`} {
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(body), patientTokens.Token,
+			http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	share := fmt.Sprintf(`{"scopes": ["tremors"], "code": "%v"}`, org.ShareCode)
+	if _, err := request(http.MethodPut, fmt.Sprintf("/api/orgs/%v/share", org.Oid), strings.NewReader(share),
+		patientTokens.Token, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	// the aborted test is neither the latest nor averaged
+	if patients := roster("?q=another", http.StatusOK); len(patients) != 1 || patients[0].Latest == nil ||
+		patients[0].Latest.Resting != 3 || patients[0].WeekResting == nil || *patients[0].WeekResting != 3 {
+		t.Error("expected the tremor shared through the organization:", patients)
+	}
+
+	// only clinicians have a roster, and nobody can make themselves an admin
+	if _, err := request(http.MethodGet, "/api/clinician/roster", nil, globalAuthTokens[0], http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPut, roleUrl, strings.NewReader(`{"role": "admin"}`), tokens.Token,
+		http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPut, roleUrl, strings.NewReader(`{"role": "patient"}`), tokens.Token,
+		http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	roster("", http.StatusForbidden)
+}
+
+func TestOrgs(t *testing.T) {
+	var tokens []string
+	for _, email := range []string{"orgadmin@tremr.com", "orgpatient@tremr.com"} {
+		user := fmt.Sprintf(`{"email": "%v", "password": "hunter1", "name": "%v"}`, email, email)
+		if _, err := request(http.MethodPost, "/api/auth/signup", strings.NewReader(user), "", http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+		signedIn, err := signin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, signedIn.Token)
+	}
+	admin, patient, nurse, outsider := tokens[0], tokens[1], globalAuthTokens[1], globalAuthTokens[0]
+	stored, _ := datastore.UserRepo.GetFromEmail("orgpatient@tremr.com")
+	read := fmt.Sprintf("/api/tremors?uid=%v", stored.Uid)
+	if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(`{"resting": 3, "postural": 4}`), patient,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := request(http.MethodPost, "/api/orgs", strings.NewReader(`{"name": "clinic"}`), admin, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var org api.Org
+	json.NewDecoder(response.Body).Decode(&org)
+	orgUrl := fmt.Sprintf("/api/orgs/%v", org.Oid)
+	response, err = request(http.MethodGet, "/api/orgs", nil, admin, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orgs []api.OrgMembership
+	json.NewDecoder(response.Body).Decode(&orgs)
+	if len(orgs) != 1 || orgs[0].Oid != org.Oid || orgs[0].Role != api.OrgRoleAdmin {
+		t.Error("unexpected organizations:", orgs)
+	}
+
+	// only admins can add members
+	members := []struct {
+		body, token string
+		expect      int
+	}{
+		{`{"email": "test2@tremr.com", "role": "nurse"}`, outsider, http.StatusNotFound},
+		{`{"email": "test2@tremr.com", "role": "boss"}`, admin, http.StatusBadRequest},
+		{`{"email": "nobody@tremr.com", "role": "nurse"}`, admin, http.StatusBadRequest},
+		{`{"email": "test2@tremr.com", "role": "nurse"}`, admin, http.StatusOK},
+		{`{"email": "test2@tremr.com", "role": "nurse"}`, admin, http.StatusConflict},
+	}
+	for _, m := range members {
+		if _, err := request(http.MethodPost, orgUrl+"/members", strings.NewReader(m.body), m.token, m.expect); err != nil {
+			t.Error(m.body, err)
+		}
+	}
+	if _, err := request(http.MethodGet, orgUrl, nil, nurse, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, orgUrl, nil, outsider, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// once the patient shares with the organization, every member can see what they shared
+	if _, err := request(http.MethodGet, read, nil, nurse, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	// without the organization's code, patients can't tell whether it exists
+	if org.ShareCode == "" {
+		t.Fatal("expected a share code, got", org)
+	}
+	share := fmt.Sprintf(`{"scopes": ["tremors"], "code": "%v"}`, org.ShareCode)
+	for url, body := range map[string]string{
+		"/api/orgs/9999/share": share,
+		orgUrl + "/share":      `{"scopes": ["tremors"], "code": "guess"}`,
+	} {
+		if _, err := request(http.MethodPut, url, strings.NewReader(body), patient, http.StatusNotFound); err != nil {
+			t.Error(url, err)
+		}
+	}
+	if _, err := request(http.MethodPut, orgUrl+"/share", strings.NewReader(share), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	response, err = request(http.MethodGet, read, nil, nurse, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tremors []api.Tremor
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 1 {
+		t.Error("expected the patient's tremor, got", tremors)
+	}
+	if _, err := request(http.MethodGet, strings.Replace(read, "tremors", "meds", 1), nil, nurse,
+		http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, read, nil, outsider, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	response, err = request(http.MethodGet, orgUrl+"/patients", nil, nurse, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patients []api.LinkedUser
+	json.NewDecoder(response.Body).Decode(&patients)
+	if len(patients) != 1 || patients[0].Uid != stored.Uid || !reflect.DeepEqual(patients[0].Scopes, api.Scopes{"tremors"}) {
+		t.Error("unexpected patients:", patients)
+	}
+	response, err = request(http.MethodGet, fmt.Sprintf("/api/users/%v/audit?limit=1", stored.Uid), nil, patient,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []api.AuditEntry
+	json.NewDecoder(response.Body).Decode(&entries)
+	if len(entries) != 1 || entries[0].Resource != "/orgs/{oid:[0-9]+}/patients" {
+		t.Error("expected listing the patients to be audited, got", entries)
+	}
+	response, err = request(http.MethodGet, "/api/orgs/shared", nil, patient, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shared []api.OrgShare
+	json.NewDecoder(response.Body).Decode(&shared)
+	if len(shared) != 1 || shared[0].Name != "clinic" || shared[0].ShareCode != "" {
+		t.Error("unexpected organizations shared with:", shared)
+	}
+
+	// the last admin can't leave or stop being an admin
+	adminUser, _ := datastore.UserRepo.GetFromEmail("orgadmin@tremr.com")
+	adminUrl := fmt.Sprintf("%v/members/%v", orgUrl, adminUser.Uid)
+	if _, err := request(http.MethodDelete, adminUrl, nil, admin, http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPut, adminUrl, strings.NewReader(`{"role": "nurse"}`), admin,
+		http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+	// not even when two admins step down at the same time
+	if _, err := datastore.OrgRepo.SetMemberRole(org.Oid, 2, api.OrgRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, uid := range []int64{adminUser.Uid, 2} {
+		wg.Add(1)
+		go func(uid int64) {
+			defer wg.Done()
+			if _, err := datastore.OrgRepo.SetMemberRole(org.Oid, uid, api.OrgRoleNurse); err != nil &&
+				err != api.ErrLastAdmin {
+				t.Error(err)
+			}
+		}(uid)
+	}
+	wg.Wait()
+	adminRole, _ := datastore.OrgRepo.GetMemberRole(org.Oid, adminUser.Uid)
+	nurseRole, _ := datastore.OrgRepo.GetMemberRole(org.Oid, 2)
+	if adminRole != api.OrgRoleAdmin && nurseRole != api.OrgRoleAdmin {
+		t.Fatal("the organization was left without an admin")
+	}
+	datastore.OrgRepo.SetMemberRole(org.Oid, adminUser.Uid, api.OrgRoleAdmin)
+	datastore.OrgRepo.SetMemberRole(org.Oid, 2, api.OrgRoleNurse)
+
+	// removing a member takes away their access straight away
+	nurseUrl := fmt.Sprintf("%v/members/%v", orgUrl, 2)
+	if _, err := request(http.MethodDelete, adminUrl, nil, nurse, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, nurseUrl, nil, admin, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, read, nil, nurse, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, orgUrl+"/share", nil, patient, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodDelete, orgUrl+"/share", nil, patient, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// the last admin can't delete their account while the organization has other members,
+	// and the organization goes with them when it hasn't
+	if _, err := request(http.MethodPost, orgUrl+"/members", strings.NewReader(`{"email": "test2@tremr.com", "role": "nurse"}`),
+		admin, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	deleteAdmin := func(expect int) {
+		t.Helper()
+		if _, err := request(http.MethodDelete, fmt.Sprintf("/api/users/%v", adminUser.Uid),
+			strings.NewReader(`{"password": "hunter1"}`), admin, expect); err != nil {
+			t.Error(err)
+		}
+	}
+	deleteAdmin(http.StatusConflict)
+	if _, err := request(http.MethodDelete, nurseUrl, nil, admin, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	deleteAdmin(http.StatusOK)
+	var count int
+	if err := db.Get(&count, "select count(*) from orgs where oid = ?", org.Oid); err != nil || count != 0 {
+		t.Error("expected the organization to be deleted:", count, err)
+	}
+}
+
+func TestCaregivers(t *testing.T) {
+	var tokens [2]string
+	var uids [2]int64
+	for i, email := range []string{"caredfor@tremr.com", "caregiver@tremr.com"} {
+		var err error
+		if tokens[i], uids[i], err = signupVerified(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patient, caregiver := tokens[0], tokens[1]
+	tremorsUrl := fmt.Sprintf("/api/tremors?uid=%v", uids[0])
+	tremor := `{"resting": 3, "postural": 4, "date": "2020-01-01T00:00:00Z"}`
+	medicine := `{"name": "given", "dosage": "1", "schedule": {"mo": true}, "startdate": "2020-01-01T00:00:00Z"}`
+
+	// shares and organizations can't be allowed to write
+	if _, err := request(http.MethodPost, fmt.Sprintf("/api/users/%v/shares", uids[0]),
+		strings.NewReader(`{"canWrite": true}`), patient, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+
+	// a read-only link doesn't let the caregiver add anything
+	link := `{"email": "caregiver@tremr.com", "scopes": ["tremors"]}`
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(link), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if err := acceptInvitations(caregiver); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, tremorsUrl, strings.NewReader(tremor), caregiver, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+
+	// with write access they can add tremors for the patient, but only in the shared scopes
+	url := fmt.Sprintf("/api/users/links/out/%v", uids[1])
+	if _, err := request(http.MethodPut, url, strings.NewReader(`{"scopes": ["tremors"], "canWrite": true}`), patient,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, tremorsUrl, strings.NewReader(tremor), caregiver, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, fmt.Sprintf("/api/meds?uid=%v", uids[0]), strings.NewReader(medicine),
+		caregiver, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	response, err := request(http.MethodGet, "/api/tremors", nil, patient, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tremors []api.Tremor
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 2 || tremors[0].EnteredBy == nil || *tremors[0].EnteredBy != uids[1] ||
+		tremors[1].EnteredBy != nil {
+		t.Error("expected one tremor entered by the caregiver and one by the patient:", tremors)
+	}
+	response, err = request(http.MethodGet, "/api/tremors", nil, caregiver, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 0 {
+		t.Error("tremor was added for the caregiver:", tremors)
+	}
+
+	// the records still belong to the patient, so caregivers can't change them
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(
+		`{"email": "caregiver@tremr.com", "scopes": ["meds"], "canWrite": true}`), patient, http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPut, url, strings.NewReader(`{"scopes": ["meds"], "canWrite": true}`), patient,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	response, err = request(http.MethodPost, fmt.Sprintf("/api/meds?uid=%v", uids[0]), strings.NewReader(medicine),
+		caregiver, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mid int64
+	json.NewDecoder(response.Body).Decode(&mid)
+	if _, err := request(http.MethodPut, fmt.Sprintf("/api/meds/%v?uid=%v", mid, uids[0]), strings.NewReader(medicine),
+		caregiver, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+
+	// records can only be added within the shared window
+	body := `{"scopes": ["meds"], "canWrite": true, "dataTo": "2019-06-01T00:00:00Z"}`
+	if _, err := request(http.MethodPut, url, strings.NewReader(body), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, fmt.Sprintf("/api/meds?uid=%v", uids[0]), strings.NewReader(medicine),
+		caregiver, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	body = fmt.Sprintf(`{"scopes": ["tremors"], "canWrite": true, "dataFrom": "%v"}`,
+		time.Now().AddDate(0, 0, -7).Format(time.RFC3339))
+	if _, err := request(http.MethodPut, url, strings.NewReader(body), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, tremorsUrl, strings.NewReader(tremor), caregiver, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+
+	// deleting the caregiver keeps what they entered for the patient
+	if _, err := request(http.MethodDelete, fmt.Sprintf("/api/users/%v", uids[1]), strings.NewReader(
+		`{"password": "hunter1"}`), caregiver, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	response, err = request(http.MethodGet, "/api/tremors", nil, patient, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 2 || tremors[0].EnteredBy != nil {
+		t.Error("expected the caregiver's tremor to be kept without them:", tremors)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var tokens [2]string
+	var uids [2]int64
+	for i, email := range []string{"audited@tremr.com", "auditor@tremr.com"} {
+		var err error
+		if tokens[i], uids[i], err = signupVerified(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patient, viewer := tokens[0], tokens[1]
+	auditUrl := fmt.Sprintf("/api/users/%v/audit", uids[0])
+	getAudit := func(url, token string) (entries []api.AuditEntry) {
+		t.Helper()
+		response, err := request(http.MethodGet, url, nil, token, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(response.Body).Decode(&entries)
+		return
+	}
+
+	// the patient's own requests aren't shown to them
+	if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(`{"resting": 1, "postural": 2,
+		"date": "2020-01-01T00:00:00Z"}`), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if entries := getAudit(auditUrl, patient); len(entries) != 0 {
+		t.Error("expected no accesses by others:", entries)
+	}
+
+	link := `{"email": "auditor@tremr.com", "scopes": ["tremors"]}`
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(link), patient, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if err := acceptInvitations(viewer); err != nil {
+		t.Fatal(err)
+	}
+	response, err := request(http.MethodGet, fmt.Sprintf("/api/tremors?uid=%v", uids[0]), nil, viewer, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestId := response.Header().Get("X-Request-Id")
+	if _, err := request(http.MethodGet, fmt.Sprintf("/api/meds?uid=%v", uids[0]), nil, viewer,
+		http.StatusForbidden); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := getAudit(auditUrl, patient)
+	if len(entries) != 2 {
+		t.Fatal("expected 2 accesses by the viewer, got", entries)
+	}
+	denied, read := entries[0], entries[1]
+	if read.Actor == nil || *read.Actor != uids[1] || read.Subject != uids[0] || read.Action != "read" ||
+		read.Resource != "/tremors" || read.Outcome != api.AuditAllowed || read.RequestId != requestId || requestId == "" {
+		t.Error("unexpected audit entry for reading tremors:", read)
+	}
+	if denied.Resource != "/meds" || denied.Outcome != api.AuditDenied || denied.Status != http.StatusForbidden {
+		t.Error("unexpected audit entry for reading medicines:", denied)
+	}
+	if entries := getAudit(auditUrl+"?outcome=denied", patient); len(entries) != 1 {
+		t.Error("expected 1 denied access, got", entries)
+	}
+	if entries := getAudit(auditUrl+"?limit=1&before="+fmt.Sprint(denied.Aid), patient); len(entries) != 1 ||
+		entries[0].Aid != read.Aid {
+		t.Error("expected the entry before the denied one, got", entries)
+	}
+	if _, err := request(http.MethodGet, auditUrl+"?limit=0", nil, patient, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, auditUrl, nil, viewer, http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+
+	// only admins can search everything
+	adminUrl := fmt.Sprintf("/api/admin/audit?actor=%v&subject=%v&action=read", uids[1], uids[0])
+	if _, err := request(http.MethodGet, adminUrl, nil, viewer, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Exec("update users set role = 'admin' where uid = ?", uids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if entries := getAudit(adminUrl, viewer); len(entries) != 2 {
+		t.Error("expected the viewer's 2 reads of the patient's data, got", entries)
+	}
+	if entries := getAudit(fmt.Sprintf("/api/admin/audit?subject=%v&action=create&limit=2", uids[0]), viewer); len(entries) != 2 ||
+		entries[1].Resource != "/tremors" || entries[0].Resource != "/users/links/out" {
+		t.Error("expected the patient's tremor and link, got", entries)
+	}
+
+	// resources are routes, so ids in the url aren't stored
+	if _, err := request(http.MethodGet, "/api/tremors/1234/samples", nil, patient, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	if entries := getAudit(fmt.Sprintf("/api/admin/audit?actor=%v&limit=1", uids[0]), viewer); len(entries) != 1 ||
+		entries[0].Resource != "/tremors/{tid:[0-9]+}/samples" {
+		t.Error("expected the route of the samples, got", entries)
+	}
+
+	// requests without a valid token which aren't for anyone's data in particular are only logged, anyone
+	// could fill the log with them
+	before := getAudit("/api/admin/audit?limit=1", viewer)
+	if _, err := request(http.MethodGet, "/api/tremors", nil, "abc", http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if entries := getAudit("/api/admin/audit?limit=2", viewer); len(entries) != 2 || len(before) != 1 ||
+		entries[1].Aid != before[0].Aid {
+		t.Error("expected the unauthorized request not to be recorded, got", entries)
+	}
+
+	// signins are recorded, and failed ones show up for the user as someone else trying their account
+	body := `{"email": "audited@tremr.com", "password": "wrong"}`
+	if _, err := request(http.MethodPost, "/api/auth/signin", strings.NewReader(body), "", http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+	if entries := getAudit(auditUrl+"?limit=1", patient); len(entries) != 1 || entries[0].Actor != nil ||
+		entries[0].Resource != "/auth/signin" || entries[0].Outcome != api.AuditDenied {
+		t.Error("expected the failed signin, got", entries)
+	}
+
+	// and nobody can change the log
+	if _, err := db.Exec("delete from audit_log"); err == nil {
+		t.Error("deleted from the audit log")
+	}
+	if _, err := db.Exec("update audit_log set actor = null"); err == nil {
+		t.Error("changed the audit log")
+	}
+}
+
+func TestTremorPages(t *testing.T) {
+	var tokens [2]string
+	var uids [2]int64
+	for i, email := range []string{"paged@tremr.com", "pageviewer@tremr.com"} {
+		var err error
+		if tokens[i], uids[i], err = signupVerified(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner, viewer := tokens[0], tokens[1]
+
+	// a tremor a day for a week, with two on the third day at the same time
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, day := range []int{0, 1, 2, 2, 3, 4, 5, 6} {
+		tremor := fmt.Sprintf(`{"resting": %v, "postural": 1, "date": "%v"}`, day, start.AddDate(0, 0, day).Format(time.RFC3339))
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), owner, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readAll := func(url, token string) (tremors []api.Tremor, pages int) {
+		t.Helper()
+		cursor := ""
+		for {
+			response, err := request(http.MethodGet, url+"&cursor="+cursor, nil, token, http.StatusOK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page api.TremorPage
+			json.NewDecoder(response.Body).Decode(&page)
+			tremors = append(tremors, page.Tremors...)
+			pages++
+			if page.Next == nil {
+				return
+			}
+			cursor = *page.Next
+		}
+	}
+
+	tremors, pages := readAll("/api/tremors?limit=3", owner)
+	if len(tremors) != 8 || pages != 3 {
+		t.Fatalf("expected 8 tremors on 3 pages, got %v on %v", len(tremors), pages)
+	}
+	for i := 1; i < len(tremors); i++ {
+		if tremors[i].Date.Before(tremors[i-1].Date) || tremors[i].TID == tremors[i-1].TID {
+			t.Error("tremors out of order:", tremors[i-1], tremors[i])
+		}
+	}
+	from, to := start.AddDate(0, 0, 2).Format(time.RFC3339), start.AddDate(0, 0, 4).Format(time.RFC3339)
+	if tremors, _ := readAll("/api/tremors?limit=2&from="+from+"&to="+to, owner); len(tremors) != 4 {
+		t.Error("expected 4 tremors from the third to the fifth day, got", tremors)
+	}
+	for _, url := range []string{"/api/tremors?cursor=nonsense", "/api/tremors?limit=0", "/api/tremors?from=" + to + "&to=" + from} {
+		if _, err := request(http.MethodGet, url, nil, owner, http.StatusBadRequest); err != nil {
+			t.Error(url, err)
+		}
+	}
+
+	// shared pages only have tremors in the shared window
+	link := fmt.Sprintf(`{"email": "pageviewer@tremr.com", "scopes": ["tremors"], "dataFrom": "%v"}`, to)
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(link), owner, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if err := acceptInvitations(viewer); err != nil {
+		t.Fatal(err)
+	}
+	tremors, pages = readAll(fmt.Sprintf("/api/tremors?uid=%v&limit=2", uids[0]), viewer)
+	if len(tremors) != 3 || pages != 2 {
+		t.Errorf("expected 3 shared tremors on 2 pages, got %v on %v", tremors, pages)
+	}
+	if tremors, _ := readAll(fmt.Sprintf("/api/tremors?uid=%v&to=%v", uids[0], from), viewer); len(tremors) != 0 {
+		t.Error("got tremors from outside the shared window:", tremors)
+	}
+}
+
+func TestTremorAggregate(t *testing.T) {
+	var tokens [2]string
+	var uids [2]int64
+	for i, email := range []string{"aggregated@tremr.com", "aggregateviewer@tremr.com"} {
+		var err error
+		if tokens[i], uids[i], err = signupVerified(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner, viewer := tokens[0], tokens[1]
+	for _, tremor := range []string{
+		// late on Sunday the 1st in Vancouver
+		`{"resting": 2, "postural": 10, "date": "2020-03-02T07:00:00Z"}`,
+		`{"resting": 4, "postural": 20, "date": "2020-03-02T09:00:00Z"}`,
+		`{"resting": 6, "postural": 30, "date": "2020-03-02T20:00:00Z"}`,
+		`{"resting": 10, "postural": 40, "date": "2020-04-01T12:00:00Z"}`,
+	} {
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), owner, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aggregate := func(query, token string) (buckets []api.TremorBucket) {
+		t.Helper()
+		response, err := request(http.MethodGet, "/api/tremors/aggregate?"+query, nil, token, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(response.Body).Decode(&buckets)
+		return
+	}
+
+	buckets := aggregate("bucket=day", owner)
+	if len(buckets) != 2 || buckets[0].Count != 3 || buckets[1].Count != 1 {
+		t.Fatal("expected 2 days in UTC, got", buckets)
+	}
+	resting := buckets[0].Resting
+	if resting.Mean != 4 || resting.Median != 4 || resting.Min != 2 || resting.Max != 6 ||
+		math.Abs(resting.StdDev-math.Sqrt(8.0/3)) > 1e-9 || buckets[0].Postural.Mean != 20 {
+		t.Error("unexpected statistics:", buckets[0])
+	}
+
+	buckets = aggregate("bucket=day&tz=America/Vancouver", owner)
+	if len(buckets) != 3 || buckets[0].Count != 1 || buckets[1].Count != 2 || buckets[1].Resting.Median != 5 {
+		t.Fatal("expected 3 days in Vancouver, got", buckets)
+	}
+	if start := buckets[0].Start.Format(time.RFC3339); start != "2020-03-01T00:00:00-08:00" {
+		t.Error("expected the first day to start at midnight in Vancouver, got", start)
+	}
+	// after daylight saving time started on March 8th
+	if start := buckets[2].Start.Format(time.RFC3339); start != "2020-04-01T00:00:00-07:00" {
+		t.Error("expected the last day to start at midnight in summer time, got", start)
+	}
+	if buckets := aggregate("bucket=week&tz=America/Vancouver", owner); len(buckets) != 3 ||
+		buckets[0].Start.Weekday() != time.Monday {
+		t.Error("expected 3 weeks starting on Monday in Vancouver, got", buckets)
+	}
+	if buckets := aggregate("bucket=month&from=2020-03-02T08:00:00Z", owner); len(buckets) != 2 || buckets[0].Count != 2 {
+		t.Error("expected 2 tremors in March from the 2nd, got", buckets)
+	}
+	for _, query := range []string{"bucket=hour", "bucket=day&tz=Nowhere/Special", "bucket=day&from=yesterday"} {
+		if _, err := request(http.MethodGet, "/api/tremors/aggregate?"+query, nil, owner, http.StatusBadRequest); err != nil {
+			t.Error(query, err)
+		}
+	}
+
+	// shared data is only aggregated in the shared window
+	link := `{"email": "aggregateviewer@tremr.com", "scopes": ["tremors"], "dataTo": "2020-03-31T00:00:00Z"}`
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(link), owner, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if err := acceptInvitations(viewer); err != nil {
+		t.Fatal(err)
+	}
+	if buckets := aggregate(fmt.Sprintf("bucket=month&uid=%v", uids[0]), viewer); len(buckets) != 1 || buckets[0].Count != 3 {
+		t.Error("expected only March to be shared, got", buckets)
+	}
+	if buckets := aggregate(fmt.Sprintf("bucket=month&uid=%v&from=2020-04-01T00:00:00Z", uids[0]), viewer); len(buckets) != 0 {
+		t.Error("got tremors from outside the shared window:", buckets)
+	}
+}
+
+func TestTremorSeries(t *testing.T) {
+	token, _, err := signupVerified("series@tremr.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a hundred flat tremors with one spike in each score
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		resting, postural := 10, 20
+		if i == 37 {
+			resting = 90
+		} else if i == 62 {
+			postural = 95
+		}
+		tremor := fmt.Sprintf(`{"resting": %v, "postural": %v, "date": "%v"}`, resting, postural,
+			start.Add(time.Duration(i)*time.Hour).Format(time.RFC3339))
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), token, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	series := func(query string) (series api.TremorSeries) {
+		t.Helper()
+		response, err := request(http.MethodGet, "/api/tremors/series?"+query, nil, token, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(response.Body).Decode(&series)
+		return
+	}
+
+	downsampled := series("points=10")
+	for name, points := range map[string][]api.SeriesPoint{"resting": downsampled.Resting, "postural": downsampled.Postural} {
+		if len(points) != 10 || !points[0].Date.Equal(start) || !points[9].Date.Equal(start.Add(99*time.Hour)) {
+			t.Fatal("expected 10 points from the first to the last tremor, got", name, points)
+		}
+		max := 0.0
+		for i, point := range points {
+			if i > 0 && !point.Date.After(points[i-1].Date) {
+				t.Error("points out of order:", name, points)
+			}
+			max = math.Max(max, point.Value)
+		}
+		if max < 90 {
+			t.Error("the spike was lost from", name, points)
+		}
+	}
+	if all := series("points=500"); len(all.Resting) != 100 || len(all.Postural) != 100 {
+		t.Error("expected every tremor when there are fewer than the points, got", len(all.Resting))
+	}
+	if window := series("from=2020-01-02T00:00:00Z"); len(window.Resting) != 76 {
+		t.Error("expected 76 tremors from the second day, got", len(window.Resting))
+	}
+	if _, err := request(http.MethodGet, "/api/tremors/series?points=2", nil, token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSamples(t *testing.T) {
+	var tokens [2]string
+	var uids [2]int64
+	for i, email := range []string{"sampled@tremr.com", "sampleviewer@tremr.com"} {
+		var err error
+		if tokens[i], uids[i], err = signupVerified(email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner, viewer := tokens[0], tokens[1]
+	addTremor := func() string {
+		t.Helper()
+		tremor := `{"resting": 30, "postural": 40, "date": "2020-05-01T00:00:00Z"}`
+		response, err := request(http.MethodPost, "/api/tremors", strings.NewReader(tremor), owner, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.Body.String()
+	}
+	tid, other := addTremor(), addTremor()
+	url := "/api/tremors/" + tid + "/samples"
+
+	// two seconds of a 5Hz tremor at 100Hz
+	var samples api.Samples
+	samples.Rate = 100
+	for i := 0; i < 200; i++ {
+		wave := math.Sin(2 * math.Pi * 5 * float64(i) / samples.Rate)
+		samples.Accel = append(samples.Accel, [3]float64{wave, 0.5 * wave, 9.81})
+		samples.Gyro = append(samples.Gyro, [3]float64{0.1 * wave, 0, -0.2})
+	}
+	body, _ := json.Marshal(samples)
+	if _, err := request(http.MethodPost, url, bytes.NewReader(body), owner, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodPost, url, bytes.NewReader(body), owner, http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+	var size int
+	if err := db.Get(&size, "select length(accel) from tremor_samples where tid = ?", tid); err != nil || size > 200*3*2 {
+		t.Error("expected samples to be stored in at most 2 bytes each, got", size, err)
+	}
+
+	response, err := request(http.MethodGet, url, nil, owner, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored api.Samples
+	json.NewDecoder(response.Body).Decode(&stored)
+	if stored.Rate != 100 || len(stored.Accel) != 200 || len(stored.Gyro) != 200 {
+		t.Fatal("unexpected samples:", stored.Rate, len(stored.Accel), len(stored.Gyro))
+	}
+	for i := range samples.Accel {
+		for axis := 0; axis < 3; axis++ {
+			if math.Abs(stored.Accel[i][axis]-samples.Accel[i][axis]) > 0.0005 ||
+				math.Abs(stored.Gyro[i][axis]-samples.Gyro[i][axis]) > 0.0005 {
+				t.Fatal("sample changed:", i, samples.Accel[i], stored.Accel[i], samples.Gyro[i], stored.Gyro[i])
+			}
+		}
+	}
+
+	otherUrl := "/api/tremors/" + other + "/samples"
+	for _, bad := range []string{
+		`{"rate": 0, "accel": [[1, 2, 3]]}`,
+		`{"rate": 100, "accel": []}`,
+		`{"rate": 100, "accel": [[1, 2, 3]], "gyro": [[1, 2, 3], [1, 2, 3]]}`,
+		`{"rate": 100, "accel": [[1, 2, 1e9]]}`,
+	} {
+		if _, err := request(http.MethodPost, otherUrl, strings.NewReader(bad), owner, http.StatusBadRequest); err != nil {
+			t.Error(bad, err)
+		}
+	}
+	if _, err := request(http.MethodGet, otherUrl, nil, owner, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, "/api/tremors/999999/samples", nil, owner, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+
+	// others can only download them if tremors are shared with them
+	sharedUrl := fmt.Sprintf("%v?uid=%v", url, uids[0])
+	if _, err := request(http.MethodGet, url, nil, viewer, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodGet, sharedUrl, nil, viewer, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	link := `{"email": "sampleviewer@tremr.com", "scopes": ["tremors"]}`
+	if _, err := request(http.MethodPost, "/api/users/links/out", strings.NewReader(link), owner, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	if err := acceptInvitations(viewer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(http.MethodGet, sharedUrl, nil, viewer, http.StatusOK); err != nil {
+		t.Error(err)
+	}
+	if _, err := request(http.MethodPost, fmt.Sprintf("%v?uid=%v", otherUrl, uids[0]), bytes.NewReader(body), viewer,
+		http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+}
+
+// helper method to make seconds of accelerometer samples at 100Hz, a tremor at frequency with amplitude
+// in m/s² along x and y, on top of gravity
+func tremorSamples(seconds, frequency, amplitude float64) (samples [][3]float64) {
+	for i := 0; i < int(seconds*100); i++ {
+		wave := amplitude * math.Sin(2*math.Pi*frequency*float64(i)/100)
+		samples = append(samples, [3]float64{0.6 * wave, 0.8 * wave, 9.81})
+	}
+	return
+}
+
+func TestScoring(t *testing.T) {
+	// a 3cm tremor at 5Hz
+	amplitude := 0.03 * math.Pow(2*math.Pi*5, 2)
+	analysis, err := scoring.Analyze(100, tremorSamples(10, 5, amplitude))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(analysis.Frequency-5) > 0.1 || math.Abs(analysis.Acceleration-amplitude)/amplitude > 0.05 ||
+		math.Abs(analysis.Displacement-3) > 0.15 || analysis.Score < 44 || analysis.Score > 48 {
+		t.Error("unexpected analysis of a 3cm tremor at 5Hz:", analysis)
+	}
+	if again, _ := scoring.Analyze(100, tremorSamples(10, 5, amplitude)); again != analysis {
+		t.Error("scoring isn't deterministic:", analysis, again)
+	}
+	if still, _ := scoring.Analyze(100, tremorSamples(10, 5, 0)); still.Score != 0 {
+		t.Error("expected a score of 0 without a tremor, got", still)
+	}
+	// outside the band doesn't count
+	if slow, _ := scoring.Analyze(100, tremorSamples(10, 1, amplitude)); slow.Score >= analysis.Score/2 {
+		t.Error("expected a slow movement to score low, got", slow)
+	}
+	if _, err := scoring.Analyze(100, tremorSamples(1, 5, amplitude)); err != scoring.ErrTooShort {
+		t.Error("expected a one second test to be too short, got", err)
+	}
+	if _, err := scoring.Analyze(20, tremorSamples(10, 5, amplitude)); err != scoring.ErrRate {
+		t.Error("expected 20Hz to be too slow, got", err)
+	}
+
+	// tremors can be uploaded with just their samples, the server scores them
+	token, _, err := signupVerified("scored@tremr.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	posturalFrom := 500
+	samples := api.Samples{Rate: 100, PosturalFrom: &posturalFrom,
+		Accel: append(tremorSamples(5, 5, 2), tremorSamples(5, 8, 40)...)}
+	upload := struct {
+		api.Tremor
+		Samples api.Samples `json:"samples"`
+	}{api.Tremor{Resting: 99, Postural: 99, Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)}, samples}
+	body, _ := json.Marshal(upload)
+	response, err := request(http.MethodPost, "/api/tremors", bytes.NewReader(body), token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid := response.Body.String()
+	response, err = request(http.MethodGet, "/api/tremors/"+tid+"/analysis", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scored api.TremorAnalysis
+	json.NewDecoder(response.Body).Decode(&scored)
+	if scored.Algorithm != scoring.Version || math.Abs(scored.Resting.Frequency-5) > 0.2 ||
+		math.Abs(scored.Postural.Frequency-8) > 0.2 || scored.Postural.Score <= scored.Resting.Score {
+		t.Error("unexpected analysis:", scored)
+	}
+	response, err = request(http.MethodGet, "/api/tremors", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tremors []api.Tremor
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 1 || tremors[0].Resting != scored.Resting.Score || tremors[0].Postural != scored.Postural.Score ||
+		tremors[0].Algorithm == nil || *tremors[0].Algorithm != scoring.Version {
+		t.Error("expected the server's scores, got", tremors)
+	}
+
+	samples.PosturalFrom = nil
+	upload.Samples = samples
+	body, _ = json.Marshal(upload)
+	if _, err := request(http.MethodPost, "/api/tremors", bytes.NewReader(body), token, http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRescore(t *testing.T) {
+	// a tremor scored by the phone, with samples uploaded afterwards
+	token, uid, err := signupVerified("rescore@tremr.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"resting": 10, "postural": 20, "date": "2020-07-01T00:00:00Z"}`
+	response, err := request(http.MethodPost, "/api/tremors", strings.NewReader(body), token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid := response.Body.String()
+	posturalFrom := 500
+	samples, _ := json.Marshal(api.Samples{Rate: 100, PosturalFrom: &posturalFrom,
+		Accel: append(tremorSamples(5, 5, 2), tremorSamples(5, 8, 40)...)})
+	if _, err := request(http.MethodPost, "/api/tremors/"+tid+"/samples", bytes.NewReader(samples), token,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	response, err = request(http.MethodGet, "/api/tremors/"+tid+"/analysis", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var analysis api.TremorAnalysis
+	json.NewDecoder(response.Body).Decode(&analysis)
+
+	// only admins can rescore
+	if _, err := request(http.MethodPost, "/api/admin/rescore", nil, token, http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.Exec("update users set role = 'admin' where uid = ?", uid); err != nil {
+		t.Fatal(err)
+	}
+	response, err = request(http.MethodPost, "/api/admin/rescore", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job api.RescoreJob
+	json.NewDecoder(response.Body).Decode(&job)
+	rescorer.Wait()
+
+	getJob := func(jid int64) (job api.RescoreJob) {
+		response, err := request(http.MethodGet, fmt.Sprintf("/api/admin/rescore/%v", jid), nil, token, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(response.Body).Decode(&job)
+		return
+	}
+	job = getJob(job.Jid)
+	if job.Status != api.JobDone || job.Algorithm != scoring.Version || job.LastTid != job.MaxTid ||
+		job.Rescored == 0 || job.Rescored+job.Skipped != job.Total {
+		t.Error("unexpected job:", job)
+	}
+
+	// the new scores are kept beside the phone's
+	id, _ := strconv.ParseInt(tid, 10, 64)
+	url := fmt.Sprintf("/api/admin/rescore/%v/results?after=%v&limit=1", job.Jid, id-1)
+	response, err = request(http.MethodGet, url, nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []api.RescoreResult
+	json.NewDecoder(response.Body).Decode(&results)
+	if len(results) != 1 || results[0].TID != id || results[0].UID != uid || results[0].Original.Algorithm != nil ||
+		results[0].Original.Resting != 10 || results[0].Original.Postural != 20 ||
+		results[0].Rescored.Resting != analysis.Resting.Score || results[0].Rescored.Postural != analysis.Postural.Score {
+		t.Error("unexpected results:", results)
+	}
+	response, err = request(http.MethodGet, "/api/tremors", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tremors []api.Tremor
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 1 || tremors[0].Resting != 10 || tremors[0].Postural != 20 || tremors[0].Algorithm != nil {
+		t.Error("expected the original scores to be kept, got", tremors)
+	}
+
+	// jobs which were running when the server stopped carry on where they were, unless the algorithm changed
+	now := time.Now()
+	interrupted := api.RescoreJob{Algorithm: scoring.Version, Status: api.JobRunning, Created: now, Updated: now,
+		MaxTid: id, LastTid: id - 1, Total: 1}
+	outdated := api.RescoreJob{Algorithm: "old", Status: api.JobRunning, Created: now, Updated: now, MaxTid: id, Total: 1}
+	for _, job := range []*api.RescoreJob{&interrupted, &outdated} {
+		if err := datastore.RescoreRepo.AddJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restarted := api.NewRescorer(datastore.RescoreRepo, datastore.SampleRepo)
+	if err := restarted.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Wait()
+	if job := getJob(interrupted.Jid); job.Status != api.JobDone || job.Rescored != 1 || job.LastTid != id {
+		t.Error("expected the interrupted job to finish, got", job)
+	}
+	if job := getJob(outdated.Jid); job.Status != api.JobFailed || job.Error == nil || job.Rescored != 0 {
+		t.Error("expected the outdated job to fail, got", job)
+	}
+
+	// samples deleted with their user while the job runs are skipped
+	deleted := api.RescoreJob{Algorithm: scoring.Version, Status: api.JobRunning, Created: now, Updated: now,
+		MaxTid: id, LastTid: id - 1, Total: 1}
+	if err := datastore.RescoreRepo.AddJob(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	restarted = api.NewRescorer(datastore.RescoreRepo, deletedSamples{datastore.SampleRepo})
+	if err := restarted.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Wait()
+	if job := getJob(deleted.Jid); job.Status != api.JobDone || job.Skipped != 1 || job.LastTid != id {
+		t.Error("expected the deleted samples to be skipped, got", job)
+	}
+
+	response, err = request(http.MethodGet, "/api/admin/rescore", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []api.RescoreJob
+	json.NewDecoder(response.Body).Decode(&jobs)
+	if len(jobs) != 4 || jobs[0].Jid != deleted.Jid {
+		t.Error("expected every job, newest first, got", jobs)
+	}
+
+	if _, err := request(http.MethodGet, "/api/admin/rescore/1000", nil, token, http.StatusNotFound); err != nil {
+		t.Error(err)
+	}
+	url = fmt.Sprintf("/api/admin/rescore/%v", job.Jid)
+	if _, err := request(http.MethodDelete, url, nil, token, http.StatusConflict); err != nil {
+		t.Error(err)
+	}
+}
+
+// deletedSamples acts as though every tremor's user was deleted after the rescore job found it
+type deletedSamples struct {
+	api.SampleRepo
+}
+
+func (deletedSamples) GetSamples(tid int64) (api.Samples, error) {
+	return api.Samples{}, api.ErrNoSamples
+}
+
+func TestTremorMetadata(t *testing.T) {
+	token, _, err := signupVerified("metadata@tremr.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"resting": 10, "postural": 20, "date": "2020-08-01T08:00:00Z", "hand": "left", "device": "Pixel 4",
+			"appVersion": "2.1.0", "aborted": true, "note": "had coffee", "tags": ["coffee", "morning"]}`,
+		`{"resting": 30, "postural": 40, "date": "2020-08-01T20:00:00Z", "hand": "right", "tags": ["coffee"]}`,
+		`{"resting": 0, "postural": 100, "date": "2020-08-02T08:00:00Z"}`,
+	} {
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(body), token, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, body := range []string{
+		`{"resting": 101, "postural": 20}`,
+		`{"resting": 10, "postural": -1}`,
+		`{"resting": 10, "postural": 20, "hand": "both"}`,
+		`{"resting": 10, "postural": 20, "tags": ["two words"]}`,
+		`{"resting": 10, "postural": 20, "tags": [""]}`,
+		`{"resting": 10, "postural": 20, "note": "` + strings.Repeat("a", 1001) + `"}`,
+		`{"resting": 10, "postural": 20, "tags": ["` + strings.Repeat(`a", "`, 20) + `a"]}`,
+	} {
+		if _, err := request(http.MethodPost, "/api/tremors", strings.NewReader(body), token,
+			http.StatusBadRequest); err != nil {
+			t.Error(body, err)
+		}
+	}
+
+	response, err := request(http.MethodGet, "/api/tremors", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tremors []api.Tremor
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 3 {
+		t.Fatal("expected 3 tremors, got", tremors)
+	}
+	first := tremors[0]
+	if first.Hand == nil || *first.Hand != api.HandLeft || first.Device == nil || *first.Device != "Pixel 4" ||
+		first.AppVersion == nil || *first.AppVersion != "2.1.0" || !first.Aborted || first.Note == nil ||
+		*first.Note != "had coffee" || len(first.Tags) != 2 || first.Tags[0] != "coffee" || first.Tags[1] != "morning" {
+		t.Error("unexpected metadata:", first)
+	}
+	if last := tremors[2]; last.Hand != nil || last.Device != nil || last.Aborted || last.Note != nil ||
+		len(last.Tags) != 0 {
+		t.Error("expected no metadata, got", last)
+	}
+
+	// the GET endpoints filter by hand and by whole tags, without turning the list into a page
+	for url, expected := range map[string]int{
+		"/api/tremors?hand=left":              1,
+		"/api/tremors?tag=coffee":             2,
+		"/api/tremors?tag=cof":                0,
+		"/api/tremors?hand=right&tag=morning": 0,
+	} {
+		response, err := request(http.MethodGet, url, nil, token, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var filtered []api.Tremor
+		if err := json.NewDecoder(response.Body).Decode(&filtered); err != nil || len(filtered) != expected {
+			t.Error(url, "expected", expected, "tremors, got", filtered, err)
+		}
+	}
+	response, err = request(http.MethodGet, "/api/tremors?tag=coffee&limit=1&from=2020-08-01T12:00:00Z", nil, token,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page api.TremorPage
+	json.NewDecoder(response.Body).Decode(&page)
+	if len(page.Tremors) != 1 {
+		t.Error("expected a page of 1 tremor, got", page.Tremors)
+	}
+	response, err = request(http.MethodGet, "/api/tremors?since=2020-01-01T00:00:00Z&tag=morning", nil, token,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tremors = nil
+	json.NewDecoder(response.Body).Decode(&tremors)
+	if len(tremors) != 1 || tremors[0].Resting != 10 {
+		t.Error("expected the morning tremor, got", tremors)
+	}
+	response, err = request(http.MethodGet, "/api/tremors/aggregate?bucket=day&tag=coffee", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the aborted test is left out
+	var buckets []api.TremorBucket
+	json.NewDecoder(response.Body).Decode(&buckets)
+	if len(buckets) != 1 || buckets[0].Count != 1 || buckets[0].Resting.Mean != 30 {
+		t.Error("unexpected buckets:", buckets)
+	}
+	response, err = request(http.MethodGet, "/api/tremors/series?hand=right", nil, token, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series api.TremorSeries
+	json.NewDecoder(response.Body).Decode(&series)
+	if len(series.Resting) != 1 || series.Resting[0].Value != 30 {
+		t.Error("unexpected series:", series)
+	}
+	for _, url := range []string{"/api/tremors?hand=both", "/api/tremors/series?tag=a%20b"} {
+		if _, err := request(http.MethodGet, url, nil, token, http.StatusBadRequest); err != nil {
+			t.Error(url, err)
+		}
+	}
+}
+
+func TestLinkMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tremr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacy, err := sqlx.Open("sqlite3", filepath.Join(dir, "legacy.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+
+	// the schema from before invitations, which allowed duplicate links
+	_, err = legacy.Exec(`create table users(
+			uid INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			name TEXT NOT NULL
+		);
+		create table links(source INTEGER NOT NULL, dest INTEGER NOT NULL);
+		insert into users(email, password, name) values("a@tremr.com", "x", "a"), ("b@tremr.com", "x", "b");
+		insert into links(source, dest) values(1, 2), (1, 2), (2, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := database.GetDataStore(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// existing links still work, once each, and share everything
+	links, err := ds.UserRepo.GetIncomingLinks(2)
+	if err != nil || len(links) != 1 || links[0].Uid != 1 {
+		t.Error("unexpected links after migration:", links, err)
+	} else if len(links[0].Scopes) != 4 || links[0].EndsAt != nil {
+		t.Error("unexpected grant after migration:", links[0].Grant)
+	}
+	if _, err := legacy.Exec("insert into links(source, dest) values(1, 2)"); err == nil {
+		t.Error("inserted a duplicate link")
+	}
+	if err := ds.UserRepo.AddLink(1, 2, time.Now(), api.Grant{}); err != api.ErrLinkExists {
+		t.Error("expected ErrLinkExists, got", err)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	response, err := request(http.MethodGet, "/api/users/1", nil, globalAuthTokens[0], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	var user api.User
+	json.NewDecoder(response.Body).Decode(&user)
+	if user.Password != "" {
+		t.Error("GET /api/users/1 returned the users password!")
+	}
+	if _, err = request(http.MethodGet, "/api/users/2", nil, globalAuthTokens[0], http.StatusUnauthorized); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSharingPermissions(t *testing.T) {
+	// user 2 has not shared with user 1 yet, so every read of user 2's data must be forbidden
+	urls := []string{
+		"/api/tremors?uid=2",
+		"/api/tremors?uid=2&since=" + time.Now().AddDate(0, 0, -6).Format(time.RFC3339),
+		"/api/meds?uid=2",
+		"/api/meds?uid=2&date=2018-11-27T00:00:00Z",
+		"/api/meds/1?uid=2",
+		"/api/exercises?uid=2",
+		"/api/exercises?uid=2&date=2018-11-27T00:00:00Z",
+		"/api/exercises/1?uid=2",
+	}
+	for _, url := range urls {
+		if _, err := request(http.MethodGet, url, nil, globalAuthTokens[0], http.StatusForbidden); err != nil {
+			t.Error(url, err)
+		}
+	}
+
+	// reading our own data with an explicit uid is fine
+	if _, err := request(http.MethodGet, "/api/tremors?uid=1", nil, globalAuthTokens[0], http.StatusOK); err != nil {
+		t.Error(err)
+	}
+
+	// bad uid
+	if _, err := request(http.MethodGet, "/api/tremors?uid=abc", nil, globalAuthTokens[0], http.StatusBadRequest); err != nil {
+		t.Error(err)
+	}
+
+	// can never write to another user's data
+	if _, err := request(http.MethodPost, "/api/tremors?uid=2", strings.NewReader(`{"resting": 1, "postural": 2}`),
+		globalAuthTokens[0], http.StatusForbidden); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	// test add link from user 1 to user 2
+	_, err := request(http.MethodPost, "/api/users/links/out",
+		strings.NewReader(`{"email":"test2@tremr.com"}`), globalAuthTokens[0], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// test add link from user 2 to user 1
+	if _, err := request(http.MethodPost, "/api/users/links/out",
+		strings.NewReader(`{"email":"test1@tremr.com"}`), globalAuthTokens[1], http.StatusOK); err != nil {
+		t.Error(err)
+	}
+
+	// links only count once the other user accepts them
+	for _, token := range globalAuthTokens {
+		if err := acceptInvitations(token); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// test get user 1 incoming links
+	response, err := request(http.MethodGet, "/api/users/links/in", nil, globalAuthTokens[0], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	var users []api.UserWithoutPassword
+	json.NewDecoder(response.Body).Decode(&users)
+	if len(users) != 1 || users[0].Email != "test2@tremr.com" {
+		t.Error("failed to get incoming links for user 1")
+	}
+
+	// test get user 2 outgoing links
+	response, err = request(http.MethodGet, "/api/users/links/out", nil, globalAuthTokens[1], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	json.NewDecoder(response.Body).Decode(&users)
+	if len(users) != 1 || users[0].Email != "test1@tremr.com" {
+		t.Error("failed to get outgoing links for user 2")
+	}
+
+	// test getting user 2 tremors while logged in as user 1
+	var tremors1 []api.Tremor
+	var tremors2 []api.Tremor
+	response, err = request(http.MethodGet, "/api/tremors?uid=2", nil, globalAuthTokens[0], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	json.NewDecoder(response.Body).Decode(&tremors1)
+	response, err = request(http.MethodGet, "/api/tremors", nil, globalAuthTokens[1], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	json.NewDecoder(response.Body).Decode(&tremors2)
+
+	if !reflect.DeepEqual(tremors1, tremors2) {
+		t.Error("failed to get user 2's tremors while logged in as user 1")
+	}
+
+	// test getting user 2 meds while logged in as user 1
+	var meds1 []api.Medicine
+	var meds2 []api.Medicine
+	response, err = request(http.MethodGet, "/api/meds?uid=2", nil, globalAuthTokens[0], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	json.NewDecoder(response.Body).Decode(&meds1)
+	response, err = request(http.MethodGet, "/api/meds", nil, globalAuthTokens[1], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	json.NewDecoder(response.Body).Decode(&meds2)
+
+	if !reflect.DeepEqual(meds1, meds2) {
+		t.Error("failed to get user 2's meds while logged in as user 1")
+	}
+
+	// the ?since= and ?date= variants must also honour the uid
+	since := time.Now().AddDate(0, 0, -6).Format(time.RFC3339)
+	response, err = request(http.MethodGet, "/api/tremors?uid=2&since="+since, nil, globalAuthTokens[0], http.StatusOK)
+	if err != nil {
+		t.Error(err)
+	}
+	json.NewDecoder(response.Body).Decode(&tremors1)
+	for _, tremor := range tremors1 {
+		if tremor.UID != 2 {
+			t.Error("GET /api/tremors?uid=2&since= returned a tremor for uid", tremor.UID)
+		}
 	}
 }
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A Store keeps the token buckets for every key. MemoryStore is enough for a single server,
+// servers behind a load balancer need a shared implementation so limits apply across all of them.
+type Store interface {
+	// Take removes a token from the bucket for key, which refills at rate tokens per second up to burst tokens.
+	// If the bucket is empty it returns false, and how long until the next token is available.
+	Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error)
+}
+
+// A Limiter allows bursts of requests per key, then limits them to a steady rate
+type Limiter struct {
+	Store Store
+	Rate  float64
+	Burst int
+}
+
+// New returns a limiter allowing burst requests per key, refilling one every per
+func New(store Store, burst int, per time.Duration) *Limiter {
+	return &Limiter{store, 1 / per.Seconds(), burst}
+}
+
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	return l.Store.Take(key, l.Rate, l.Burst, time.Now())
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(key string, rate float64, burst int, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// every so often forget about buckets which have refilled, they are the same as new ones
+	s.takes++
+	if s.takes%1000 == 0 {
+		for k, b := range s.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{float64(burst), now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait, nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
@@ -0,0 +1,155 @@
+// Package scoring turns the raw accelerometer readings of a tremor test into a score from 0 to 100.
+//
+// Each axis has its mean (mostly gravity) taken out, is windowed and transformed with an FFT, and the power
+// spectra of the three axes are added up so the result doesn't depend on how the phone is held. The power
+// between 3 and 12Hz, where Parkinsonian and essential tremors are, gives the amplitude of the tremor, and
+// the strongest frequency in that band turns it into how far the hand moves. Scores grow with the log of
+// that distance, so 1cm scores about 23, 3cm 46, 10cm 79 and 20cm or more 100, roughly following the steps
+// of clinical rating scales.
+package scoring
+
+import (
+	"errors"
+	"math"
+	"math/cmplx"
+)
+
+// Version is recorded with every score, since scores from different versions can't be compared.
+// It must change whenever the score of any input would.
+const Version = "fft-1"
+
+// The band tremors are looked for in, in Hz
+const (
+	MinFrequency = 3.0
+	MaxFrequency = 12.0
+)
+
+const (
+	// a test has to be long enough to tell frequencies half a hertz apart
+	minSeconds = 2.0
+	// displacement that scores 100, in cm
+	maxDisplacement = 20.0
+)
+
+var (
+	ErrTooShort = errors.New("a test must be at least two seconds long")
+	ErrRate     = errors.New("the sample rate must be more than twice the highest tremor frequency")
+)
+
+// An Analysis describes the tremor in a recording
+type Analysis struct {
+	// the strongest frequency in the band, in Hz
+	Frequency float64 `json:"frequency"`
+	// the power of the acceleration in the band, in (m/s²)²
+	BandPower float64 `json:"bandPower"`
+	// the amplitude of a sine wave with the band's power, in m/s²
+	Acceleration float64 `json:"acceleration"`
+	// how far the hand moves either side of the middle at the strongest frequency, in cm
+	Displacement float64 `json:"displacement"`
+	Score        int     `json:"score"`
+}
+
+// Analyze scores accelerometer readings of x, y and z in m/s², taken rate times a second.
+// The same readings always get the same analysis.
+func Analyze(rate float64, accel [][3]float64) (analysis Analysis, err error) {
+	if rate <= 2*MaxFrequency {
+		return analysis, ErrRate
+	}
+	if float64(len(accel)) < minSeconds*rate {
+		return analysis, ErrTooShort
+	}
+
+	n := len(accel)
+	size := 1
+	for size < n {
+		size *= 2
+	}
+	window := make([]float64, n)
+	var windowPower float64
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+		windowPower += window[i] * window[i]
+	}
+
+	// one-sided power spectrum summed over the axes, scaled so the powers of the bins add up to the
+	// mean square of the signal
+	power := make([]float64, size/2+1)
+	for axis := 0; axis < 3; axis++ {
+		var mean float64
+		for _, sample := range accel {
+			mean += sample[axis]
+		}
+		mean /= float64(n)
+		signal := make([]complex128, size)
+		for i, sample := range accel {
+			signal[i] = complex((sample[axis]-mean)*window[i], 0)
+		}
+		fft(signal)
+		for k := range power {
+			p := math.Pow(cmplx.Abs(signal[k]), 2) / (float64(size) * windowPower)
+			if k != 0 && k != size/2 {
+				p *= 2
+			}
+			power[k] += p
+		}
+	}
+
+	binWidth := rate / float64(size)
+	peak := -1
+	for k := range power {
+		frequency := float64(k) * binWidth
+		if frequency < MinFrequency || frequency > MaxFrequency {
+			continue
+		}
+		analysis.BandPower += power[k]
+		if peak < 0 || power[k] > power[peak] {
+			peak = k
+		}
+	}
+	if analysis.BandPower == 0 {
+		return analysis, nil
+	}
+
+	// the peak is somewhere between bins, fit a parabola through it and its neighbours
+	offset := 0.0
+	if peak > 0 && peak < len(power)-1 {
+		a, b, c := power[peak-1], power[peak], power[peak+1]
+		if denominator := a - 2*b + c; denominator != 0 {
+			offset = 0.5 * (a - c) / denominator
+		}
+	}
+	analysis.Frequency = (float64(peak) + offset) * binWidth
+	analysis.Acceleration = math.Sqrt(2 * analysis.BandPower)
+	omega := 2 * math.Pi * analysis.Frequency
+	analysis.Displacement = 100 * analysis.Acceleration / (omega * omega)
+	score := math.Round(100 * math.Log1p(analysis.Displacement) / math.Log1p(maxDisplacement))
+	analysis.Score = int(math.Min(100, math.Max(0, score)))
+	return analysis, nil
+}
+
+// fft transforms x in place, its length must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	// reorder by bit-reversed index, then combine ever larger transforms
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for length := 2; length <= n; length <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(length)))
+		for start := 0; start < n; start += length {
+			w := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				even, odd := x[start+k], w*x[start+k+length/2]
+				x[start+k], x[start+k+length/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
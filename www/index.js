@@ -25,6 +25,8 @@ function loadCanvas() {
 		})
 	}
 
+	respondToInvitations()
+
 	// get the list of users who have shared their data with the logged in user
 	// use this to populate the user select input
 	fetchWithAuth('api/users/links/in').then(
@@ -39,6 +41,30 @@ function loadCanvas() {
 	})
 }
 
+// ask the logged in user about every pending invitation to see someone else's data
+function respondToInvitations() {
+	let token = localStorage.getItem('token')
+	if (token === null) {
+		return
+	}
+	let payload = token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')
+	let uid = JSON.parse(atob(payload)).uid
+
+	fetchWithAuth('api/users/links/invitations').then(
+		response => response.json()
+	).then(function(invitations) {
+		invitations.filter(i => i.to == uid && i.status == 'pending').forEach(function(invitation) {
+			let shared = invitation.scopes.join(', ')
+			if (invitation.canWrite) {
+				shared += ', and adding records for them'
+			}
+			let action = confirm(invitation.name + ' (' + invitation.email + ') wants to share their Tremr data (' + shared + ') with you. Accept?')
+				? 'accept' : 'decline'
+			fetchWithAuth('api/users/links/invitations/' + invitation.lid + '/' + action, false, {method: 'POST'})
+		})
+	})
+}
+
 function WeekFunction() {
 	let oneWeekAgo = new Date();
 	oneWeekAgo.setDate(oneWeekAgo.getDate() - 6);
@@ -67,10 +93,49 @@ function YearFunction() {
 }
 
 function onSignOut() {
+	let token = localStorage.getItem('token')
 	localStorage.removeItem('token')
+	localStorage.removeItem('refresh')
+	if (token !== null) {
+		// revoke the session on the server too, so a copied token stops working
+		fetch('/api/auth/signout', {
+			method: 'POST',
+			headers: {
+				'Authorization': token
+			},
+			keepalive: true
+		})
+	}
 }
 
-function fetchWithAuth(url) {
+function redirectToSignin() {
+	localStorage.removeItem('token')
+	localStorage.removeItem('refresh')
+	window.location.replace('/signin.html')
+}
+
+// exchange the refresh token for a new access token, resolves to false if the session is over
+function refreshToken() {
+	let refresh = localStorage.getItem('refresh')
+	if (refresh === null) {
+		return Promise.resolve(false)
+	}
+	return fetch('/api/auth/refresh', {
+		method: 'POST',
+		body: JSON.stringify({'refresh': refresh})
+	}).then(response => {
+		if (response.status != 200) {
+			return false
+		}
+		return response.json().then(tokens => {
+			localStorage.setItem('token', tokens.token)
+			localStorage.setItem('refresh', tokens.refresh)
+			return true
+		})
+	})
+}
+
+function fetchWithAuth(url, retried, options) {
 	// get the jwt from window.localStorage
 	let token = localStorage.getItem('token')
 	if (token === null) {
@@ -79,28 +144,48 @@ function fetchWithAuth(url) {
 	}
 
 	// fetch with the jwt in the authorization header
-	return fetch(url, {
+	return fetch(url, Object.assign({}, options, {
 		headers: {
 			'Authorization': token
 		}
-	}).then(response => {
+	})).then(response => {
 		if (response.status == 401) {
-			// if server returned StatusUnauthorized, clear the token and redirect to signin page
-			localStorage.removeItem('token')
-			window.location.replace('/signin.html')
+			// access tokens are short-lived, try to refresh once before giving up
+			if (retried) {
+				redirectToSignin()
+				return response
+			}
+			return refreshToken().then(ok => {
+				if (!ok) {
+					// if the session is over, clear the tokens and redirect to signin page
+					redirectToSignin()
+					return response
+				}
+				return fetchWithAuth(url, true, options)
+			})
 		}
 		return response
 	})
 }
 
-function getTremors(uid) {
-	let url = "/api/tremors"
+// the chart shows at most a year, so only that much is loaded, a page at a time
+async function getTremors(uid) {
+	let oneYearAgo = new Date()
+	oneYearAgo.setFullYear(oneYearAgo.getFullYear() - 1)
+	let url = "/api/tremors?from=" + encodeURIComponent(oneYearAgo.toISOString().split('.')[0] + 'Z')
 	if (uid != 0) {
-		url = url + "?uid=" + uid
+		url = url + "&uid=" + uid
 	}
-	return fetchWithAuth(url).then(
-		response => response.json()
-	)
+	let tremors = []
+	let cursor = ""
+	do {
+		let page = await fetchWithAuth(url + "&cursor=" + cursor).then(
+			response => response.json()
+		)
+		tremors = tremors.concat(page.tremors)
+		cursor = page.next
+	} while (cursor)
+	return tremors
 }
 
 function getMedicines(uid) {
@@ -135,9 +220,10 @@ async function loadData(uid) {
 	let medicinePromise = getMedicines(uid)
 	let exercisePromise = getExercises(uid)
 
-	let tremors = await tremorPromise.catch(err => console.log("failed to get tremors", err))
-	let medicines = await medicinePromise.catch(err => console.log("failed to get medicines", err))
-	let exercises = await exercisePromise.catch(err => console.log("failed to get exercises", err))
+	// another user may not share everything, so anything that fails to load is left empty
+	let tremors = await tremorPromise.catch(err => { console.log("failed to get tremors", err); return [] })
+	let medicines = await medicinePromise.catch(err => { console.log("failed to get medicines", err); return [] })
+	let exercises = await exercisePromise.catch(err => { console.log("failed to get exercises", err); return [] })
 
 	return new Data(tremors, medicines, exercises)
 }
@@ -21,9 +21,12 @@ function onSignin() {
 		if (response.status != 200) {
 			response.text().then(errorText => alert(errorText))
 		} else {
-			response.text().then(token => {
-				localStorage.setItem('token', token)
-				window.location.replace('/index.html')
+			response.json().then(tokens => {
+				if (tokens.mfaRequired) {
+					onMFA(tokens.mfaToken)
+					return
+				}
+				storeTokens(tokens)
 			})
 		}
 		return false
@@ -33,4 +36,62 @@ function onSignin() {
 	return false
 }
 
+function storeTokens(tokens) {
+	localStorage.setItem('token', tokens.token)
+	localStorage.setItem('refresh', tokens.refresh)
+	window.location.replace('/index.html')
+}
+
+// the password was right, now ask for a code from the user's authenticator app
+function onMFA(mfaToken) {
+	code = prompt('Enter the code from your authenticator app, or a recovery code')
+	if (code == null) {
+		return
+	}
+	fetch('/api/auth/signin/mfa', {
+		method: 'POST',
+		body: JSON.stringify({'mfaToken': mfaToken, 'code': code})
+	}).then(response => {
+		if (response.status != 200) {
+			response.text().then(errorText => alert(errorText))
+		} else {
+			response.json().then(storeTokens)
+		}
+	}).catch(error => {
+		alert(error)
+	})
+}
+
+// adds a button for every identity provider users can sign in with
+function showProviders() {
+	fetch('/api/auth/oidc').then(response => response.json()).then(providers => {
+		div = document.getElementById('oidc_providers')
+		providers.forEach(provider => {
+			button = document.createElement('button')
+			button.textContent = 'Sign in with ' + provider.displayName
+			button.onclick = () => window.location.assign('/api/auth/oidc/' + encodeURIComponent(provider.name) + '/login')
+			div.appendChild(document.createElement('br'))
+			div.appendChild(button)
+		})
+	}).catch(error => console.log(error))
+}
+
+// identity provider signins come back to this page with the result in the url fragment
+function onProviderResult() {
+	if (!window.location.hash) {
+		return
+	}
+	result = new URLSearchParams(window.location.hash.substring(1))
+	history.replaceState(null, '', window.location.pathname)
+	if (result.get('error')) {
+		alert(result.get('error'))
+	} else if (result.get('mfaToken')) {
+		onMFA(result.get('mfaToken'))
+	} else if (result.get('token')) {
+		storeTokens({'token': result.get('token'), 'refresh': result.get('refresh')})
+	}
+}
+
 document.getElementById('signin_form').onsubmit = onSignin
+showProviders()
+onProviderResult()
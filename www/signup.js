@@ -35,6 +35,7 @@ function onSignup() {
 		if (response.status != 200) {
 			response.text().then(errorText => alert(errorText))
 		} else {
+			alert('We sent you an email with a code to verify your address')
 			window.location.replace('/signin.html')
 		}
 		return false